@@ -2,11 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/raymondmars/go-delayqueue/internal/app/core"
 	"github.com/raymondmars/go-delayqueue/internal/app/message"
@@ -20,6 +26,10 @@ const (
 	DEFAULT_HOST      = "0.0.0.0"
 	DEFAULT_PORT      = "3450"
 	DEFAULT_CONN_TYPE = "tcp"
+	DEFAULT_TICK      = "1s"
+
+	DEFAULT_LATE_TOLERANCE   = "0s"
+	DEFAULT_SHUTDOWN_TIMEOUT = "30s"
 )
 
 var delayQueue *core.DelayQueue
@@ -44,24 +54,118 @@ func main() {
 	port := common.GetEvnWithDefaultVal("CONN_PORT", DEFAULT_PORT)
 	conType := common.GetEvnWithDefaultVal("CONN_TYPE", DEFAULT_CONN_TYPE)
 
-	delayQueue = core.GetDelayQueue(notify.BuildExecutor)
+	// the resolution of the delay queue, such as 1s or 100ms
+	tick, err := time.ParseDuration(common.GetEvnWithDefaultVal("TIME_WHEEL_TICK", DEFAULT_TICK))
+	if err != nil {
+		log.Fatal("Invalid TIME_WHEEL_TICK: ", err)
+	}
+
+	// what to do with the tasks that became overdue while the server was down: run, skip or dead-letter
+	latePolicy := core.StringToLatePolicy(common.GetEvnWithDefaultVal("LATE_EXECUTION_POLICY", "run"))
+	if latePolicy == core.LatePolicy(0) {
+		log.Fatal("Invalid LATE_EXECUTION_POLICY")
+	}
+	lateTolerance, err := time.ParseDuration(common.GetEvnWithDefaultVal("LATE_EXECUTION_TOLERANCE", DEFAULT_LATE_TOLERANCE))
+	if err != nil {
+		log.Fatal("Invalid LATE_EXECUTION_TOLERANCE: ", err)
+	}
+
+	// the retry policy of the failed tasks
+	retryPolicy := core.DefaultRetryPolicy()
+	retryPolicy.MaxAttempts, _ = strconv.Atoi(common.GetEvnWithDefaultVal("RETRY_MAX_ATTEMPTS", strconv.Itoa(core.DEFAULT_RETRY_MAX_ATTEMPTS)))
+	if retryPolicy.InitialBackoff, err = time.ParseDuration(common.GetEvnWithDefaultVal("RETRY_INITIAL_BACKOFF", core.DEFAULT_RETRY_INITIAL_BACKOFF.String())); err != nil {
+		log.Fatal("Invalid RETRY_INITIAL_BACKOFF: ", err)
+	}
+	if retryPolicy.MaxBackoff, err = time.ParseDuration(common.GetEvnWithDefaultVal("RETRY_MAX_BACKOFF", core.DEFAULT_RETRY_MAX_BACKOFF.String())); err != nil {
+		log.Fatal("Invalid RETRY_MAX_BACKOFF: ", err)
+	}
+
+	// how long an execution can take before its task is executed again, such as after a crash
+	leaseDuration, err := time.ParseDuration(common.GetEvnWithDefaultVal("EXECUTION_LEASE_DURATION", core.DEFAULT_LEASE_DURATION.String()))
+	if err != nil {
+		log.Fatal("Invalid EXECUTION_LEASE_DURATION: ", err)
+	}
+
+	// the executions which run at the same time, and the due tasks which wait for them
+	poolWorkers, _ := strconv.Atoi(common.GetEvnWithDefaultVal("WORKER_POOL_SIZE", strconv.Itoa(core.DEFAULT_POOL_WORKERS)))
+	poolBuffer, _ := strconv.Atoi(common.GetEvnWithDefaultVal("WORKER_POOL_BUFFER", strconv.Itoa(core.DEFAULT_POOL_BUFFER)))
+	// the executions of each notify way which run at the same time, 0 means the size of the worker pool
+	httpConcurrency, _ := strconv.Atoi(common.GetEvnWithDefaultVal("HTTP_NOTIFY_CONCURRENCY", "0"))
+	pubConcurrency, _ := strconv.Atoi(common.GetEvnWithDefaultVal("SUBPUB_NOTIFY_CONCURRENCY", "0"))
+
+	// how long the final state of a task can be queried
+	statusRetention, err := time.ParseDuration(common.GetEvnWithDefaultVal("TASK_STATUS_RETENTION", core.DEFAULT_STATUS_RETENTION.String()))
+	if err != nil {
+		log.Fatal("Invalid TASK_STATUS_RETENTION: ", err)
+	}
+
+	// how long a pushed task is returned again to the pushes with the same id or idempotency key
+	idempotencyRetention, err := time.ParseDuration(common.GetEvnWithDefaultVal("IDEMPOTENCY_RETENTION", core.DEFAULT_IDEMPOTENCY_RETENTION.String()))
+	if err != nil {
+		log.Fatal("Invalid IDEMPOTENCY_RETENTION: ", err)
+	}
+
+	delayQueue = core.New(
+		core.WithTaskExecutor(notify.BuildExecutor),
+		core.WithTick(tick),
+		core.WithLatePolicy(latePolicy),
+		core.WithLateTolerance(lateTolerance),
+		core.WithDefaultRetryPolicy(retryPolicy),
+		core.WithLeaseDuration(leaseDuration),
+		core.WithWorkerPool(poolWorkers, poolBuffer),
+		core.WithModeConcurrency(notify.HTTP, httpConcurrency),
+		core.WithModeConcurrency(notify.SubPub, pubConcurrency),
+		core.WithStatusRetention(statusRetention),
+		core.WithIdempotencyRetention(idempotencyRetention),
+	)
+
+	// export or import a snapshot of the tasks instead of serving, the delay queue is not started meanwhile
+	if len(os.Args) > 1 {
+		if err := runSnapshotCommand(delayQueue, os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	go delayQueue.Start()
 
 	l, err := net.Listen(conType, fmt.Sprintf("%s:%s", host, port))
 	if err != nil {
 		log.Error("Listen error: ", err)
 	}
-	defer l.Close()
 	log.Infoln("Listening on " + host + ":" + port)
-	for {
-		// Listen for an incoming connection.
-		conn, err := l.Accept()
-		if err != nil {
-			fmt.Println("Error accepting: ", err.Error())
-			os.Exit(1)
+	go func() {
+		for {
+			// Listen for an incoming connection.
+			conn, err := l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				fmt.Println("Error accepting: ", err.Error())
+				os.Exit(1)
+			}
+			// Handle connections in a new goroutine.
+			go handleRequest(conn)
 		}
-		// Handle connections in a new goroutine.
-		go handleRequest(conn)
+	}()
+
+	// stop the delay queue gracefully, so a rolling deploy does not lose or double fire tasks
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Infoln("Receive signal: " + sig.String() + ", shutting down...")
+	l.Close()
+
+	shutdownTimeout, err := time.ParseDuration(common.GetEvnWithDefaultVal("SHUTDOWN_TIMEOUT", DEFAULT_SHUTDOWN_TIMEOUT))
+	if err != nil {
+		shutdownTimeout, _ = time.ParseDuration(DEFAULT_SHUTDOWN_TIMEOUT)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := delayQueue.Stop(ctx); err != nil {
+		log.Error("Stop delay queue error: ", err)
 	}
 }
 
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/core"
+)
+
+const snapshotUsage = `usage:
+  server export [-o FILE]                      write the tasks to FILE or the standard output
+  server import [-overwrite] [-rebase] [FILE]  read the tasks from FILE or the standard input`
+
+// move the tasks between delay queues, such as to a new redis instance:
+// server export -o tasks.jsonl
+// server import -overwrite tasks.jsonl
+func runSnapshotCommand(queue *core.DelayQueue, args []string) error {
+	switch args[0] {
+	case "export":
+		flags := flag.NewFlagSet("export", flag.ContinueOnError)
+		output := flags.String("o", "-", "the file to write the snapshot to, - is the standard output")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		var w io.Writer = os.Stdout
+		if *output != "-" {
+			file, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			w = file
+		}
+		exported, err := queue.Export(w)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "exported %d tasks\n", exported)
+		return nil
+	case "import":
+		flags := flag.NewFlagSet("import", flag.ContinueOnError)
+		overwrite := flags.Bool("overwrite", false, "replace the conflicting tasks and schedules instead of skipping the imported ones")
+		rebase := flags.Bool("rebase", false, "keep the delays the tasks had at the export instead of their due times")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		var r io.Reader = os.Stdin
+		if input := flags.Arg(0); input != "" && input != "-" {
+			file, err := os.Open(input)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			r = file
+		}
+		options := core.ImportOptions{Rebase: *rebase}
+		if *overwrite {
+			options.Conflict = core.ImportOverwrite
+		}
+		result, err := queue.Import(r, options)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "imported %d tasks, overwritten %d, skipped %d\n", result.Imported, result.Overwritten, result.Skipped)
+		return nil
+	default:
+		return errors.New(snapshotUsage)
+	}
+}
@@ -0,0 +1,229 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+)
+
+// ErrDuplicateTaskId is the result of an id which appears again in a batch delete
+var ErrDuplicateTaskId = errors.New("the task appears twice in the batch")
+
+// PushItem is a task of a batch push
+type PushItem struct {
+	// the delay from now, it is not used if DueAt is set
+	Delay    time.Duration
+	DueAt    time.Time
+	TaskMode notify.NotifyMode
+	TaskData interface{}
+	Options  []TaskOption
+}
+
+// UpdateItem is a task of a batch update
+type UpdateItem struct {
+	TaskId   string
+	TaskMode notify.NotifyMode
+	TaskData string
+}
+
+// BatchResult is the result of an item of a batch, the id of its task or its error
+type BatchResult struct {
+	Id  string
+	Err error
+}
+
+// the tasks changed by a batch, each of them once in the order they were changed
+type changedTasks struct {
+	tasks []*Task
+	seen  map[*Task]bool
+}
+
+func (ct *changedTasks) add(task *Task) {
+	if task == nil || ct.seen[task] {
+		return
+	}
+	if ct.seen == nil {
+		ct.seen = map[*Task]bool{}
+	}
+	ct.seen[task] = true
+	ct.tasks = append(ct.tasks, task)
+}
+
+// PushBatch adds many tasks to the delay queue, they are persisted in one operation.
+// Every item has its own result, an invalid item does not stop the others.
+// If the persistence fails, none of the new tasks is added and the error is returned as well.
+func (dq *DelayQueue) PushBatch(items []PushItem) ([]BatchResult, error) {
+	now := dq.clock.Now()
+	results := make([]BatchResult, len(items))
+	tasks := make([]*Task, len(items))
+	clientIds := make([]bool, len(items))
+	for i, item := range items {
+		dueAt := item.DueAt
+		if dueAt.IsZero() {
+			dueAt = now.Add(item.Delay)
+		}
+		if dq.delayToTicks(dueAt.Sub(now)) <= 0 {
+			results[i].Err = fmt.Errorf("the due time rounds to zero ticks of %v from now, current is: %v", dq.tick, dueAt.Format(time.RFC3339Nano))
+			continue
+		}
+		tasks[i], clientIds[i] = dq.newTask(dueAt, "", item.TaskMode, taskDataToString(item.TaskData), item.Options...)
+	}
+
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	changed := &changedTasks{}
+	// the task each item has added or changed
+	saved := make([]*Task, len(tasks))
+	// the pending tasks as they were before the debounced pushes of the batch
+	originals := map[*Task]*Task{}
+	for i, task := range tasks {
+		if task == nil {
+			continue
+		}
+		if pending := dq.pendingByKey(task.Key); pending != nil && originals[pending] == nil {
+			originals[pending] = pending.clone()
+		}
+		pushed, changedTask, err := dq.addTask(task, clientIds[i], true)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Id = pushed.Id
+		saved[i] = changedTask
+		changed.add(changedTask)
+	}
+	if err := dq.Persistence.SaveBatch(changed.tasks); err != nil {
+		// nothing has been persisted, take the new tasks off the time wheel and undo the debounced pushes
+		for i, task := range tasks {
+			if task == nil || saved[i] != task {
+				continue
+			}
+			dq.wheel.remove(task)
+			delete(dq.TaskQueryTable, task.Id)
+			dq.forgetKey(task)
+			dq.forgetOccurrence(task)
+			if key := idempotencyKeyOf(task, clientIds[i]); key != "" && dq.idempotencyRetention > 0 {
+				if err := dq.Persistence.ReleaseIdempotencyKey(key, task.Id); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+		for pending, original := range originals {
+			if dq.TaskQueryTable[pending.Id] == pending {
+				dq.undoPushOnKey(pending, original)
+			}
+		}
+		for i := range results {
+			if saved[i] != nil {
+				results[i] = BatchResult{Err: err}
+			}
+		}
+		return results, err
+	}
+	for i, task := range tasks {
+		if task != nil {
+			dq.emitAdded(task, saved[i])
+		}
+	}
+	return results, nil
+}
+
+// UpdateBatch changes the notify mode and data of many pending tasks, they are persisted in one operation.
+// The tasks are only changed once they are persisted.
+func (dq *DelayQueue) UpdateBatch(items []UpdateItem) ([]BatchResult, error) {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	results := make([]BatchResult, len(items))
+	// the changed copies of the pending tasks
+	changed := &changedTasks{}
+	pending := []*Task{}
+	copies := map[*Task]*Task{}
+	for i, item := range items {
+		task, ok := dq.TaskQueryTable[item.TaskId]
+		if !ok {
+			results[i].Err = ErrTaskNotFound
+			continue
+		}
+		updated, ok := copies[task]
+		if !ok {
+			updated = task.clone()
+			copies[task] = updated
+			pending = append(pending, task)
+		}
+		updated.TaskMode = item.TaskMode
+		updated.TaskData = item.TaskData
+		results[i].Id = task.Id
+		changed.add(updated)
+	}
+	if err := dq.Persistence.SaveBatch(changed.tasks); err != nil {
+		batchFailed(results, err)
+		return results, err
+	}
+	for _, task := range pending {
+		task.TaskMode = copies[task].TaskMode
+		task.TaskData = copies[task].TaskData
+		dq.emit(EventUpdate, task, nil, 0)
+	}
+	return results, nil
+}
+
+// DeleteBatch cancels many pending or waiting tasks, the pending ones are removed from the persistence in one operation.
+// The tasks are only cancelled once they are removed from the persistence.
+func (dq *DelayQueue) DeleteBatch(taskIds []string) ([]BatchResult, error) {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	results := make([]BatchResult, len(taskIds))
+	pending := make([]*Task, len(taskIds))
+	waiting := make([]*Task, len(taskIds))
+	deleted := []string{}
+	found := map[string]bool{}
+	for i, taskId := range taskIds {
+		if found[taskId] {
+			results[i].Err = ErrDuplicateTaskId
+			continue
+		}
+		if task, ok := dq.TaskQueryTable[taskId]; ok {
+			pending[i] = task
+			deleted = append(deleted, taskId)
+		} else if waiting[i] = dq.Persistence.GetWaiting(taskId); waiting[i] == nil {
+			results[i].Err = ErrTaskNotFound
+			continue
+		}
+		found[taskId] = true
+		results[i].Id = taskId
+	}
+	if err := dq.Persistence.DeleteBatch(deleted); err != nil {
+		batchFailed(results, err)
+		return results, err
+	}
+	for i := range taskIds {
+		if task := pending[i]; task != nil {
+			dq.wheel.remove(task)
+			delete(dq.TaskQueryTable, task.Id)
+			dq.forgetKey(task)
+			dq.forgetOccurrence(task)
+			dq.finish(task, TaskCancelled)
+			dq.emit(EventDelete, task, nil, 0)
+		} else if task := waiting[i]; task != nil {
+			if err := dq.Persistence.DeleteWaiting(task.Id); err != nil {
+				results[i] = BatchResult{Err: err}
+				continue
+			}
+			dq.finish(task, TaskCancelled)
+			dq.emit(EventDelete, task, nil, 0)
+		}
+	}
+	return results, nil
+}
+
+// the items which would have been applied fail with the error of the persistence
+func batchFailed(results []BatchResult, err error) {
+	for i := range results {
+		if results[i].Err == nil {
+			results[i] = BatchResult{Err: err}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+// fails every batch operation
+type testFailingBatchDb struct {
+	*testMemoryDb
+}
+
+func (td *testFailingBatchDb) SaveBatch(tasks []*Task) error {
+	return errors.New("connection refused")
+}
+
+func (td *testFailingBatchDb) DeleteBatch(taskIds []string) error {
+	return errors.New("connection refused")
+}
+
+func TestPushBatch(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	dueAt := time.Now().Add(time.Hour)
+	results, err := queue.PushBatch([]PushItem{
+		{Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "first", Options: []TaskOption{WithTag("tenant", "a")}},
+		{DueAt: dueAt, TaskMode: notify.SubPub, TaskData: "second"},
+		{Delay: time.Millisecond, TaskMode: notify.HTTP, TaskData: "too soon"},
+		{Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "third", Options: []TaskOption{WithTaskId("order-1001")}},
+		{Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "duplicate", Options: []TaskOption{WithTaskId("order-1001")}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(results))
+	assert.NotEmpty(t, results[0].Id)
+	assert.Nil(t, results[0].Err)
+	assert.True(t, dueAt.Equal(queue.GetTask(results[1].Id).DueAt))
+	assert.NotNil(t, results[2].Err)
+	assert.Empty(t, results[2].Id)
+	assert.Equal(t, "order-1001", results[3].Id)
+	assert.Equal(t, "order-1001", results[4].Id)
+	assert.Equal(t, "third", queue.GetTask("order-1001").TaskData)
+
+	assert.Equal(t, 3, len(queue.TaskQueryTable))
+	assert.Equal(t, 3, len(db.GetList()))
+	assert.Equal(t, 1, db.batches)
+	assert.Equal(t, "a", db.tasks[results[0].Id].Tags["tenant"])
+}
+
+func TestPushBatchIsRolledBackWhenPersistenceFails(t *testing.T) {
+	db := &testFailingBatchDb{newTestMemoryDb()}
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	results, err := queue.PushBatch([]PushItem{
+		{Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "first", Options: []TaskOption{WithThrottle("user-1")}},
+		{Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "second"},
+	})
+	assert.NotNil(t, err)
+	for _, result := range results {
+		assert.Empty(t, result.Id)
+		assert.Equal(t, err, result.Err)
+	}
+	assert.Equal(t, 0, len(queue.TaskQueryTable))
+	assert.Nil(t, queue.pendingByKey("user-1"))
+}
+
+func TestPushBatchRollbackReleasesKeysAndUndoesDebounces(t *testing.T) {
+	memory := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(memory))
+	pending, _ := queue.Push(time.Hour, notify.HTTP, "pending", WithDebounce("user-1"))
+
+	queue.Persistence = &testFailingBatchDb{memory}
+	_, err := queue.PushBatch([]PushItem{
+		{Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "first", Options: []TaskOption{WithIdempotencyKey("req-1")}},
+		{Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "second", Options: []TaskOption{WithTaskId("order-1001")}},
+		{Delay: 2 * time.Hour, TaskMode: notify.SubPub, TaskData: "debounced", Options: []TaskOption{WithDebounce("user-1")}},
+	})
+	assert.NotNil(t, err)
+	restored := queue.GetTask(pending.Id)
+	assert.Equal(t, "pending", restored.TaskData)
+	assert.Equal(t, notify.HTTP, restored.TaskMode)
+	assert.Equal(t, pending.DueTick, restored.DueTick)
+	assert.Equal(t, 1, testWheelCount(queue.wheel))
+
+	// the retried pushes add the tasks instead of returning the ones which were rolled back
+	queue.Persistence = memory
+	first, err := queue.Push(time.Minute, notify.HTTP, "first", WithIdempotencyKey("req-1"))
+	assert.Nil(t, err)
+	assert.NotNil(t, queue.GetTask(first.Id))
+	second, _ := queue.Push(time.Minute, notify.HTTP, "second", WithTaskId("order-1001"))
+	assert.NotNil(t, queue.GetTask(second.Id))
+	assert.Equal(t, 3, len(memory.GetList()))
+}
+
+func TestUpdateAndDeleteBatchChangeNothingWhenPersistenceFails(t *testing.T) {
+	memory := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(memory))
+	recorder := &testEventRecorder{}
+	queue.OnUpdate(recorder.record)
+	queue.OnDelete(recorder.record)
+	tk, _ := queue.Push(time.Hour, notify.HTTP, "first")
+	queue.PushChain([]ChainTask{{Id: "a", Delay: time.Minute}, {Id: "b", DependsOn: []string{"a"}}})
+
+	queue.Persistence = &testFailingBatchDb{memory}
+	updated, err := queue.UpdateBatch([]UpdateItem{
+		{TaskId: tk.Id, TaskMode: notify.SubPub, TaskData: "updated"},
+		{TaskId: "not-exist", TaskMode: notify.HTTP, TaskData: "updated"},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, err, updated[0].Err)
+	assert.Equal(t, ErrTaskNotFound, updated[1].Err)
+	assert.Equal(t, "first", queue.GetTask(tk.Id).TaskData)
+	assert.Equal(t, notify.HTTP, queue.GetTask(tk.Id).TaskMode)
+
+	deleted, err := queue.DeleteBatch([]string{tk.Id, "b", "not-exist"})
+	assert.NotNil(t, err)
+	assert.Equal(t, err, deleted[0].Err)
+	assert.Equal(t, err, deleted[1].Err)
+	assert.Equal(t, ErrTaskNotFound, deleted[2].Err)
+	assert.NotNil(t, queue.GetTask(tk.Id))
+	assert.Equal(t, 2, testWheelCount(queue.wheel))
+	assert.NotNil(t, memory.GetWaiting("b"))
+	status, _ := queue.GetTaskStatus(tk.Id)
+	assert.Equal(t, TaskPending, status.State)
+
+	// no hook is called for the changes which were not applied
+	queue.Stop(context.Background())
+	assert.Equal(t, 0, recorder.count())
+}
+
+func TestUpdateAndDeleteBatch(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	results, _ := queue.PushBatch([]PushItem{
+		{Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "first"},
+		{Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "second"},
+		{Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "third"},
+	})
+
+	updated, err := queue.UpdateBatch([]UpdateItem{
+		{TaskId: results[0].Id, TaskMode: notify.SubPub, TaskData: "updated"},
+		{TaskId: "not-exist", TaskMode: notify.HTTP, TaskData: "updated"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, results[0].Id, updated[0].Id)
+	assert.Equal(t, ErrTaskNotFound, updated[1].Err)
+	assert.Equal(t, "updated", db.tasks[results[0].Id].TaskData)
+	assert.Equal(t, notify.SubPub, queue.GetTask(results[0].Id).TaskMode)
+
+	deleted, err := queue.DeleteBatch([]string{results[0].Id, results[1].Id, "not-exist", results[1].Id})
+	assert.Nil(t, err)
+	assert.Equal(t, results[1].Id, deleted[1].Id)
+	assert.Equal(t, ErrTaskNotFound, deleted[2].Err)
+	// the task is deleted once, the repeated id is reported as a duplicate
+	assert.Equal(t, ErrDuplicateTaskId, deleted[3].Err)
+	assert.Equal(t, 1, len(queue.TaskQueryTable))
+	assert.Equal(t, 1, len(db.GetList()))
+	status, _ := queue.GetTaskStatus(results[0].Id)
+	assert.Equal(t, TaskCancelled, status.State)
+	assert.Equal(t, 3, db.batches)
+}
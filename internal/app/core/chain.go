@@ -0,0 +1,221 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+)
+
+// ChainTask is a task of a chain, it is added to the time wheel once all the tasks it depends on have succeeded,
+// and it is cancelled if any of them is dead lettered or cancelled.
+type ChainTask struct {
+	// the id other tasks of the chain refer to, it is generated if it is empty
+	Id string
+	// the delay from the push for a task without dependencies,
+	// or from the time the last task it depends on succeeded
+	Delay    time.Duration
+	TaskMode notify.NotifyMode
+	TaskData interface{}
+	// the ids of the tasks of the chain it depends on
+	DependsOn []string
+	Options   []TaskOption
+}
+
+// Add a chain or a small DAG of tasks to the delay queue, returns the tasks in the given order.
+// The tasks without dependencies are added to the time wheel, the others wait in the persistence
+// until the tasks they depend on have succeeded.
+func (dq *DelayQueue) PushChain(chainTasks []ChainTask) ([]*Task, error) {
+	if len(chainTasks) == 0 {
+		return nil, errors.New("the chain has no task")
+	}
+	ids := make([]string, len(chainTasks))
+	index := map[string]int{}
+	for i, chainTask := range chainTasks {
+		ids[i] = chainTask.Id
+		if ids[i] == "" {
+			ids[i] = uuid.New().String()
+		}
+		if _, ok := index[ids[i]]; ok {
+			return nil, fmt.Errorf("the task %s appears twice in the chain", ids[i])
+		}
+		index[ids[i]] = i
+	}
+
+	now := dq.clock.Now()
+	tasks := make([]*Task, len(chainTasks))
+	for i, chainTask := range chainTasks {
+		task := &Task{
+			CreatedAt:         now,
+			TaskMode:          chainTask.TaskMode,
+			TaskData:          taskDataToString(chainTask.TaskData),
+			DelayAfterParents: chainTask.Delay,
+		}
+		for _, opt := range chainTask.Options {
+			opt(task)
+		}
+		task.Id = ids[i]
+		if task.Key != "" {
+			return nil, fmt.Errorf("the task %s of a chain can not be debounced or throttled", task.Id)
+		}
+		for _, parent := range chainTask.DependsOn {
+			if _, ok := index[parent]; !ok || parent == task.Id {
+				return nil, fmt.Errorf("the task %s depends on an unknown task %s", task.Id, parent)
+			}
+			task.Parents = append(task.Parents, parent)
+		}
+		if len(task.Parents) == 0 {
+			if dq.delayToTicks(chainTask.Delay) <= 0 {
+				return nil, fmt.Errorf("the delay time of the task %s rounds to zero ticks of %v, current is: %v", task.Id, dq.tick, chainTask.Delay)
+			}
+			task.State = TaskPending
+			task.DueAt = now.Add(chainTask.Delay)
+		} else {
+			if chainTask.Delay < 0 {
+				return nil, fmt.Errorf("the delay time of the task %s can not be negative", task.Id)
+			}
+			task.State = TaskWaiting
+		}
+		tasks[i] = task
+	}
+	for _, task := range tasks {
+		for _, parent := range task.Parents {
+			tasks[index[parent]].Children = append(tasks[index[parent]].Children, task.Id)
+		}
+	}
+	if hasCycle(tasks, index) {
+		return nil, errors.New("the dependencies of the chain have a cycle")
+	}
+
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	for _, task := range tasks {
+		if dq.taskExists(task.Id) {
+			return nil, fmt.Errorf("task already exists: %s", task.Id)
+		}
+	}
+	// the waiting tasks are saved first, so the children are there when a parent is due,
+	// the chain is only added to the time wheel once all of it is persisted
+	waiting := []*Task{}
+	roots := []*Task{}
+	for _, task := range tasks {
+		if task.State != TaskWaiting {
+			task.DueTick = dq.dueTickOf(task.DueAt)
+			roots = append(roots, task)
+			continue
+		}
+		if err := dq.Persistence.SaveWaiting(task); err != nil {
+			dq.discardWaiting(waiting)
+			return nil, err
+		}
+		waiting = append(waiting, task)
+	}
+	if err := dq.Persistence.SaveBatch(roots); err != nil {
+		dq.discardWaiting(waiting)
+		return nil, err
+	}
+	pushed := make([]*Task, len(tasks))
+	for i, task := range tasks {
+		if task.State == TaskPending {
+			dq.wheel.add(task)
+			dq.TaskQueryTable[task.Id] = task
+		}
+		dq.emit(EventPush, task, nil, 0)
+		pushed[i] = task.clone()
+	}
+	return pushed, nil
+}
+
+// delete the waiting tasks of a chain which could not be persisted
+func (dq *DelayQueue) discardWaiting(tasks []*Task) {
+	for _, task := range tasks {
+		if err := dq.Persistence.DeleteWaiting(task.Id); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// whether a task with the id is pending, running or waiting for its parents,
+// the caller must hold the lock
+func (dq *DelayQueue) taskExists(taskId string) bool {
+	if _, ok := dq.TaskQueryTable[taskId]; ok {
+		return true
+	}
+	if _, ok := dq.running[taskId]; ok {
+		return true
+	}
+	return dq.Persistence.GetWaiting(taskId) != nil
+}
+
+// whether the dependencies of the tasks have a cycle, the tasks are removed in topological order
+func hasCycle(tasks []*Task, index map[string]int) bool {
+	remaining := make([]int, len(tasks))
+	ready := []int{}
+	for i, task := range tasks {
+		remaining[i] = len(task.Parents)
+		if remaining[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	removed := 0
+	for len(ready) > 0 {
+		i := ready[0]
+		ready = ready[1:]
+		removed++
+		for _, child := range tasks[i].Children {
+			j := index[child]
+			if remaining[j]--; remaining[j] == 0 {
+				ready = append(ready, j)
+			}
+		}
+	}
+	return removed < len(tasks)
+}
+
+// add the children of a succeeded task to the time wheel once all of their parents have succeeded,
+// or cancel them and their descendants if the task did not succeed. the caller must hold the lock
+func (dq *DelayQueue) settleChildren(task *Task) {
+	for _, childId := range task.Children {
+		child := dq.Persistence.GetWaiting(childId)
+		if child == nil {
+			// it has been cancelled by another parent or deleted
+			continue
+		}
+		if task.State != TaskSucceeded {
+			dq.Persistence.DeleteWaiting(childId)
+			child.LastError = fmt.Sprintf("the parent task %s is %s", task.Id, task.State)
+			dq.finish(child, TaskCancelled)
+			continue
+		}
+
+		parents := []string{}
+		for _, parent := range child.Parents {
+			if parent != task.Id {
+				parents = append(parents, parent)
+			}
+		}
+		child.Parents = parents
+		if len(parents) > 0 {
+			if err := dq.Persistence.SaveWaiting(child); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		child.State = TaskPending
+		child.DueAt = dq.clock.Now().Add(child.DelayAfterParents)
+		child.DueTick = dq.dueTickOf(child.DueAt)
+		dq.wheel.add(child)
+		dq.TaskQueryTable[child.Id] = child
+		// the waiting task is kept if the pending one can not be persisted, so the child is not lost
+		if err := dq.Persistence.Save(child); err != nil {
+			log.Printf("the task %s of a chain can not be persisted: %v\n", child.Id, err)
+			continue
+		}
+		if err := dq.Persistence.DeleteWaiting(childId); err != nil {
+			log.Println(err)
+		}
+	}
+}
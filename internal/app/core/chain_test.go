@@ -0,0 +1,217 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+// fails the executions of the given contents and reports the others to a channel
+type testSelectiveNotify struct {
+	fail     string
+	executed chan string
+}
+
+func (tn *testSelectiveNotify) DoDelayTask(contents string) error {
+	if contents == tn.fail {
+		return errors.New("service unavailable")
+	}
+	tn.executed <- contents
+	return nil
+}
+
+func TestPushChainValidation(t *testing.T) {
+	testBeforeSetUp()
+	_, err := dq.PushChain(nil)
+	assert.NotNil(t, err)
+	_, err = dq.PushChain([]ChainTask{{Id: "a", Delay: time.Minute}, {Id: "a", Delay: time.Minute}})
+	assert.NotNil(t, err)
+	_, err = dq.PushChain([]ChainTask{{Id: "a", Delay: time.Minute}, {Id: "b", DependsOn: []string{"c"}}})
+	assert.NotNil(t, err)
+	_, err = dq.PushChain([]ChainTask{{Id: "a", Delay: time.Minute, DependsOn: []string{"a"}}})
+	assert.NotNil(t, err)
+	_, err = dq.PushChain([]ChainTask{{Id: "a"}})
+	assert.NotNil(t, err)
+	_, err = dq.PushChain([]ChainTask{
+		{Id: "a", Delay: time.Minute},
+		{Id: "b", DependsOn: []string{"a", "c"}},
+		{Id: "c", DependsOn: []string{"b"}},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(dq.TaskQueryTable))
+}
+
+// the number of tasks linked on the time wheel
+func testWheelCount(tw *timingWheel) int {
+	count := 0
+	for level, lv := range tw.levels {
+		for index := range lv.slots {
+			count += tw.quantity(level, index)
+		}
+	}
+	return count
+}
+
+func TestPushChainRejectsExistingIds(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	queue.Push(time.Hour, notify.HTTP, "pending", WithTaskId("pending"))
+	_, err := queue.PushChain([]ChainTask{{Id: "a", Delay: time.Minute}, {Id: "waiting", DependsOn: []string{"a"}}})
+	assert.Nil(t, err)
+
+	for _, id := range []string{"pending", "waiting"} {
+		_, err = queue.PushChain([]ChainTask{{Id: "x", Delay: time.Minute}, {Id: id, DependsOn: []string{"x"}}})
+		assert.NotNil(t, err, id)
+		_, err = queue.PushChain([]ChainTask{{Id: id, Delay: time.Minute}})
+		assert.NotNil(t, err, id)
+	}
+	assert.Equal(t, 2, len(queue.TaskQueryTable))
+	assert.Equal(t, 2, testWheelCount(queue.wheel))
+	assert.Equal(t, "pending", queue.GetTask("pending").TaskData)
+
+	// the task can be deleted, nothing is left behind on the time wheel
+	assert.Nil(t, queue.DeleteTask("pending"))
+	assert.Equal(t, 1, testWheelCount(queue.wheel))
+
+	_, err = queue.PushChain([]ChainTask{{Id: "keyed", Delay: time.Minute, Options: []TaskOption{WithDebounce("user-1")}}})
+	assert.NotNil(t, err)
+	assert.Nil(t, queue.GetTask("keyed"))
+}
+
+// fails to save the waiting tasks after the given number of them
+type testFailingWaitingDb struct {
+	*testMemoryDb
+	saves int
+}
+
+func (td *testFailingWaitingDb) SaveWaiting(task *Task) error {
+	if td.saves == 0 {
+		return errors.New("connection refused")
+	}
+	td.saves--
+	return td.testMemoryDb.SaveWaiting(task)
+}
+
+func TestPushChainIsNotAddedWhenPersistenceFails(t *testing.T) {
+	chain := []ChainTask{
+		{Id: "a", Delay: time.Minute},
+		{Id: "b", DependsOn: []string{"a"}},
+		{Id: "c", DependsOn: []string{"a"}},
+	}
+	memory := newTestMemoryDb()
+	for _, db := range []Persistence{&testFailingWaitingDb{testMemoryDb: memory, saves: 1}, &testFailingBatchDb{memory}} {
+		queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+		recorder := &testEventRecorder{}
+		recorder.registerAll(queue)
+		_, err := queue.PushChain(chain)
+		assert.NotNil(t, err)
+		assert.Nil(t, queue.Stop(context.Background()))
+
+		// the waiting tasks which were saved are deleted again
+		assert.Equal(t, 0, len(queue.TaskQueryTable))
+		assert.Equal(t, 0, testWheelCount(queue.wheel))
+		assert.Equal(t, 0, len(memory.GetWaitingList()))
+		assert.Equal(t, 0, len(memory.GetList()))
+		assert.Equal(t, 0, recorder.count())
+	}
+}
+
+func TestChainRunsAfterParentSucceeds(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testSelectiveNotify{executed: make(chan string, 10)}
+	queue := testRetryQueue(executor, db, RetryPolicy{MaxAttempts: 1})
+	defer queue.Stop(context.Background())
+
+	tasks, err := queue.PushChain([]ChainTask{
+		{Id: "billing", Delay: 50 * time.Millisecond, TaskMode: notify.HTTP, TaskData: "billing"},
+		{Id: "publish", Delay: 100 * time.Millisecond, TaskMode: notify.SubPub, TaskData: "publish", DependsOn: []string{"billing"}, Options: []TaskOption{WithTag("tenant", "a")}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, TaskPending, tasks[0].State)
+	assert.Equal(t, []string{"publish"}, tasks[0].Children)
+	assert.Equal(t, TaskWaiting, tasks[1].State)
+	assert.Equal(t, "a", tasks[1].Tags["tenant"])
+	status, _ := queue.GetTaskStatus("publish")
+	assert.Equal(t, TaskWaiting, status.State)
+	assert.Nil(t, queue.GetTask("publish"))
+
+	assert.Equal(t, "billing", <-executor.executed)
+	succeededAt := time.Now()
+	assert.Equal(t, "publish", <-executor.executed)
+	assert.True(t, time.Since(succeededAt) >= 80*time.Millisecond)
+	assert.Nil(t, db.GetWaiting("publish"))
+	assert.Eventually(t, func() bool {
+		status, _ := queue.GetTaskStatus("publish")
+		return status.State == TaskSucceeded
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestChainIsCancelledWhenParentIsDeadLettered(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testSelectiveNotify{fail: "refund", executed: make(chan string, 10)}
+	queue := testRetryQueue(executor, db, RetryPolicy{MaxAttempts: 1})
+	defer queue.Stop(context.Background())
+
+	// report waits for both billing and refund, notify waits for report
+	_, err := queue.PushChain([]ChainTask{
+		{Id: "billing", Delay: 30 * time.Millisecond, TaskMode: notify.HTTP, TaskData: "billing"},
+		{Id: "refund", Delay: 60 * time.Millisecond, TaskMode: notify.HTTP, TaskData: "refund"},
+		{Id: "report", TaskMode: notify.HTTP, TaskData: "report", DependsOn: []string{"billing", "refund"}},
+		{Id: "notify", TaskMode: notify.HTTP, TaskData: "notify", DependsOn: []string{"report"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "billing", <-executor.executed)
+	// one parent has succeeded, the other is still pending
+	assert.Eventually(t, func() bool {
+		waiting := db.GetWaiting("report")
+		return waiting != nil && len(waiting.Parents) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"refund"}, db.GetWaiting("report").Parents)
+
+	assert.Eventually(t, func() bool {
+		status, _ := queue.GetTaskStatus("notify")
+		return status != nil && status.State == TaskCancelled
+	}, time.Second, 10*time.Millisecond)
+	status, _ := queue.GetTaskStatus("report")
+	assert.Equal(t, TaskCancelled, status.State)
+	assert.Equal(t, "the parent task refund is dead-lettered", status.LastError)
+	assert.Nil(t, db.GetWaiting("report"))
+	assert.Nil(t, db.GetWaiting("notify"))
+	select {
+	case contents := <-executor.executed:
+		assert.Fail(t, "a cancelled task is executed", contents)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestChainSurvivesRestart(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	queue.Start()
+	_, err := queue.PushChain([]ChainTask{
+		{Id: "a", Delay: time.Hour, TaskMode: notify.HTTP, TaskData: "a"},
+		{Id: "b", Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "b", DependsOn: []string{"a"}},
+		{Id: "c", Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "c", DependsOn: []string{"b"}},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, queue.Stop(context.Background()))
+
+	restarted := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	restarted.Start()
+	defer restarted.Stop(context.Background())
+	assert.Equal(t, []string{"b"}, restarted.GetTask("a").Children)
+	status, _ := restarted.GetTaskStatus("c")
+	assert.Equal(t, TaskWaiting, status.State)
+
+	// deleting a task cancels the tasks which depend on it
+	assert.Nil(t, restarted.DeleteTask("a"))
+	status, _ = restarted.GetTaskStatus("b")
+	assert.Equal(t, TaskCancelled, status.State)
+	status, _ = restarted.GetTaskStatus("c")
+	assert.Equal(t, TaskCancelled, status.State)
+	assert.Equal(t, 0, len(db.waiting))
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// a started delay queue on a fake clock, with the default tick and wheel sizes
+func testFakeClockQueue(fake *clock.Fake, db Persistence, executed chan string) *DelayQueue {
+	queue := New(WithClock(fake), WithPersistence(db), WithTaskExecutor(testChanFactory(executed)))
+	queue.Start()
+	return queue
+}
+
+func testAssertExecuted(t *testing.T, executed chan string, expected ...string) {
+	for _, contents := range expected {
+		select {
+		case actual := <-executed:
+			assert.Equal(t, contents, actual)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s is not executed", contents)
+		}
+	}
+}
+
+// waits until every started queue on the fake clock waits for its next tick and pointer refresh,
+// so the due tasks of the last advance have been handed to the worker pool
+func testWaitIdle(t *testing.T, fake *clock.Fake, queues int) {
+	assert.Eventually(t, func() bool { return fake.Timers() == 2*queues }, 5*time.Second, time.Millisecond)
+}
+
+// advances the fake clock once the queues wait on it, and waits for them to process the passed ticks
+func testAdvance(t *testing.T, fake *clock.Fake, queues int, d time.Duration) {
+	testWaitIdle(t, fake, queues)
+	fake.Advance(d)
+	testWaitIdle(t, fake, queues)
+}
+
+// the tasks are still waiting in the time wheel
+func testAssertPending(t *testing.T, queue *DelayQueue, tasks ...*Task) {
+	for _, task := range tasks {
+		assert.NotNil(t, queue.GetTask(task.Id), "%s is executed early", task.TaskData)
+	}
+}
+
+func TestFakeClockWheelWrapAround(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	executed := make(chan string, 10)
+	queue := testFakeClockQueue(fake, newTestMemoryDb(), executed)
+	defer queue.Stop(context.Background())
+
+	// each task wraps around a level of the time wheel
+	delays := []time.Duration{59 * time.Second, 61 * time.Second, time.Hour + time.Second, 25 * time.Hour, 49*time.Hour + time.Minute}
+	tasks := make([]*Task, 0, len(delays))
+	for _, delay := range delays {
+		task, err := queue.Push(delay, notify.HTTP, delay.String())
+		assert.Nil(t, err)
+		tasks = append(tasks, task)
+	}
+	elapsed := time.Duration(0)
+	for i, delay := range delays {
+		testAdvance(t, fake, 1, delay-time.Second-elapsed)
+		testAssertPending(t, queue, tasks[i])
+		testAdvance(t, fake, 1, time.Second)
+		testAssertExecuted(t, executed, delay.String())
+		elapsed = delay
+	}
+	assert.Equal(t, 0, len(queue.TaskQueryTable))
+}
+
+func TestFakeClockRecovery(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	db := newTestMemoryDb()
+	executed := make(chan string, 10)
+	queue := testFakeClockQueue(fake, db, executed)
+	overdue, _ := queue.Push(time.Hour, notify.HTTP, "overdue")
+	pending, _ := queue.Push(3*time.Hour, notify.HTTP, "pending")
+	testAdvance(t, fake, 1, 30*time.Minute)
+	assert.Nil(t, queue.Stop(context.Background()))
+
+	// the queue is down while the first task becomes due
+	fake.Advance(90 * time.Minute)
+	queue = testFakeClockQueue(fake, db, executed)
+	defer queue.Stop(context.Background())
+	testWaitIdle(t, fake, 1)
+	testAssertPending(t, queue, overdue)
+	testAdvance(t, fake, 1, time.Second)
+	testAssertExecuted(t, executed, "overdue")
+
+	testAdvance(t, fake, 1, time.Hour-2*time.Second)
+	testAssertPending(t, queue, pending)
+	testAdvance(t, fake, 1, time.Second)
+	testAssertExecuted(t, executed, "pending")
+}
+
+func TestFakeClockRecurrence(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone database is not available")
+	}
+	fake := clock.NewFake(time.Date(2023, 3, 10, 12, 0, 0, 0, loc))
+	db := newTestMemoryDb()
+	executed := make(chan string, 10)
+	queue := testFakeClockQueue(fake, db, executed)
+	defer queue.Stop(context.Background())
+
+	// the occurrences cross the start of the daylight saving time
+	_, err = queue.PushSchedule(Schedule{Cron: "30 9 * * *", TimeZone: "America/New_York", MaxOccurrences: 3}, notify.HTTP, "report")
+	assert.Nil(t, err)
+	for i := 1; i <= 3; i++ {
+		testAdvance(t, fake, 1, 24*time.Hour)
+		testAssertExecuted(t, executed, "report")
+		// the next occurrence is armed before the execution is done
+		assert.Eventually(t, func() bool {
+			db.Lock()
+			defer db.Unlock()
+			return len(db.statuses) == i
+		}, 5*time.Second, time.Millisecond)
+	}
+	testAdvance(t, fake, 1, 24*time.Hour)
+	assert.Equal(t, uint64(3), queue.PoolStats().Submitted)
+	assert.Equal(t, 0, len(db.GetList()))
+
+	for i, dueAt := range testOccurrenceDueTimes(db, 3) {
+		dueAt = dueAt.In(loc)
+		assert.Equal(t, time.Date(2023, 3, 11+i, 9, 30, 0, 0, loc), dueAt)
+	}
+}
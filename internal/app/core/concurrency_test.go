@@ -0,0 +1,135 @@
+package core
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// counts the executed tasks
+type testCountNotify struct {
+	executed *int64
+}
+
+func (tn *testCountNotify) DoDelayTask(contents string) error {
+	atomic.AddInt64(tn.executed, 1)
+	return nil
+}
+
+// run with go test -race to check the data races between the time wheel and the api
+func TestConcurrentOperationsWhileTicking(t *testing.T) {
+	var executed, deleted int64
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	db := newTestMemoryDb()
+	queue := New(
+		WithClock(fake),
+		WithTaskExecutor(func(taskMode notify.NotifyMode) notify.Executor { return &testCountNotify{executed: &executed} }),
+		WithPersistence(db),
+		WithTick(time.Millisecond),
+		WithWheelSizes(8, 8, 8),
+	)
+	queue.Start()
+	defer queue.Stop(context.Background())
+
+	// the clock moves a tick whenever the time wheel waits for it, while the tasks are pushed
+	done := make(chan struct{})
+	moved := make(chan struct{})
+	go func() {
+		defer close(moved)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if fake.Timers() == 2 {
+				fake.Advance(time.Millisecond)
+			}
+			runtime.Gosched()
+		}
+	}()
+
+	workers := 8
+	taskCounts := 300
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < taskCounts; i++ {
+				delay := time.Duration(1+(w*taskCounts+i)%100) * time.Millisecond
+				tk, err := queue.Push(delay, notify.HTTP, i)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				switch i % 3 {
+				case 0:
+					// the task may have been executed already
+					queue.UpdateTask(tk.Id, notify.SubPub, "updated")
+				case 1:
+					if queue.DeleteTask(tk.Id) == nil {
+						atomic.AddInt64(&deleted, 1)
+					}
+				}
+				if task := queue.GetTask(tk.Id); task != nil {
+					_ = task.TaskData
+				}
+				queue.WheelTaskQuantity(0, i%8)
+				queue.Lag()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	<-moved
+
+	// every task is either executed or deleted, and none is executed twice
+	testAdvance(t, fake, 1, time.Second)
+	assert.Nil(t, queue.Stop(context.Background()))
+	total := int64(workers * taskCounts)
+	assert.Equal(t, total, atomic.LoadInt64(&executed)+atomic.LoadInt64(&deleted))
+	assert.Equal(t, uint64(atomic.LoadInt64(&executed)), queue.PoolStats().Submitted)
+
+	queue.mutex.RLock()
+	assert.Equal(t, 0, len(queue.TaskQueryTable))
+	queue.mutex.RUnlock()
+	assert.Equal(t, 0, len(db.GetList()))
+}
+
+func TestConcurrentRemoveAllWhileTicking(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db), WithTick(time.Millisecond), WithWheelSizes(8, 8))
+	queue.Start()
+	defer queue.Stop(context.Background())
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				queue.Push(time.Duration(1+i%20)*time.Millisecond, notify.HTTP, i)
+				if i%50 == 0 {
+					queue.RemoveAllTasks()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	queue.RemoveAllTasks()
+
+	queue.mutex.RLock()
+	assert.Equal(t, 0, len(queue.TaskQueryTable))
+	queue.mutex.RUnlock()
+	for i := 0; i < 8; i++ {
+		assert.Equal(t, 0, queue.WheelTaskQuantity(0, i))
+	}
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// move a task which failed for good to the dead letters
+func (dq *DelayQueue) deadLetter(task *Task) {
+	task.DeadLetteredAt = dq.clock.Now()
+	task.LeaseUntil = time.Time{}
+	dq.finish(task, TaskDeadLettered)
+	if err := dq.Persistence.SaveDeadLetter(task); err != nil {
+		log.Println(err)
+	}
+	// remove the task from the persistent object
+	dq.Persistence.Delete(task.Id)
+	dq.emit(EventDeadLetter, task, lastErrorOf(task), 0)
+}
+
+// List the tasks which exhausted their retries
+func (dq *DelayQueue) ListDeadLetters() []*Task {
+	return dq.Persistence.GetDeadLetters()
+}
+
+// Put a dead letter back to the time wheel, it is executed on the next tick with a fresh retry budget
+func (dq *DelayQueue) ReplayDeadLetter(taskId string) (*Task, error) {
+	for _, task := range dq.Persistence.GetDeadLetters() {
+		if task.Id == taskId {
+			return dq.replay(task)
+		}
+	}
+	return nil, errors.New("dead letter not found")
+}
+
+// Put all dead letters back to the time wheel, returns the number of replayed tasks
+func (dq *DelayQueue) ReplayAllDeadLetters() (int, error) {
+	replayed := 0
+	for _, task := range dq.Persistence.GetDeadLetters() {
+		if _, err := dq.replay(task); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// Remove all dead letters, returns the number of removed tasks
+func (dq *DelayQueue) PurgeDeadLetters() (int, error) {
+	purged := len(dq.Persistence.GetDeadLetters())
+	if err := dq.Persistence.RemoveAllDeadLetters(); err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+func (dq *DelayQueue) replay(task *Task) (*Task, error) {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	if _, ok := dq.TaskQueryTable[task.Id]; ok {
+		return nil, errors.New("task already exists: " + task.Id)
+	}
+	task.Attempts = 0
+	task.DeadLetteredAt = time.Time{}
+	task.FinishedAt = time.Time{}
+	task.State = TaskPending
+	dq.requeue(task, dq.clock.Now())
+	if err := dq.Persistence.DeleteDeadLetter(task.Id); err != nil {
+		log.Println(err)
+	}
+	return task.clone(), nil
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailedTaskMovedToDeadLetters(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testFlakyNotify{failTimes: 2, err: errors.New("service unavailable")}
+	queue := testRetryQueue(executor, db, RetryPolicy{MaxAttempts: 2, InitialBackoff: 10 * time.Millisecond})
+	defer queue.Stop(context.Background())
+
+	tk, _ := queue.Push(10*time.Millisecond, notify.HTTP, "hello")
+	assert.Eventually(t, func() bool { return len(queue.ListDeadLetters()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, len(db.GetList()))
+
+	deadLetter := queue.ListDeadLetters()[0]
+	assert.Equal(t, tk.Id, deadLetter.Id)
+	assert.Equal(t, "hello", deadLetter.TaskData)
+	assert.Equal(t, 2, deadLetter.Attempts)
+	assert.Equal(t, "service unavailable", deadLetter.LastError)
+	assert.False(t, deadLetter.LastAttemptAt.IsZero())
+	assert.False(t, deadLetter.DeadLetteredAt.IsZero())
+
+	// replay it, the executor succeeds now
+	_, err := queue.ReplayDeadLetter("not-exist")
+	assert.NotNil(t, err)
+	replayed, err := queue.ReplayDeadLetter(tk.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, replayed.Attempts)
+	assert.Equal(t, 0, len(queue.ListDeadLetters()))
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&executor.executed) == 3 }, time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool { return len(db.GetList()) == 0 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, len(queue.ListDeadLetters()))
+}
+
+func TestReplayAndPurgeDeadLetters(t *testing.T) {
+	db := newTestMemoryDb()
+	testBeforeSetUp()
+	dq = New(WithTaskExecutor(testFactory), WithPersistence(db))
+	for _, id := range []string{"1", "2", "3"} {
+		db.SaveDeadLetter(&Task{Id: id, TaskMode: notify.HTTP, TaskData: "hello", Attempts: 3, LastError: "failed"})
+	}
+	assert.Equal(t, 3, len(dq.ListDeadLetters()))
+
+	replayed, err := dq.ReplayAllDeadLetters()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, replayed)
+	assert.Equal(t, 0, len(dq.ListDeadLetters()))
+	assert.Equal(t, 3, len(db.GetList()))
+	for _, id := range []string{"1", "2", "3"} {
+		task := dq.GetTask(id)
+		assert.NotNil(t, task)
+		assert.Equal(t, int64(1), task.DueTick)
+		assert.Equal(t, "failed", task.LastError)
+	}
+
+	// a dead letter can not replace a task on the time wheel
+	db.SaveDeadLetter(&Task{Id: "1"})
+	_, err = dq.ReplayDeadLetter("1")
+	assert.NotNil(t, err)
+
+	db.SaveDeadLetter(&Task{Id: "4"})
+	purged, err := dq.PurgeDeadLetters()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, purged)
+	assert.Equal(t, 0, len(dq.ListDeadLetters()))
+}
@@ -1,38 +1,46 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
 	"github.com/raymondmars/go-delayqueue/internal/pkg/common"
 )
 
 const (
-	// The time length of the round is currently set to one hour, that is,
-	// it takes 1 hour for each cycle of the time wheel;
-	// the minimum granularity of each step on the default time wheel is 1 second.
-	WHEEL_SIZE                      = 3600
+	// The time wheel has four levels by default, each slot of a level covers a full round of the level below it,
+	// the minimum granularity of each step on the default time wheel is 1 second,
+	// so the levels are 60 seconds, 60 minutes, 24 hours and 365 days.
+	// Both the tick and the sizes can be changed by options.
+	SECONDS_WHEEL_SIZE              = 60
+	MINUTES_WHEEL_SIZE              = 60
+	HOURS_WHEEL_SIZE                = 24
+	DAYS_WHEEL_SIZE                 = 365
 	REFRESH_POINTER_DEFAULT_SECONDS = 5
+	// the size of the single time wheel of the older versions, one slot a second
+	LEGACY_WHEEL_SIZE = 3600
 )
 
 // factory method
 type BuildExecutor func(taskMode notify.NotifyMode) notify.Executor
 
-type SlotRecorder map[string]int
+// records the tasks on the time wheel by task id
+type SlotRecorder map[string]*Task
 
-type ActionEvent func()
+// ErrTaskNotFound is returned when there is no pending task with the id
+var ErrTaskNotFound = errors.New("task not found")
 
 var onceNew sync.Once
-var onceStart sync.Once
-
-var mutex = &sync.RWMutex{}
 
 var delayQueueInstance *DelayQueue
 
@@ -42,220 +50,396 @@ type wheel struct {
 }
 
 type DelayQueue struct {
-	// circular queue
-	TimeWheel    [WHEEL_SIZE]wheel
-	CurrentIndex uint // time wheel current pointer
+	// guards the time wheel and the query table
+	mutex     sync.RWMutex
+	startOnce sync.Once
+	stopOnce  sync.Once
+	// closed to stop the background goroutines
+	stopped chan struct{}
+	// the background goroutines of the time wheel
+	workers sync.WaitGroup
+	// the executions of the tasks which are still running
+	executions sync.WaitGroup
+	// hierarchical time wheel
+	wheel *timingWheel
+	// the duration of one tick
+	tick       time.Duration
+	wheelSizes []int
+	// what to do with the tasks that became overdue while the queue was down
+	latePolicy    LatePolicy
+	lateTolerance time.Duration
+	// the retry policy of the tasks which are pushed without their own policy
+	retryPolicy RetryPolicy
+	// how long an execution can take before its task is put back to the time wheel
+	leaseDuration time.Duration
+	// the tasks which are executed by this delay queue right now
+	running SlotRecorder
+	// the pending debounced or throttled tasks by their keys
+	keyed SlotRecorder
+	// the pending occurrences by the ids of their schedules
+	scheduled map[string]SlotRecorder
+	// how long the final state of a task is kept
+	statusRetention time.Duration
+	// how long the idempotency key of a pushed task is kept
+	idempotencyRetention time.Duration
+	// executes the due tasks with a bounded number of goroutines
+	pool        *workerPool
+	poolWorkers int
+	poolBuffer  int
+	modeLimits  map[notify.NotifyMode]int
+	// the tick of the time wheel that corresponds to refTime,
+	// the time of any tick is calculated from them so the time wheel does not drift
+	refTick int64
+	refTime time.Time
+	// tells the time of the time wheel, the wall clock by default
+	clock clock.Clock
+	// the hooks of the events of the tasks
+	hooks hookSet
 	Persistence
 	// task executor
 	TaskExecutor BuildExecutor
 
 	TaskQueryTable SlotRecorder
-	// ready flag
-	IsReady bool
+	// ready flag, 1 when the time wheel is running
+	ready int32
+}
+
+// New creates an independent delay queue,
+// the redis persistence configured by the environment variables and the notify executors are used by default.
+func New(opts ...Option) *DelayQueue {
+	dq := &DelayQueue{
+		tick:                 DEFAULT_TICK,
+		latePolicy:           LateRun,
+		retryPolicy:          DefaultRetryPolicy(),
+		leaseDuration:        DEFAULT_LEASE_DURATION,
+		statusRetention:      DEFAULT_STATUS_RETENTION,
+		idempotencyRetention: DEFAULT_IDEMPOTENCY_RETENTION,
+		running:              make(SlotRecorder),
+		keyed:                make(SlotRecorder),
+		scheduled:            map[string]SlotRecorder{},
+		poolWorkers:          DEFAULT_POOL_WORKERS,
+		poolBuffer:           DEFAULT_POOL_BUFFER,
+		modeLimits:           map[notify.NotifyMode]int{},
+		clock:                clock.New(),
+		wheelSizes:           []int{SECONDS_WHEEL_SIZE, MINUTES_WHEEL_SIZE, HOURS_WHEEL_SIZE, DAYS_WHEEL_SIZE},
+		TaskExecutor:         notify.BuildExecutor,
+		TaskQueryTable:       make(SlotRecorder),
+		hooks:                hookSet{size: DEFAULT_HOOK_QUEUE_SIZE},
+		stopped:              make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(dq)
+	}
+	dq.refTime = dq.clock.Now()
+	if dq.Persistence == nil {
+		dq.Persistence = newRedisDb(newRedisClient(), "")
+	}
+	dq.wheel = newTimingWheel(dq.wheelSizes...)
+	dq.pool = newWorkerPool(dq.poolWorkers, dq.poolBuffer, dq.modeLimits, dq.clock, func(task *Task) {
+		defer dq.executions.Done()
+		dq.runTask(task)
+	})
+	return dq
 }
 
-// singleton method use redis as persistence layer
-func GetDelayQueue(serviceBuilder BuildExecutor) *DelayQueue {
+// singleton method use redis as persistence layer,
+// use New to create more than one delay queue in a process
+func GetDelayQueue(serviceBuilder BuildExecutor, opts ...Option) *DelayQueue {
 	onceNew.Do(func() {
-		delayQueueInstance = &DelayQueue{
-			Persistence:    getRedisDb(),
-			TaskExecutor:   serviceBuilder,
-			TaskQueryTable: make(SlotRecorder),
-			IsReady:        false,
-		}
+		delayQueueInstance = New(append([]Option{WithTaskExecutor(serviceBuilder), WithPersistence(getRedisDb())}, opts...)...)
 	})
 	return delayQueueInstance
 }
 
-// singleton method use other persistence layer
-func GetDelayQueueWithPersis(serviceBuilder BuildExecutor, persistence Persistence) *DelayQueue {
+// singleton method use other persistence layer,
+// use New to create more than one delay queue in a process
+func GetDelayQueueWithPersis(serviceBuilder BuildExecutor, persistence Persistence, opts ...Option) *DelayQueue {
 	if persistence == nil {
 		log.Fatalf("persistance is null")
 	}
 	onceNew.Do(func() {
-		delayQueueInstance = &DelayQueue{
-			Persistence:    persistence,
-			TaskExecutor:   serviceBuilder,
-			TaskQueryTable: make(SlotRecorder),
-			IsReady:        false,
-		}
+		delayQueueInstance = New(append([]Option{WithTaskExecutor(serviceBuilder), WithPersistence(persistence)}, opts...)...)
 	})
 	return delayQueueInstance
 }
 
 func (dq *DelayQueue) Start() {
-	// ensure only excute one time even multi delay queue instances call it
-	onceStart.Do(dq.init)
+	// ensure the time wheel of this delay queue only starts once
+	dq.startOnce.Do(dq.init)
 }
 
 func (dq *DelayQueue) init() {
 	log.Println("delay queue init...")
-	// load task from cache
-	dq.loadTasksFromDb()
-
 	// update pointer
-	dq.CurrentIndex = uint(dq.Persistence.GetWheelTimePointer())
+	pointer, savedAt := dq.Persistence.GetWheelTimePointer()
+	dq.mutex.Lock()
+	dq.wheel.currentTick = int64(pointer)
+	// the restored pointer is the reference of the wall clock from now on
+	dq.refTick = dq.wheel.currentTick
+	dq.refTime = dq.clock.Now()
+	dq.mutex.Unlock()
+
+	// load task from cache
+	dq.loadTasksFromDb(savedAt)
+	// the executions which were interrupted by a crash
+	dq.requeueExpiredLeases(dq.clock.Now())
 
 	// start time wheel
-	go func() {
-		for {
-			select {
-			case <-time.After(time.Second * 1):
-				if dq.CurrentIndex >= WHEEL_SIZE {
-					dq.CurrentIndex = dq.CurrentIndex % WHEEL_SIZE
-				}
-				taskLinkHead := dq.TimeWheel[dq.CurrentIndex].NotifyTasks
-				headIndex := dq.CurrentIndex
-
-				dq.CurrentIndex++
-
-				// fetch linked list
-				prev := taskLinkHead
-				p := taskLinkHead
-				for p != nil {
-					if p.CycleCount == 0 {
-						taskId := p.Id
-						// Open a new go routing for notifications, speed up each traversal,
-						// and ensure that the time wheel will not be slowed down
-						// If there is an exception in the task, try to let the specific business object handle it,
-						// and the delay queue does not handle the specific business exception.
-						// This can ensure the business simplicity of the delay queue and avoid problems that are difficult to maintain.
-						// If there is a problem with a specific business and you need to be notified repeatedly,
-						// you can add the task back to the queue.
-						go dq.ExecuteTask(p.TaskMode, p.TaskData)
-						// delete task
-						// if the first node
-						if prev == p {
-							dq.TimeWheel[headIndex].NotifyTasks = p.Next
-							prev = p.Next
-							p = p.Next
-						} else {
-							// if it is not the first node
-							prev.Next = p.Next
-							p = p.Next
-						}
-						// remove the task from the persistent object
-						dq.Persistence.Delete(taskId)
-						// remove task from query table
-						mutex.Lock()
-						delete(dq.TaskQueryTable, taskId)
-						mutex.Unlock()
-					} else {
-						p.CycleCount--
-						prev = p
-						p = p.Next
-					}
-				}
-			}
-		}
-	}()
+	dq.workers.Add(2)
+	go dq.runTimeWheel()
 
 	// async to update timewheel pointer
 	go func() {
+		defer dq.workers.Done()
 		// refresh pinter internal seconds
 		refreshInternal, _ := strconv.Atoi(common.GetEvnWithDefaultVal("REFRESH_POINTER_INTERNAL", fmt.Sprintf("%d", REFRESH_POINTER_DEFAULT_SECONDS)))
 		if refreshInternal < REFRESH_POINTER_DEFAULT_SECONDS {
 			refreshInternal = REFRESH_POINTER_DEFAULT_SECONDS
 		}
 		for {
+			// the timer is stopped with the delay queue, so a fake clock is not left with it
+			timer := dq.clock.NewTimer(time.Second * time.Duration(refreshInternal))
 			select {
-			case <-time.After(time.Second * time.Duration(refreshInternal)):
-				err := dq.Persistence.SaveWheelTimePointer(int(dq.CurrentIndex))
-				if err != nil {
-					log.Println(err)
-				}
+			case <-timer.C():
+				dq.saveWheelPointer()
+				dq.requeueExpiredLeases(dq.clock.Now())
+			case <-dq.stopped:
+				timer.Stop()
+				return
 			}
 		}
 
 	}()
 
-	dq.IsReady = true
+	atomic.StoreInt32(&dq.ready, 1)
 }
 
-func (dq *DelayQueue) loadTasksFromDb() {
+// whether the time wheel of the delay queue is running
+func (dq *DelayQueue) IsReady() bool {
+	return atomic.LoadInt32(&dq.ready) == 1
+}
+
+// the current time on the clock of the delay queue
+func (dq *DelayQueue) Now() time.Time {
+	return dq.clock.Now()
+}
+
+// Stop the time wheel, persist the current pointer
+// and wait for the running executions until the context is done.
+// A stopped delay queue can not be started again.
+func (dq *DelayQueue) Stop(ctx context.Context) error {
+	dq.stopOnce.Do(func() {
+		// wait for an init in progress, and never start after being stopped
+		dq.startOnce.Do(func() {})
+		atomic.StoreInt32(&dq.ready, 0)
+		close(dq.stopped)
+		dq.workers.Wait()
+		// the pending tasks are still executed
+		dq.pool.close()
+		dq.saveWheelPointer()
+		log.Println("delay queue stopped")
+	})
+
+	finished := make(chan struct{})
+	go func() {
+		dq.executions.Wait()
+		dq.hooks.wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (dq *DelayQueue) saveWheelPointer() {
+	dq.mutex.RLock()
+	currentTick := dq.wheel.currentTick
+	dq.mutex.RUnlock()
+	err := dq.Persistence.SaveWheelTimePointer(int(currentTick), dq.clock.Now())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (dq *DelayQueue) loadTasksFromDb(pointerSavedAt time.Time) {
 	tasks := dq.Persistence.GetList()
 	if tasks != nil && len(tasks) > 0 {
+		now := dq.clock.Now()
+		dq.mutex.Lock()
+		defer dq.mutex.Unlock()
+		// the tasks saved by an older version get their due times and indexes,
+		// the due ticks of the others are calculated from their due times on every load, so they are not saved again
+		legacy := []*Task{}
 		for _, task := range tasks {
-			delaySeconds := (task.CycleCount * WHEEL_SIZE) + task.WheelPosition
-			if delaySeconds > 0 {
-				tk, _ := dq.internalPush(time.Duration(delaySeconds)*time.Second, task.Id, task.TaskMode, task.TaskData, false)
-				if tk != nil {
-					dq.TaskQueryTable[task.Id] = task.WheelPosition
+			var remaining time.Duration
+			hasDueAt := !task.DueAt.IsZero()
+			if hasDueAt {
+				remaining = task.DueAt.Sub(now)
+			} else {
+				if task.DueTick == 0 {
+					task.DueTick = dq.legacyDueTick(task)
+				}
+				remaining = time.Duration(task.DueTick-dq.wheel.currentTick) * dq.tick
+				if !pointerSavedAt.IsZero() {
+					remaining = remaining - now.Sub(pointerSavedAt)
+				}
+				task.DueAt = now.Add(remaining)
+			}
+
+			if dq.delayToTicks(remaining) <= 0 && -remaining > dq.lateTolerance {
+				log.Printf("task %s is overdue for %v, late policy: %s\n", task.Id, -remaining, dq.latePolicy)
+				switch dq.latePolicy {
+				case LateSkip:
+					if task.Schedule != nil {
+						dq.scheduleNext(task)
+					}
+					dq.Persistence.Delete(task.Id)
+					task.LastError = fmt.Sprintf("skipped for being overdue for %v after a restart", -remaining)
+					dq.finish(task, TaskCancelled)
+					continue
+				case LateDeadLetter:
+					task.LastError = fmt.Sprintf("overdue for %v after a restart", -remaining)
+					if task.Schedule != nil {
+						dq.scheduleNext(task)
+					}
+					dq.deadLetter(task)
+					continue
 				}
 			}
+			// an overdue task is executed on the next tick
+			task.DueTick = dq.dueTickOf(task.DueAt)
+			dq.wheel.add(task)
+			dq.TaskQueryTable[task.Id] = task
+			if task.Key != "" {
+				dq.keyed[task.Key] = task
+			}
+			dq.rememberOccurrence(task)
+			if !hasDueAt {
+				legacy = append(legacy, task)
+			}
+		}
+		if err := dq.Persistence.SaveBatch(legacy); err != nil {
+			log.Println(err)
 		}
 	}
 }
 
+// the due tick of a task saved by the single time wheel of the older versions,
+// its slot is counted from the restored pointer, the caller must hold the lock
+func (dq *DelayQueue) legacyDueTick(task *Task) int64 {
+	pointer := int(dq.wheel.currentTick % LEGACY_WHEEL_SIZE)
+	seconds := task.CycleCount*LEGACY_WHEEL_SIZE + (task.LegacyPosition-pointer+LEGACY_WHEEL_SIZE)%LEGACY_WHEEL_SIZE
+	task.CycleCount = 0
+	task.LegacyPosition = 0
+	return dq.wheel.currentTick + dq.delayToTicks(time.Duration(seconds)*time.Second)
+}
+
 // Add a task to the delay queue
-func (dq *DelayQueue) Push(delaySeconds time.Duration, taskMode notify.NotifyMode, taskData interface{}) (task *Task, err error) {
-	var pms string
-	result, ok := taskData.(string)
-	if !ok {
-		tp, _ := json.Marshal(taskData)
-		pms = string(tp)
-	} else {
-		pms = result
+func (dq *DelayQueue) Push(delay time.Duration, taskMode notify.NotifyMode, taskData interface{}, opts ...TaskOption) (*Task, error) {
+	if dq.delayToTicks(delay) <= 0 {
+		errorMsg := fmt.Sprintf("the delay time rounds to zero ticks of %v, current is: %v", dq.tick, delay)
+		return nil, errors.New(errorMsg)
 	}
 
-	task, err = dq.internalPush(delaySeconds, "", taskMode, pms, true)
-	if err == nil {
-		mutex.Lock()
-		dq.TaskQueryTable[task.Id] = task.WheelPosition
-		mutex.Unlock()
+	return dq.internalPush(dq.clock.Now().Add(delay), "", taskMode, taskDataToString(taskData), true, opts...)
+}
+
+// Add a task to the delay queue which is executed at the given time,
+// the task is executed on the tick nearest to that time.
+func (dq *DelayQueue) PushAt(dueAt time.Time, taskMode notify.NotifyMode, taskData interface{}, opts ...TaskOption) (*Task, error) {
+	if dq.delayToTicks(dueAt.Sub(dq.clock.Now())) <= 0 {
+		errorMsg := fmt.Sprintf("the due time rounds to zero ticks of %v from now, current is: %v", dq.tick, dueAt.Format(time.RFC3339Nano))
+		return nil, errors.New(errorMsg)
 	}
 
-	return
+	return dq.internalPush(dueAt, "", taskMode, taskDataToString(taskData), true, opts...)
 }
 
-func (dq *DelayQueue) internalPush(delaySeconds time.Duration, taskId string, taskMode notify.NotifyMode, taskData string, needPresis bool) (*Task, error) {
-	if int(delaySeconds.Seconds()) == 0 {
-		errorMsg := fmt.Sprintf("the delay time cannot be less than 1 second, current is: %v", delaySeconds)
-		return nil, errors.New(errorMsg)
+func (dq *DelayQueue) internalPush(dueAt time.Time, taskId string, taskMode notify.NotifyMode, taskData string, needPresis bool, opts ...TaskOption) (*Task, error) {
+	task, clientId := dq.newTask(dueAt, taskId, taskMode, taskData, opts...)
+
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	pushed, changed, err := dq.addTask(task, clientId, needPresis)
+	if err != nil {
+		return nil, err
 	}
 
-	// Start timing from the current time pointer
-	seconds := int(delaySeconds.Seconds())
-	calculateValue := int(dq.CurrentIndex) + seconds
+	// save while holding the lock, so it can not overwrite the deletion after the task is executed or deleted
+	if needPresis && changed != nil {
+		dq.Persistence.Save(changed)
+	}
+	dq.emitAdded(task, changed)
 
-	cycle := calculateValue / WHEEL_SIZE
-	index := calculateValue % WHEEL_SIZE
+	return pushed, nil
+}
 
+// build the task of a push, and whether its id is supplied by the client
+func (dq *DelayQueue) newTask(dueAt time.Time, taskId string, taskMode notify.NotifyMode, taskData string, opts ...TaskOption) (*Task, bool) {
 	if taskId == "" {
 		u := uuid.New()
 		taskId = u.String()
 	}
 	task := &Task{
-		Id:            taskId,
-		CycleCount:    cycle,
-		WheelPosition: index,
-		TaskMode:      taskMode,
-		TaskData:      taskData,
+		Id:        taskId,
+		CreatedAt: dq.clock.Now(),
+		DueAt:     dueAt,
+		TaskMode:  taskMode,
+		TaskData:  taskData,
+		State:     TaskPending,
 	}
-
-	if cycle > 0 && index <= int(dq.CurrentIndex) {
-		cycle--
-		task.CycleCount = cycle
+	for _, opt := range opts {
+		opt(task)
 	}
+	return task, task.Id != taskId
+}
 
-	mutex.Lock()
-	if dq.TimeWheel[index].NotifyTasks == nil {
-		dq.TimeWheel[index].NotifyTasks = task
-	} else {
-		// Insert a new task into the head of the linked list.
-		// Since there is no order relationship between tasks,
-		// this implementation is the easiest
-		head := dq.TimeWheel[index].NotifyTasks
-		task.Next = head
-		dq.TimeWheel[index].NotifyTasks = task
+// add the task of a push to the time wheel, a deduplicated push or a push applied to the pending task with its key
+// adds no task. returns a copy of the resulting task, and the task to persist which is nil if nothing has changed.
+// the caller must hold the lock
+func (dq *DelayQueue) addTask(task *Task, clientId bool, deduplicate bool) (*Task, *Task, error) {
+	if deduplicate {
+		// a debounced or throttled push is applied to the pending task with its key
+		if pending := dq.pendingByKey(task.Key); pending != nil {
+			pushed, changed := dq.pushOnKey(pending, task)
+			return pushed, changed, nil
+		}
+		// the id supplied by the client is an idempotency key as well
+		existing, err := dq.duplicateOf(task, clientId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if existing != nil {
+			return existing, nil, nil
+		}
 	}
-	mutex.Unlock()
-
-	if needPresis {
-		dq.Persistence.Save(task)
+	task.DueTick = dq.dueTickOf(task.DueAt)
+	dq.wheel.add(task)
+	dq.TaskQueryTable[task.Id] = task
+	if task.Key != "" {
+		dq.keyed[task.Key] = task
 	}
+	dq.rememberOccurrence(task)
+	return task.clone(), task, nil
+}
 
-	return task, nil
+// add a task which is not on the time wheel back to it and persist it,
+// the caller must hold the lock
+func (dq *DelayQueue) requeue(task *Task, dueAt time.Time) {
+	task.LeaseUntil = time.Time{}
+	task.DueAt = dueAt
+	task.DueTick = dq.dueTickOf(dueAt)
+	dq.wheel.add(task)
+	dq.TaskQueryTable[task.Id] = task
+	dq.rememberOccurrence(task)
+	// the key was released when the task was due, unless another task has taken it meanwhile
+	if task.Key != "" && dq.pendingByKey(task.Key) == nil {
+		dq.keyed[task.Key] = task
+	}
+	dq.Persistence.Save(task)
 }
 
 // execute task
@@ -275,89 +459,114 @@ func (dq *DelayQueue) ExecuteTask(taskMode notify.NotifyMode, taskData string) e
 
 }
 
-// Get the number of tasks on a time wheel
-func (dq *DelayQueue) WheelTaskQuantity(index int) int {
-	tasks := dq.TimeWheel[index].NotifyTasks
-	if tasks == nil {
-		return 0
-	}
-	k := 0
-	for p := tasks; p != nil; p = p.Next {
-		k++
+func taskDataToString(taskData interface{}) string {
+	result, ok := taskData.(string)
+	if ok {
+		return result
 	}
+	tp, _ := json.Marshal(taskData)
+	return string(tp)
+}
 
-	return k
+// Get the number of tasks on a slot of a time wheel level
+func (dq *DelayQueue) WheelTaskQuantity(level, index int) int {
+	dq.mutex.RLock()
+	defer dq.mutex.RUnlock()
+	return dq.wheel.quantity(level, index)
 }
 
+// Get a copy of a task on the time wheel, it is nil if the task is not found
 func (dq *DelayQueue) GetTask(taskId string) *Task {
-	mutex.Lock()
-	val, ok := dq.TaskQueryTable[taskId]
-	mutex.Unlock()
+	dq.mutex.RLock()
+	defer dq.mutex.RUnlock()
+	task, ok := dq.TaskQueryTable[taskId]
 	if !ok {
 		return nil
-	} else {
-		tasks := dq.TimeWheel[val].NotifyTasks
-		for p := tasks; p != nil; p = p.Next {
-			if p.Id == taskId {
-				return p
-			}
-		}
-		return nil
 	}
+	return task.clone()
 }
 
 func (dq *DelayQueue) UpdateTask(taskId string, taskMode notify.NotifyMode, taskData string) error {
-	task := dq.GetTask(taskId)
-	if task == nil {
-		return errors.New("task not found")
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	task, ok := dq.TaskQueryTable[taskId]
+	if !ok {
+		return ErrTaskNotFound
 	}
 	task.TaskMode = taskMode
 	task.TaskData = taskData
 
 	// update cache
 	dq.Persistence.Save(task)
+	dq.emit(EventUpdate, task, nil, 0)
 
 	return nil
 }
 
-func (dq *DelayQueue) DeleteTask(taskId string) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-	val, ok := dq.TaskQueryTable[taskId]
+// Move a task to the given delay from now, it keeps its id
+func (dq *DelayQueue) Reschedule(taskId string, delay time.Duration) (*Task, error) {
+	if dq.delayToTicks(delay) <= 0 {
+		errorMsg := fmt.Sprintf("the delay time rounds to zero ticks of %v, current is: %v", dq.tick, delay)
+		return nil, errors.New(errorMsg)
+	}
+	return dq.RescheduleAt(taskId, dq.clock.Now().Add(delay))
+}
+
+// Move a task to the given due time, it keeps its id
+func (dq *DelayQueue) RescheduleAt(taskId string, dueAt time.Time) (*Task, error) {
+	if dq.delayToTicks(dueAt.Sub(dq.clock.Now())) <= 0 {
+		errorMsg := fmt.Sprintf("the due time rounds to zero ticks of %v from now, current is: %v", dq.tick, dueAt.Format(time.RFC3339Nano))
+		return nil, errors.New(errorMsg)
+	}
+
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	task, ok := dq.TaskQueryTable[taskId]
 	if !ok {
-		return errors.New("task not found")
-	} else {
-		p := dq.TimeWheel[val].NotifyTasks
-		prev := p
-		for p != nil {
-			if p.Id == taskId {
-				// if current node is root node
-				if p == prev {
-					dq.TimeWheel[val].NotifyTasks = p.Next
-				} else {
-					prev.Next = p.Next
-				}
-				// clear cache
-				delete(dq.TaskQueryTable, taskId)
-				dq.Persistence.Delete(taskId)
-				p = nil
-				prev = nil
+		return nil, ErrTaskNotFound
+	}
+	// move the task to the slot of its new due tick
+	dq.wheel.remove(task)
+	task.DueAt = dueAt
+	task.DueTick = dq.dueTickOf(dueAt)
+	dq.wheel.add(task)
+	dq.Persistence.Save(task)
+	dq.emit(EventUpdate, task, nil, 0)
 
-				break
-			} else {
-				prev = p
-				p = p.Next
-			}
+	return task.clone(), nil
+}
+
+func (dq *DelayQueue) DeleteTask(taskId string) error {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	task, ok := dq.TaskQueryTable[taskId]
+	if !ok {
+		if waiting := dq.Persistence.GetWaiting(taskId); waiting != nil {
+			dq.Persistence.DeleteWaiting(taskId)
+			dq.finish(waiting, TaskCancelled)
+			dq.emit(EventDelete, waiting, nil, 0)
+			return nil
 		}
-		return nil
+		return ErrTaskNotFound
 	}
+	dq.wheel.remove(task)
+	// clear cache
+	delete(dq.TaskQueryTable, taskId)
+	dq.forgetKey(task)
+	dq.forgetOccurrence(task)
+	dq.Persistence.Delete(taskId)
+	dq.finish(task, TaskCancelled)
+	dq.emit(EventDelete, task, nil, 0)
+
+	return nil
 }
 
 func (dq *DelayQueue) RemoveAllTasks() error {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
 	dq.TaskQueryTable = make(SlotRecorder)
-	for i := 0; i < len(dq.TimeWheel); i++ {
-		dq.TimeWheel[i].NotifyTasks = nil
-	}
+	dq.keyed = make(SlotRecorder)
+	dq.wheel.clear()
 	dq.Persistence.RemoveAll()
 	return nil
 }
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
@@ -9,6 +11,7 @@ import (
 	"time"
 
 	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -43,11 +46,372 @@ func (td *testDoNothingDb) RemoveAll() error {
 	return nil
 }
 
-func (td *testDoNothingDb) GetWheelTimePointer() int {
-	return 0
+func (td *testDoNothingDb) QueryTasks(filter TaskFilter) ([]*Task, int, error) {
+	return []*Task{}, 0, nil
 }
 
-func (td *testDoNothingDb) SaveWheelTimePointer(index int) error {
+func (td *testDoNothingDb) GetWheelTimePointer() (int, time.Time) {
+	return 0, time.Time{}
+}
+
+func (td *testDoNothingDb) SaveWheelTimePointer(index int, savedAt time.Time) error {
+	return nil
+}
+
+func (td *testDoNothingDb) SaveDeadLetter(task *Task) error {
+	return nil
+}
+
+func (td *testDoNothingDb) GetDeadLetters() []*Task {
+	return []*Task{}
+}
+
+func (td *testDoNothingDb) DeleteDeadLetter(taskId string) error {
+	return nil
+}
+
+func (td *testDoNothingDb) RemoveAllDeadLetters() error {
+	return nil
+}
+
+func (td *testDoNothingDb) SaveInFlight(task *Task) error {
+	return nil
+}
+
+func (td *testDoNothingDb) GetInFlight() []*Task {
+	return []*Task{}
+}
+
+func (td *testDoNothingDb) DeleteInFlight(taskId string) error {
+	return nil
+}
+
+func (td *testDoNothingDb) SaveStatus(task *Task, retention time.Duration) error {
+	return nil
+}
+
+func (td *testDoNothingDb) GetStatus(taskId string) *Task {
+	return nil
+}
+
+func (td *testDoNothingDb) SaveSchedule(task *Task) error {
+	return nil
+}
+
+func (td *testDoNothingDb) GetSchedule(scheduleId string) *Task {
+	return nil
+}
+
+func (td *testDoNothingDb) GetSchedules() []*Task {
+	return nil
+}
+
+func (td *testDoNothingDb) DeleteSchedule(scheduleId string) error {
+	return nil
+}
+
+func (td *testDoNothingDb) SaveBatch(tasks []*Task) error {
+	return nil
+}
+
+func (td *testDoNothingDb) DeleteBatch(taskIds []string) error {
+	return nil
+}
+
+func (td *testDoNothingDb) SaveWaiting(task *Task) error {
+	return nil
+}
+
+func (td *testDoNothingDb) GetWaiting(taskId string) *Task {
+	return nil
+}
+
+func (td *testDoNothingDb) GetWaitingList() []*Task {
+	return nil
+}
+
+func (td *testDoNothingDb) DeleteWaiting(taskId string) error {
+	return nil
+}
+
+func (td *testDoNothingDb) ClaimIdempotencyKey(key string, task *Task, retention time.Duration) (*Task, error) {
+	return nil, nil
+}
+
+func (td *testDoNothingDb) ReleaseIdempotencyKey(key string, taskId string) error {
+	return nil
+}
+
+// reports the executed contents to a channel
+type testChanNotify struct {
+	executed chan string
+}
+
+func (tn *testChanNotify) DoDelayTask(contents string) error {
+	tn.executed <- contents
+	return nil
+}
+
+func testChanFactory(executed chan string) BuildExecutor {
+	return func(taskMode notify.NotifyMode) notify.Executor {
+		return &testChanNotify{executed: executed}
+	}
+}
+
+// keeps tasks in memory to test the interaction with the persistence layer
+type testMemoryDb struct {
+	sync.Mutex
+	tasks       map[string]*Task
+	deadLetters map[string]*Task
+	inFlight    map[string]*Task
+	statuses    map[string]*Task
+	schedules   map[string]*Task
+	keys        map[string]*Task
+	waiting     map[string]*Task
+	pointer     int
+	savedAt     time.Time
+
+	// the number of batch operations
+	batches int
+}
+
+func newTestMemoryDb() *testMemoryDb {
+	return &testMemoryDb{
+		tasks:       map[string]*Task{},
+		deadLetters: map[string]*Task{},
+		inFlight:    map[string]*Task{},
+		statuses:    map[string]*Task{},
+		schedules:   map[string]*Task{},
+		keys:        map[string]*Task{},
+		waiting:     map[string]*Task{},
+	}
+}
+
+func (td *testMemoryDb) Save(task *Task) error {
+	td.Lock()
+	defer td.Unlock()
+	td.tasks[task.Id] = task.clone()
+	return nil
+}
+
+func (td *testMemoryDb) GetList() []*Task {
+	td.Lock()
+	defer td.Unlock()
+	tasks := []*Task{}
+	for _, task := range td.tasks {
+		tasks = append(tasks, task.clone())
+	}
+	return tasks
+}
+
+func (td *testMemoryDb) Delete(taskId string) error {
+	td.Lock()
+	defer td.Unlock()
+	delete(td.tasks, taskId)
+	return nil
+}
+
+func (td *testMemoryDb) RemoveAll() error {
+	td.Lock()
+	defer td.Unlock()
+	td.tasks = map[string]*Task{}
+	return nil
+}
+
+func (td *testMemoryDb) QueryTasks(filter TaskFilter) ([]*Task, int, error) {
+	tasks, total := QueryTasks(td.GetList(), filter)
+	return tasks, total, nil
+}
+
+func (td *testMemoryDb) GetWheelTimePointer() (int, time.Time) {
+	td.Lock()
+	defer td.Unlock()
+	return td.pointer, td.savedAt
+}
+
+func (td *testMemoryDb) SaveWheelTimePointer(index int, savedAt time.Time) error {
+	td.Lock()
+	defer td.Unlock()
+	td.pointer = index
+	td.savedAt = savedAt
+	return nil
+}
+
+func (td *testMemoryDb) SaveDeadLetter(task *Task) error {
+	td.Lock()
+	defer td.Unlock()
+	td.deadLetters[task.Id] = task.clone()
+	return nil
+}
+
+func (td *testMemoryDb) GetDeadLetters() []*Task {
+	td.Lock()
+	defer td.Unlock()
+	tasks := []*Task{}
+	for _, task := range td.deadLetters {
+		tasks = append(tasks, task.clone())
+	}
+	return tasks
+}
+
+func (td *testMemoryDb) DeleteDeadLetter(taskId string) error {
+	td.Lock()
+	defer td.Unlock()
+	delete(td.deadLetters, taskId)
+	return nil
+}
+
+func (td *testMemoryDb) RemoveAllDeadLetters() error {
+	td.Lock()
+	defer td.Unlock()
+	td.deadLetters = map[string]*Task{}
+	return nil
+}
+
+func (td *testMemoryDb) SaveInFlight(task *Task) error {
+	td.Lock()
+	defer td.Unlock()
+	td.inFlight[task.Id] = task.clone()
+	return nil
+}
+
+func (td *testMemoryDb) GetInFlight() []*Task {
+	td.Lock()
+	defer td.Unlock()
+	tasks := []*Task{}
+	for _, task := range td.inFlight {
+		tasks = append(tasks, task.clone())
+	}
+	return tasks
+}
+
+func (td *testMemoryDb) DeleteInFlight(taskId string) error {
+	td.Lock()
+	defer td.Unlock()
+	delete(td.inFlight, taskId)
+	return nil
+}
+
+// the retention is not enforced in memory
+func (td *testMemoryDb) SaveStatus(task *Task, retention time.Duration) error {
+	td.Lock()
+	defer td.Unlock()
+	td.statuses[task.Id] = task.clone()
+	return nil
+}
+
+func (td *testMemoryDb) GetStatus(taskId string) *Task {
+	td.Lock()
+	defer td.Unlock()
+	if task, ok := td.statuses[taskId]; ok {
+		return task.clone()
+	}
+	return nil
+}
+
+func (td *testMemoryDb) SaveSchedule(task *Task) error {
+	td.Lock()
+	defer td.Unlock()
+	td.schedules[task.Schedule.Id] = task.clone()
+	return nil
+}
+
+func (td *testMemoryDb) GetSchedule(scheduleId string) *Task {
+	td.Lock()
+	defer td.Unlock()
+	if task, ok := td.schedules[scheduleId]; ok {
+		return task.clone()
+	}
+	return nil
+}
+
+func (td *testMemoryDb) GetSchedules() []*Task {
+	td.Lock()
+	defer td.Unlock()
+	tasks := []*Task{}
+	for _, task := range td.schedules {
+		tasks = append(tasks, task.clone())
+	}
+	return tasks
+}
+
+func (td *testMemoryDb) DeleteSchedule(scheduleId string) error {
+	td.Lock()
+	defer td.Unlock()
+	delete(td.schedules, scheduleId)
+	return nil
+}
+
+func (td *testMemoryDb) SaveBatch(tasks []*Task) error {
+	td.Lock()
+	defer td.Unlock()
+	td.batches++
+	for _, task := range tasks {
+		td.tasks[task.Id] = task.clone()
+	}
+	return nil
+}
+
+func (td *testMemoryDb) DeleteBatch(taskIds []string) error {
+	td.Lock()
+	defer td.Unlock()
+	td.batches++
+	for _, taskId := range taskIds {
+		delete(td.tasks, taskId)
+	}
+	return nil
+}
+
+func (td *testMemoryDb) SaveWaiting(task *Task) error {
+	td.Lock()
+	defer td.Unlock()
+	td.waiting[task.Id] = task.clone()
+	return nil
+}
+
+func (td *testMemoryDb) GetWaiting(taskId string) *Task {
+	td.Lock()
+	defer td.Unlock()
+	if task, ok := td.waiting[taskId]; ok {
+		return task.clone()
+	}
+	return nil
+}
+
+func (td *testMemoryDb) GetWaitingList() []*Task {
+	td.Lock()
+	defer td.Unlock()
+	tasks := []*Task{}
+	for _, task := range td.waiting {
+		tasks = append(tasks, task.clone())
+	}
+	return tasks
+}
+
+func (td *testMemoryDb) DeleteWaiting(taskId string) error {
+	td.Lock()
+	defer td.Unlock()
+	delete(td.waiting, taskId)
+	return nil
+}
+
+// the retention is not enforced in memory
+func (td *testMemoryDb) ClaimIdempotencyKey(key string, task *Task, retention time.Duration) (*Task, error) {
+	td.Lock()
+	defer td.Unlock()
+	if claimed, ok := td.keys[key]; ok {
+		return claimed.clone(), nil
+	}
+	td.keys[key] = task.clone()
+	return nil, nil
+}
+
+func (td *testMemoryDb) ReleaseIdempotencyKey(key string, taskId string) error {
+	td.Lock()
+	defer td.Unlock()
+	if claimed, ok := td.keys[key]; ok && claimed.Id == taskId {
+		delete(td.keys, key)
+	}
 	return nil
 }
 
@@ -55,32 +419,66 @@ var dq *DelayQueue
 
 func testBeforeSetUp() {
 	presisDb := &testDoNothingDb{}
-	dq = &DelayQueue{
-		Persistence:    presisDb,
-		TaskExecutor:   testFactory,
-		TaskQueryTable: make(SlotRecorder),
-	}
+	dq = New(WithTaskExecutor(testFactory), WithPersistence(presisDb))
 }
 
 func testWithRedisBeforeSetUp() {
-	dq = &DelayQueue{
-		Persistence:    getRedisDb(),
-		TaskExecutor:   testFactory,
-		TaskQueryTable: make(SlotRecorder),
-	}
+	dq = New(WithTaskExecutor(testFactory), WithPersistence(getRedisDb()))
 	dq.RemoveAllTasks()
 }
 
 func TestCanntPushTask(t *testing.T) {
 	testBeforeSetUp()
-	_, err := dq.Push(999*time.Millisecond, notify.HTTP, "")
-	assert.Equal(t, err.Error(), "the delay time cannot be less than 1 second, current is: 999ms")
+	_, err := dq.Push(499*time.Millisecond, notify.HTTP, "")
+	assert.Equal(t, err.Error(), "the delay time rounds to zero ticks of 1s, current is: 499ms")
+}
+
+func TestPushRoundsDelayToTick(t *testing.T) {
+	// the reference time does not move, so the boundaries are exact
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	dq = New(WithTaskExecutor(testFactory), WithPersistence(&testDoNothingDb{}), WithClock(fake))
+	tk, err := dq.Push(999*time.Millisecond, notify.HTTP, "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), tk.DueTick)
+	tk, _ = dq.Push(1499*time.Millisecond, notify.HTTP, "")
+	assert.Equal(t, int64(1), tk.DueTick)
+	tk, _ = dq.Push(1500*time.Millisecond, notify.HTTP, "")
+	assert.Equal(t, int64(2), tk.DueTick)
+
+	dq = New(WithTaskExecutor(testFactory), WithPersistence(&testDoNothingDb{}), WithClock(fake), WithTick(100*time.Millisecond), WithWheelSizes(10, 60, 60))
+	tk, _ = dq.Push(250*time.Millisecond, notify.HTTP, "")
+	assert.Equal(t, int64(3), tk.DueTick)
+	assert.Equal(t, 1, dq.WheelTaskQuantity(0, 3))
+	tk, _ = dq.Push(2*time.Second, notify.HTTP, "")
+	assert.Equal(t, int64(20), tk.DueTick)
+	assert.Equal(t, 1, dq.WheelTaskQuantity(1, 2))
+	_, err = dq.Push(49*time.Millisecond, notify.HTTP, "")
+	assert.Equal(t, err.Error(), "the delay time rounds to zero ticks of 100ms, current is: 49ms")
+}
+
+func TestPushAt(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	dq = New(WithClock(fake), WithTaskExecutor(testFactory), WithPersistence(&testDoNothingDb{}))
+	dueAt := fake.Now().Add(90 * time.Second)
+	tk, err := dq.PushAt(dueAt, notify.HTTP, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, dueAt, tk.DueAt)
+	assert.Equal(t, int64(90), tk.DueTick)
+	assert.Equal(t, dueAt, dq.GetTask(tk.Id).DueAt)
+	assert.Equal(t, 1, dq.WheelTaskQuantity(1, 1))
+
+	tk, _ = dq.Push(10*time.Second, notify.HTTP, "hello")
+	assert.Equal(t, fake.Now().Add(10*time.Second), tk.DueAt)
+	assert.Equal(t, int64(10), tk.DueTick)
+
+	_, err = dq.PushAt(fake.Now().Add(-time.Minute), notify.HTTP, "hello")
+	assert.NotNil(t, err)
 }
 
 func TestPushTaskInCorrectPosition(t *testing.T) {
 	testBeforeSetUp()
 	var wg sync.WaitGroup
-	for i := 1; i <= WHEEL_SIZE; i++ {
+	for i := 1; i <= 3600; i++ {
 		wg.Add(1)
 		go func(index int) {
 			dq.Push(time.Duration(index)*time.Second, notify.HTTP, "")
@@ -89,9 +487,16 @@ func TestPushTaskInCorrectPosition(t *testing.T) {
 	}
 	wg.Wait()
 
-	for i := 1; i <= WHEEL_SIZE; i++ {
-		assert.Equal(t, 1, dq.WheelTaskQuantity(i%WHEEL_SIZE))
+	// less than one minute on the seconds level
+	for i := 1; i < SECONDS_WHEEL_SIZE; i++ {
+		assert.Equal(t, 1, dq.WheelTaskQuantity(0, i))
 	}
+	// less than one hour on the minutes level
+	for i := 1; i < MINUTES_WHEEL_SIZE; i++ {
+		assert.Equal(t, SECONDS_WHEEL_SIZE, dq.WheelTaskQuantity(1, i))
+	}
+	// one hour on the hours level
+	assert.Equal(t, 1, dq.WheelTaskQuantity(2, 1))
 }
 
 func TestConcurrentPush(t *testing.T) {
@@ -107,20 +512,102 @@ func TestConcurrentPush(t *testing.T) {
 		}()
 	}
 	wg.Wait()
-	assert.Equal(t, taskCounts, dq.WheelTaskQuantity(targetSeconds%WHEEL_SIZE))
+	assert.Equal(t, taskCounts, dq.WheelTaskQuantity(0, targetSeconds))
 }
 
 func TestExecuteTask(t *testing.T) {
-	testBeforeSetUp()
-	dq.Start()
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	executed := make(chan string, 10)
+	queue := testFakeClockQueue(fake, &testDoNothingDb{}, executed)
+	defer queue.Stop(context.Background())
 	targetSeconds := 2
-	tk, _ := dq.Push(time.Duration(targetSeconds)*time.Second, notify.HTTP, "hello,world")
+	tk, _ := queue.Push(time.Duration(targetSeconds)*time.Second, notify.HTTP, "hello,world")
 	assert.NotNil(t, tk)
+	assert.Equal(t, 1, queue.WheelTaskQuantity(0, targetSeconds))
+
+	testAdvance(t, fake, 1, time.Duration(targetSeconds-1)*time.Second)
+	testAssertPending(t, queue, tk)
+	testAdvance(t, fake, 1, time.Second)
+	testAssertExecuted(t, executed, "hello,world")
+	assert.Equal(t, 0, queue.WheelTaskQuantity(0, targetSeconds))
+	assert.Nil(t, queue.GetTask(tk.Id))
+}
+
+func TestIndependentQueues(t *testing.T) {
+	executed1 := make(chan string, 10)
+	executed2 := make(chan string, 10)
+	db1 := newTestMemoryDb()
+	db2 := newTestMemoryDb()
+	dq1 := New(WithTaskExecutor(testChanFactory(executed1)), WithPersistence(db1), WithTick(10*time.Millisecond))
+	dq2 := New(WithTaskExecutor(testChanFactory(executed2)), WithPersistence(db2), WithTick(20*time.Millisecond), WithWheelSizes(100, 100))
+	dq1.Start()
+	dq2.Start()
+	assert.True(t, dq1.IsReady())
+	assert.True(t, dq2.IsReady())
+
+	tk1, _ := dq1.Push(50*time.Millisecond, notify.HTTP, "queue1")
+	tk2, _ := dq2.Push(time.Hour, notify.HTTP, "queue2")
+	assert.Nil(t, dq2.GetTask(tk1.Id))
+	assert.Nil(t, dq1.GetTask(tk2.Id))
+	assert.Equal(t, 1, len(db2.GetList()))
+
+	select {
+	case contents := <-executed1:
+		assert.Equal(t, "queue1", contents)
+	case <-time.After(time.Second):
+		assert.Fail(t, "task of queue1 is not executed")
+	}
+	assert.Equal(t, 0, len(executed2))
+	assert.Eventually(t, func() bool { return len(db1.GetList()) == 0 }, time.Second, 10*time.Millisecond)
+	assert.NotNil(t, dq2.GetTask(tk2.Id))
+}
+
+// blocks the execution until it is released
+type testBlockingNotify struct {
+	started chan string
+	release chan struct{}
+}
+
+func (tn *testBlockingNotify) DoDelayTask(contents string) error {
+	tn.started <- contents
+	<-tn.release
+	return nil
+}
 
-	// wait to task be executed
-	time.Sleep(time.Duration(targetSeconds+2) * time.Second)
-	assert.Equal(t, 0, dq.WheelTaskQuantity(targetSeconds%WHEEL_SIZE))
-	assert.Nil(t, dq.GetTask(tk.Id))
+func TestStop(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testBlockingNotify{started: make(chan string, 1), release: make(chan struct{})}
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	queue := New(WithClock(fake), WithTaskExecutor(func(taskMode notify.NotifyMode) notify.Executor { return executor }), WithPersistence(db))
+	queue.Start()
+	queue.Push(3*time.Second, notify.HTTP, "hello")
+	tk, _ := queue.Push(time.Hour, notify.HTTP, "later")
+	testAdvance(t, fake, 1, 3*time.Second)
+	assert.Equal(t, "hello", <-executor.started)
+
+	// the execution is still running when the deadline is reached
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, queue.Stop(ctx))
+	assert.False(t, queue.IsReady())
+
+	// the pointer is persisted
+	pointer, savedAt := db.GetWheelTimePointer()
+	assert.Equal(t, 3, pointer)
+	assert.Equal(t, fake.Now(), savedAt)
+
+	close(executor.release)
+	assert.Nil(t, queue.Stop(context.Background()))
+
+	// the time wheel does not move any more, and no timer is left on the clock
+	assert.Equal(t, 0, fake.Timers())
+	fake.Advance(time.Hour)
+	assert.Equal(t, int64(pointer), queue.wheel.currentTick)
+	assert.NotNil(t, queue.GetTask(tk.Id))
+
+	// a stopped queue can not be started again
+	queue.Start()
+	assert.False(t, queue.IsReady())
 }
 
 func TestGetTask(t *testing.T) {
@@ -139,6 +626,29 @@ func TestGetTask(t *testing.T) {
 	assert.Equal(t, dq.GetTask(tk3.Id).TaskData, "hello3")
 }
 
+func TestTaskMetadata(t *testing.T) {
+	testBeforeSetUp()
+	before := time.Now()
+	tk, _ := dq.Push(10*time.Second, notify.HTTP, "hello", WithTags(map[string]string{"tenant": "a", "source": "orders"}), WithTag("order_id", "1001"))
+	assert.False(t, tk.CreatedAt.Before(before))
+	assert.WithinDuration(t, tk.CreatedAt.Add(10*time.Second), tk.DueAt, time.Second)
+
+	task := dq.GetTask(tk.Id)
+	assert.Equal(t, map[string]string{"tenant": "a", "source": "orders", "order_id": "1001"}, task.Tags)
+	assert.Equal(t, 0, task.Attempts)
+	assert.Equal(t, "", task.LastError)
+
+	// the returned tags are a copy
+	task.Tags["tenant"] = "b"
+	assert.Equal(t, "a", dq.GetTask(tk.Id).Tags["tenant"])
+
+	// an update keeps the metadata
+	dq.UpdateTask(tk.Id, notify.SubPub, "updated")
+	task = dq.GetTask(tk.Id)
+	assert.Equal(t, "a", task.Tags["tenant"])
+	assert.True(t, tk.CreatedAt.Equal(task.CreatedAt))
+}
+
 func TestConcurrentGetTask(t *testing.T) {
 	testBeforeSetUp()
 	targetSeconds := 50
@@ -153,21 +663,22 @@ func TestConcurrentGetTask(t *testing.T) {
 	}
 
 	innerTotal := 0
+	var lock sync.Mutex
 	for i := 0; i < taskCounts; i++ {
 		wg.Add(1)
 		go func(index int) {
 			tk := dq.GetTask(taskIds[index])
 			if tk != nil {
 				p, _ := strconv.Atoi(tk.TaskData)
-				mutex.Lock()
+				lock.Lock()
 				innerTotal = innerTotal + p
-				mutex.Unlock()
+				lock.Unlock()
 			}
 			wg.Done()
 		}(i)
 	}
 	wg.Wait()
-	assert.Equal(t, taskCounts, dq.WheelTaskQuantity(targetSeconds%WHEEL_SIZE))
+	assert.Equal(t, taskCounts, dq.WheelTaskQuantity(0, targetSeconds))
 	assert.Equal(t, total, innerTotal)
 }
 
@@ -185,6 +696,42 @@ func TestUpdateTask(t *testing.T) {
 	assert.Equal(t, dq.GetTask(tk1.Id).TaskData, "hello100")
 }
 
+func TestRescheduleTask(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	db := newTestMemoryDb()
+	dq = New(WithClock(fake), WithTaskExecutor(testFactory), WithPersistence(db))
+	tk, _ := dq.Push(10*time.Second, notify.HTTP, "hello", WithTag("tenant", "a"))
+	assert.Equal(t, 1, dq.WheelTaskQuantity(0, 10))
+
+	// move it to the minutes level
+	task, err := dq.Reschedule(tk.Id, 2*time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, tk.Id, task.Id)
+	assert.Equal(t, int64(120), task.DueTick)
+	assert.Equal(t, 0, dq.WheelTaskQuantity(0, 10))
+	assert.Equal(t, 1, dq.WheelTaskQuantity(1, 2))
+	assert.Equal(t, "a", dq.GetTask(tk.Id).Tags["tenant"])
+	db.Lock()
+	assert.Equal(t, int64(120), db.tasks[tk.Id].DueTick)
+	db.Unlock()
+
+	dueAt := fake.Now().Add(5 * time.Second)
+	task, err = dq.RescheduleAt(tk.Id, dueAt)
+	assert.Nil(t, err)
+	assert.Equal(t, dueAt, task.DueAt)
+	assert.Equal(t, int64(5), task.DueTick)
+	assert.Equal(t, 0, dq.WheelTaskQuantity(1, 2))
+	assert.Equal(t, 1, dq.WheelTaskQuantity(0, 5))
+	assert.Equal(t, 1, len(dq.TaskQueryTable))
+
+	_, err = dq.Reschedule(tk.Id, 0)
+	assert.NotNil(t, err)
+	_, err = dq.RescheduleAt(tk.Id, fake.Now().Add(-time.Minute))
+	assert.NotNil(t, err)
+	_, err = dq.Reschedule("not-exist", time.Minute)
+	assert.NotNil(t, err)
+}
+
 func TestDeleteTask(t *testing.T) {
 	testBeforeSetUp()
 	targetSeconds := 10
@@ -192,11 +739,11 @@ func TestDeleteTask(t *testing.T) {
 	tk2, _ := dq.Push(time.Duration(targetSeconds)*time.Second, notify.SubPub, "hello2")
 	tk3, _ := dq.Push(time.Duration(targetSeconds)*time.Second, notify.SubPub, "hello3")
 	assert.Equal(t, 3, len(dq.TaskQueryTable))
-	assert.Equal(t, 3, dq.WheelTaskQuantity(targetSeconds%WHEEL_SIZE))
+	assert.Equal(t, 3, dq.WheelTaskQuantity(0, targetSeconds))
 	err := dq.DeleteTask(tk2.Id)
 	assert.Nil(t, err)
 	assert.Equal(t, 2, len(dq.TaskQueryTable))
-	assert.Equal(t, 2, dq.WheelTaskQuantity(targetSeconds%WHEEL_SIZE))
+	assert.Equal(t, 2, dq.WheelTaskQuantity(0, targetSeconds))
 
 	assert.Equal(t, dq.GetTask(tk1.Id).TaskMode, notify.HTTP)
 	assert.Equal(t, dq.GetTask(tk1.Id).TaskData, "hello1")
@@ -208,7 +755,7 @@ func TestDeleteTask(t *testing.T) {
 	dq.DeleteTask(tk3.Id)
 
 	assert.Equal(t, 0, len(dq.TaskQueryTable))
-	assert.Equal(t, 0, dq.WheelTaskQuantity(targetSeconds%WHEEL_SIZE))
+	assert.Equal(t, 0, dq.WheelTaskQuantity(0, targetSeconds))
 }
 
 func TestConcurrentDeleteTasks(t *testing.T) {
@@ -232,7 +779,7 @@ func TestConcurrentDeleteTasks(t *testing.T) {
 	wg.Wait()
 	assert.Equal(t, taskCounts, len(dq.TaskQueryTable))
 	assert.Equal(t, taskCounts, len(taskIds))
-	assert.Equal(t, taskCounts, dq.WheelTaskQuantity(targetSeconds%WHEEL_SIZE))
+	assert.Equal(t, taskCounts, dq.WheelTaskQuantity(0, targetSeconds))
 
 	for i := 0; i < taskCounts; i++ {
 		wg.Add(1)
@@ -244,44 +791,110 @@ func TestConcurrentDeleteTasks(t *testing.T) {
 	wg.Wait()
 
 	assert.Equal(t, 0, len(dq.TaskQueryTable))
-	assert.Equal(t, 0, dq.WheelTaskQuantity(targetSeconds%WHEEL_SIZE))
+	assert.Equal(t, 0, dq.WheelTaskQuantity(0, targetSeconds))
 }
 
 func TestDelayQueueAndRedisIntegrate(t *testing.T) {
 	testWithRedisBeforeSetUp()
 
-	randomSlots := []int{60, 100, 560, 2450, 3500}
+	randomSlots := []int{60, 100, 560, 2450, 3500, 90000}
 	eachSoltNodes := 100
+	positions := map[string][2]int{}
 	for _, seconds := range randomSlots {
 		for i := 0; i < eachSoltNodes; i++ {
-			dq.Push(time.Duration(seconds)*time.Second, notify.HTTP, i)
+			tk, _ := dq.Push(time.Duration(seconds)*time.Second, notify.HTTP, i)
+			positions[tk.Id] = [2]int{tk.WheelLevel, tk.WheelPosition}
 		}
 	}
 	assert.Equal(t, eachSoltNodes*len(randomSlots), len(dq.TaskQueryTable))
-	for _, seconds := range randomSlots {
-		assert.Equal(t, eachSoltNodes, dq.WheelTaskQuantity(seconds%WHEEL_SIZE))
-	}
 	//remove nodes
 	dq.TaskQueryTable = make(SlotRecorder)
-	for i := 0; i < len(dq.TimeWheel); i++ {
-		dq.TimeWheel[i].NotifyTasks = nil
-	}
-	// Do not use range to fetch wheel, it will use copy value
-	// for _, wheel := range dq.TimeWheel {
-	// 	wheel.NotifyTasks = nil
-	// }
+	dq.wheel.clear()
 	assert.Equal(t, 0, len(dq.TaskQueryTable))
-	for _, seconds := range randomSlots {
-		assert.Equal(t, 0, dq.WheelTaskQuantity(seconds%WHEEL_SIZE))
-	}
 	// load from cache
-	dq.loadTasksFromDb()
+	dq.loadTasksFromDb(time.Time{})
 	assert.Equal(t, eachSoltNodes*len(randomSlots), len(dq.TaskQueryTable))
-	for _, seconds := range randomSlots {
-		assert.Equal(t, eachSoltNodes, dq.WheelTaskQuantity(seconds%WHEEL_SIZE))
+	for id, position := range positions {
+		tk := dq.GetTask(id)
+		assert.NotNil(t, tk)
+		assert.Equal(t, position, [2]int{tk.WheelLevel, tk.WheelPosition})
 	}
 }
 
+func TestLoadTasksAfterDowntime(t *testing.T) {
+	now := time.Now()
+	for _, policy := range []LatePolicy{LateRun, LateSkip, LateDeadLetter} {
+		db := newTestMemoryDb()
+		db.Save(&Task{Id: "future", DueAt: now.Add(90 * time.Second)})
+		db.Save(&Task{Id: "overdue", DueAt: now.Add(-10 * time.Minute)})
+		db.Save(&Task{Id: "tolerated", DueAt: now.Add(-2 * time.Second)})
+		// saved before the due time was persisted, the pointer was saved 40 seconds ago
+		db.Save(&Task{Id: "legacy", DueTick: 1100})
+
+		dq = New(WithTaskExecutor(testFactory), WithPersistence(db), WithLatePolicy(policy), WithLateTolerance(5*time.Second))
+		dq.wheel.currentTick = 1000
+		dq.refTick = 1000
+		dq.refTime = now
+		dq.loadTasksFromDb(now.Add(-40 * time.Second))
+
+		assert.Equal(t, int64(1090), dq.GetTask("future").DueTick)
+		assert.Equal(t, int64(1001), dq.GetTask("tolerated").DueTick)
+		assert.Equal(t, int64(1060), dq.GetTask("legacy").DueTick)
+		switch policy {
+		case LateRun:
+			assert.Equal(t, int64(1001), dq.GetTask("overdue").DueTick)
+			assert.Equal(t, 4, len(db.GetList()))
+		case LateSkip:
+			assert.Nil(t, dq.GetTask("overdue"))
+			assert.Equal(t, 3, len(db.GetList()))
+			assert.Equal(t, 0, len(db.deadLetters))
+		case LateDeadLetter:
+			assert.Nil(t, dq.GetTask("overdue"))
+			assert.Equal(t, 3, len(db.GetList()))
+			assert.NotNil(t, db.deadLetters["overdue"])
+		}
+	}
+}
+
+func TestLoadTasksOfSingleTimeWheel(t *testing.T) {
+	for _, policy := range []LatePolicy{LateRun, LateSkip, LateDeadLetter} {
+		db := newTestMemoryDb()
+		// saved by the single time wheel of 3600 slots, the pointer was a plain index
+		task := &Task{}
+		assert.Nil(t, json.Unmarshal([]byte(`{"Id":"old","CycleCount":2,"WheelPosition":100,"TaskMode":1,"TaskData":"hello"}`), task))
+		db.Save(task)
+
+		dq = New(WithTaskExecutor(testFactory), WithPersistence(db), WithLatePolicy(policy))
+		dq.wheel.currentTick = 50
+		dq.refTick = 50
+		dq.loadTasksFromDb(time.Time{})
+
+		// two rounds of the wheel and 50 slots from the pointer
+		loaded := dq.GetTask("old")
+		assert.NotNil(t, loaded, policy.String())
+		assert.Equal(t, int64(50+2*3600+50), loaded.DueTick)
+		assert.Equal(t, 0, len(db.deadLetters))
+		assert.Equal(t, 0, db.GetList()[0].CycleCount)
+	}
+}
+
+func TestLoadOnlySavesTheTasksOfOlderVersions(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	db := newTestMemoryDb()
+	db.Save(&Task{Id: "current", DueAt: fake.Now().Add(time.Hour), DueTick: 7, TaskMode: notify.HTTP, TaskData: "hello"})
+	db.Save(&Task{Id: "old", DueTick: 60, TaskMode: notify.HTTP, TaskData: "hello"})
+
+	queue := New(WithClock(fake), WithTaskExecutor(testFactory), WithPersistence(db))
+	queue.loadTasksFromDb(time.Time{})
+	assert.Equal(t, int64(3600), queue.GetTask("current").DueTick)
+	assert.Equal(t, 1, db.batches)
+	db.Lock()
+	defer db.Unlock()
+	// the due tick of a task with a due time is not saved again
+	assert.Equal(t, int64(7), db.tasks["current"].DueTick)
+	assert.Equal(t, fake.Now().Add(time.Minute), db.tasks["old"].DueAt)
+}
+
 func BenchmarkPushTask(b *testing.B) {
 	testBeforeSetUp()
 	targetSeconds := 50
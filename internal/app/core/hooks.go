@@ -0,0 +1,237 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the default number of events which can wait for their hooks
+const DEFAULT_HOOK_QUEUE_SIZE = 10000
+
+// EventType is the kind of an event in the life of a task
+type EventType int
+
+const (
+	// a task is added to the delay queue
+	EventPush EventType = iota + 1
+	// the data or the due time of a pending task is changed
+	EventUpdate
+	// a pending or waiting task is deleted
+	EventDelete
+	// a task is due and handed to the worker pool
+	EventDue
+	// an execution of a task succeeded
+	EventSuccess
+	// an execution of a task failed, the task may be retried
+	EventFailure
+	// a task failed for good and is moved to the dead letters
+	EventDeadLetter
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventPush:
+		return "push"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	case EventDue:
+		return "due"
+	case EventSuccess:
+		return "success"
+	case EventFailure:
+		return "failure"
+	case EventDeadLetter:
+		return "dead-letter"
+	default:
+		return "unknown"
+	}
+}
+
+// TaskEvent is what a hook gets on an event
+type TaskEvent struct {
+	Type EventType
+	// a copy of the task at the time of the event
+	Task *Task
+	// the error of a failed execution, or the last error of a dead letter
+	Err error
+	// how long the execution took on success and failure, how late the task is handed to the workers when it is due
+	Duration time.Duration
+}
+
+// ActionEvent is a hook which is called on the events of the tasks
+type ActionEvent func(event TaskEvent)
+
+// calls the hooks of the events one after another in the order of the events,
+// the hooks run on their own goroutine, so a slow hook does not hold the time wheel and a hook can call the delay queue.
+// at most size events wait for the hooks, the events past it are dropped and counted.
+type hookSet struct {
+	mutex    sync.Mutex
+	hooks    map[EventType][]ActionEvent
+	pending  []TaskEvent
+	size     int
+	dropped  uint64
+	running  bool
+	finished *sync.Cond
+	// whether the events are being dropped since the queue was full, so a drop is logged once until the queue is drained
+	overflowing bool
+}
+
+func (hs *hookSet) add(eventType EventType, hook ActionEvent) {
+	if hook == nil {
+		return
+	}
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	if hs.hooks == nil {
+		hs.hooks = map[EventType][]ActionEvent{}
+	}
+	hs.hooks[eventType] = append(hs.hooks[eventType], hook)
+}
+
+// whether any hook is registered for the type of events
+func (hs *hookSet) has(eventType EventType) bool {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	return len(hs.hooks[eventType]) > 0
+}
+
+// queue an event for its hooks, it never blocks, the event is dropped if the queue is full
+func (hs *hookSet) emit(event TaskEvent) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	if len(hs.hooks[event.Type]) == 0 {
+		return
+	}
+	if hs.size > 0 && len(hs.pending) >= hs.size {
+		dropped := atomic.AddUint64(&hs.dropped, 1)
+		if !hs.overflowing {
+			hs.overflowing = true
+			log.Printf("the hooks are %d events behind, the %s event of task %s is dropped, %d events are dropped so far\n", len(hs.pending), event.Type, event.Task.Id, dropped)
+		}
+		return
+	}
+	hs.pending = append(hs.pending, event)
+	if !hs.running {
+		hs.running = true
+		go hs.dispatch()
+	}
+}
+
+func (hs *hookSet) dispatch() {
+	for {
+		hs.mutex.Lock()
+		if len(hs.pending) == 0 {
+			hs.running = false
+			hs.overflowing = false
+			if hs.finished != nil {
+				hs.finished.Broadcast()
+			}
+			hs.mutex.Unlock()
+			return
+		}
+		event := hs.pending[0]
+		hs.pending = hs.pending[1:]
+		hooks := hs.hooks[event.Type]
+		hs.mutex.Unlock()
+
+		for _, hook := range hooks {
+			callHook(hook, event)
+		}
+	}
+}
+
+// a panic of a hook does not stop the following hooks
+func callHook(hook ActionEvent, event TaskEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("the %s hook of task %s panics: %v\n", event.Type, event.Task.Id, r)
+		}
+	}()
+	hook(event)
+}
+
+// wait until the hooks of the queued events have been called
+func (hs *hookSet) wait() {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	if hs.finished == nil {
+		hs.finished = sync.NewCond(&hs.mutex)
+	}
+	for hs.running {
+		hs.finished.Wait()
+	}
+}
+
+// DroppedEvents returns the number of events whose hooks were not called because too many events were waiting for the hooks
+func (dq *DelayQueue) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&dq.hooks.dropped)
+}
+
+// report an event of a task to the hooks
+func (dq *DelayQueue) emit(eventType EventType, task *Task, err error, duration time.Duration) {
+	// the task is only copied when a hook gets it
+	if !dq.hooks.has(eventType) {
+		return
+	}
+	dq.hooks.emit(TaskEvent{Type: eventType, Task: task.clone(), Err: err, Duration: duration})
+}
+
+// report the result of addTask, a push applied to the pending task with its key is an update
+func (dq *DelayQueue) emitAdded(task *Task, changed *Task) {
+	if changed == task {
+		dq.emit(EventPush, task, nil, 0)
+	} else if changed != nil {
+		dq.emit(EventUpdate, changed, nil, 0)
+	}
+}
+
+// OnPush registers a hook which is called when a task is added to the delay queue,
+// the occurrences of the schedules included.
+func (dq *DelayQueue) OnPush(hook ActionEvent) {
+	dq.hooks.add(EventPush, hook)
+}
+
+// OnUpdate registers a hook which is called when a pending task is changed, rescheduled,
+// or merged with a debounced or throttled push.
+func (dq *DelayQueue) OnUpdate(hook ActionEvent) {
+	dq.hooks.add(EventUpdate, hook)
+}
+
+// OnDelete registers a hook which is called when a pending or waiting task is deleted
+func (dq *DelayQueue) OnDelete(hook ActionEvent) {
+	dq.hooks.add(EventDelete, hook)
+}
+
+// OnDue registers a hook which is called when a task is due, the duration is how late it is
+func (dq *DelayQueue) OnDue(hook ActionEvent) {
+	dq.hooks.add(EventDue, hook)
+}
+
+// OnSuccess registers a hook which is called when an execution succeeds, the duration is how long it took
+func (dq *DelayQueue) OnSuccess(hook ActionEvent) {
+	dq.hooks.add(EventSuccess, hook)
+}
+
+// OnFailure registers a hook which is called on every failed execution with its error,
+// the duration is how long it took.
+func (dq *DelayQueue) OnFailure(hook ActionEvent) {
+	dq.hooks.add(EventFailure, hook)
+}
+
+// OnDeadLetter registers a hook which is called when a task is moved to the dead letters
+func (dq *DelayQueue) OnDeadLetter(hook ActionEvent) {
+	dq.hooks.add(EventDeadLetter, hook)
+}
+
+// the last error of a task as an error, nil if there is none
+func lastErrorOf(task *Task) error {
+	if task.LastError == "" {
+		return nil
+	}
+	return errors.New(task.LastError)
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// records the events of the tasks as "type task-id", with the error and duration if there is any
+type testEventRecorder struct {
+	sync.Mutex
+	events []string
+}
+
+func (tr *testEventRecorder) record(event TaskEvent) {
+	tr.Lock()
+	defer tr.Unlock()
+	record := fmt.Sprintf("%s %s", event.Type, event.Task.TaskData)
+	if event.Err != nil {
+		record += " " + event.Err.Error()
+	}
+	if event.Duration > 0 {
+		record += " " + event.Duration.String()
+	}
+	tr.events = append(tr.events, record)
+}
+
+func (tr *testEventRecorder) count() int {
+	tr.Lock()
+	defer tr.Unlock()
+	return len(tr.events)
+}
+
+func (tr *testEventRecorder) registerAll(queue *DelayQueue) {
+	for _, on := range []func(ActionEvent){queue.OnPush, queue.OnUpdate, queue.OnDelete, queue.OnDue, queue.OnSuccess, queue.OnFailure, queue.OnDeadLetter} {
+		on(tr.record)
+	}
+}
+
+func testHookQueue(fake *clock.Fake, executor notify.Executor, policy RetryPolicy) *DelayQueue {
+	return New(
+		WithClock(fake),
+		WithPersistence(newTestMemoryDb()),
+		WithTaskExecutor(func(taskMode notify.NotifyMode) notify.Executor { return executor }),
+		WithDefaultRetryPolicy(policy),
+	)
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	executor := &testFlakyNotify{failTimes: 1, err: errors.New("service unavailable")}
+	queue := testHookQueue(fake, executor, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second})
+	recorder := &testEventRecorder{}
+	recorder.registerAll(queue)
+	queue.Start()
+
+	queue.Push(2*time.Second, notify.HTTP, "a")
+	b, _ := queue.Push(time.Hour, notify.HTTP, "b")
+	queue.UpdateTask(b.Id, notify.HTTP, "b2")
+	queue.DeleteTask(b.Id)
+
+	// the first execution fails and the task is retried a second later
+	testAdvance(t, fake, 1, 2*time.Second)
+	assert.Eventually(t, func() bool { return recorder.count() == 6 }, 5*time.Second, time.Millisecond)
+	testAdvance(t, fake, 1, time.Second)
+	assert.Eventually(t, func() bool { return recorder.count() == 8 }, 5*time.Second, time.Millisecond)
+	assert.Nil(t, queue.Stop(context.Background()))
+
+	assert.Equal(t, []string{
+		"push a",
+		"push b",
+		"update b2",
+		"delete b2",
+		"due a",
+		"failure a service unavailable",
+		"due a",
+		"success a",
+	}, recorder.events)
+}
+
+func TestDeadLetterHook(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	executor := &testFlakyNotify{failTimes: 1, err: errors.New("service unavailable")}
+	queue := testHookQueue(fake, executor, RetryPolicy{MaxAttempts: 1})
+	recorder := &testEventRecorder{}
+	queue.OnDeadLetter(recorder.record)
+	queue.Start()
+
+	queue.Push(time.Second, notify.HTTP, "a")
+	testAdvance(t, fake, 1, time.Second)
+	assert.Eventually(t, func() bool { return recorder.count() == 1 }, 5*time.Second, time.Millisecond)
+	assert.Nil(t, queue.Stop(context.Background()))
+	assert.Equal(t, []string{"dead-letter a service unavailable"}, recorder.events)
+}
+
+func TestHooksCanCallTheQueue(t *testing.T) {
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(newTestMemoryDb()))
+	recorder := &testEventRecorder{}
+	// a panic does not stop the other hooks
+	queue.OnPush(func(event TaskEvent) { panic("broken hook") })
+	queue.OnPush(func(event TaskEvent) {
+		if event.Task.TaskData == "a" {
+			queue.Push(time.Hour, notify.HTTP, "pushed by a hook")
+		}
+	})
+	queue.OnPush(recorder.record)
+
+	_, err := queue.Push(time.Hour, notify.HTTP, "a")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return recorder.count() == 2 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []string{"push a", "push pushed by a hook"}, recorder.events)
+	assert.Nil(t, queue.Stop(context.Background()))
+}
+
+func TestHookQueueDropsTheEventsPastItsSize(t *testing.T) {
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	recorder := &testEventRecorder{}
+	queue := New(
+		WithTaskExecutor(testFactory),
+		WithPersistence(newTestMemoryDb()),
+		WithHookQueueSize(2),
+		WithHook(EventPush, func(event TaskEvent) {
+			started <- event.Task.TaskData
+			<-release
+		}),
+		WithHook(EventPush, recorder.record),
+	)
+
+	_, err := queue.Push(time.Hour, notify.HTTP, "a")
+	assert.Nil(t, err)
+	// the hook of the first event holds the others in the queue
+	testAssertExecuted(t, started, "a")
+	for _, data := range []string{"b", "c", "d", "e"} {
+		_, err := queue.Push(time.Hour, notify.HTTP, data)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, uint64(2), queue.DroppedEvents())
+
+	close(release)
+	assert.Nil(t, queue.Stop(context.Background()))
+	assert.Equal(t, []string{"push a", "push b", "push c"}, recorder.events)
+	assert.Equal(t, uint64(2), queue.DroppedEvents())
+}
+
+func TestEventsWithoutHooksAreNotQueued(t *testing.T) {
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(newTestMemoryDb()))
+	recorder := &testEventRecorder{}
+	queue.OnDue(recorder.record)
+
+	tk, _ := queue.Push(time.Hour, notify.HTTP, "a")
+	queue.DeleteTask(tk.Id)
+	// the task is not even copied for an event without hooks
+	assert.NotPanics(t, func() { queue.emit(EventPush, nil, nil, 0) })
+	queue.hooks.mutex.Lock()
+	assert.False(t, queue.hooks.running)
+	assert.Equal(t, 0, len(queue.hooks.pending))
+	queue.hooks.mutex.Unlock()
+	assert.Equal(t, 0, recorder.count())
+}
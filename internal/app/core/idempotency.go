@@ -0,0 +1,40 @@
+package core
+
+import "time"
+
+// the default time the idempotency key of a pushed task is kept
+const DEFAULT_IDEMPOTENCY_RETENTION = 24 * time.Hour
+
+// the task pushed before with the same id or idempotency key, nil if the task is not a duplicate,
+// the caller must hold the lock
+func (dq *DelayQueue) duplicateOf(task *Task, clientId bool) (*Task, error) {
+	if clientId {
+		if existing, ok := dq.TaskQueryTable[task.Id]; ok {
+			return existing.clone(), nil
+		}
+		if existing, ok := dq.running[task.Id]; ok {
+			return existing.clone(), nil
+		}
+	}
+	key := idempotencyKeyOf(task, clientId)
+	if key == "" || dq.idempotencyRetention <= 0 {
+		return nil, nil
+	}
+	claimed, err := dq.Persistence.ClaimIdempotencyKey(key, task, dq.idempotencyRetention)
+	if err != nil || claimed == nil {
+		return nil, err
+	}
+	// the task as it is now, or as it was pushed if it is no longer known
+	if existing := dq.lookupTask(claimed.Id); existing != nil {
+		return existing, nil
+	}
+	return claimed, nil
+}
+
+// the idempotency key a push claims, the id supplied by the client is an idempotency key as well
+func idempotencyKeyOf(task *Task, clientId bool) string {
+	if task.IdempotencyKey == "" && clientId {
+		return "id:" + task.Id
+	}
+	return task.IdempotencyKey
+}
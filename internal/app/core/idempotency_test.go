@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushWithTaskId(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	tk, err := queue.Push(time.Minute, notify.HTTP, "hello", WithTaskId("order-1001"))
+	assert.Nil(t, err)
+	assert.Equal(t, "order-1001", tk.Id)
+
+	// the retried push returns the existing task
+	again, err := queue.Push(2*time.Minute, notify.HTTP, "world", WithTaskId("order-1001"))
+	assert.Nil(t, err)
+	assert.Equal(t, "order-1001", again.Id)
+	assert.Equal(t, "hello", again.TaskData)
+	assert.True(t, tk.DueAt.Equal(again.DueAt))
+	assert.Equal(t, 1, len(queue.TaskQueryTable))
+	assert.Equal(t, 1, len(db.GetList()))
+}
+
+func TestPushWithIdempotencyKey(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	tk, err := queue.Push(time.Minute, notify.HTTP, "hello", WithIdempotencyKey("request-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "request-1", tk.IdempotencyKey)
+	again, _ := queue.Push(time.Minute, notify.HTTP, "hello", WithIdempotencyKey("request-1"))
+	assert.Equal(t, tk.Id, again.Id)
+	other, _ := queue.Push(time.Minute, notify.HTTP, "hello", WithIdempotencyKey("request-2"))
+	assert.NotEqual(t, tk.Id, other.Id)
+	assert.Equal(t, 2, len(queue.TaskQueryTable))
+
+	// the key is kept after the task is gone, the last known state is returned
+	assert.Nil(t, queue.DeleteTask(tk.Id))
+	again, _ = queue.Push(time.Minute, notify.HTTP, "hello", WithIdempotencyKey("request-1"))
+	assert.Equal(t, tk.Id, again.Id)
+	assert.Equal(t, TaskCancelled, again.State)
+	assert.Equal(t, 1, len(queue.TaskQueryTable))
+
+	// the task as it was pushed is returned once its final state expired
+	db.Lock()
+	delete(db.statuses, tk.Id)
+	db.Unlock()
+	again, _ = queue.Push(time.Minute, notify.HTTP, "hello", WithIdempotencyKey("request-1"))
+	assert.Equal(t, tk.Id, again.Id)
+	assert.Equal(t, TaskPending, again.State)
+	assert.Equal(t, 1, len(queue.TaskQueryTable))
+}
+
+func TestIdempotencyKeyAcrossRestarts(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	queue.Start()
+	tk, _ := queue.Push(time.Minute, notify.HTTP, "hello", WithTaskId("order-1001"), WithIdempotencyKey("request-1"))
+	assert.Nil(t, queue.Stop(context.Background()))
+
+	restarted := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	restarted.Start()
+	defer restarted.Stop(context.Background())
+	again, _ := restarted.Push(time.Minute, notify.HTTP, "hello", WithIdempotencyKey("request-1"))
+	assert.Equal(t, tk.Id, again.Id)
+	again, _ = restarted.Push(time.Minute, notify.HTTP, "hello", WithTaskId("order-1001"))
+	assert.Equal(t, tk.Id, again.Id)
+	assert.Equal(t, 1, len(db.GetList()))
+}
+
+func TestIdempotencyRetentionDisabled(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db), WithIdempotencyRetention(0))
+	tk, _ := queue.Push(time.Minute, notify.HTTP, "hello", WithIdempotencyKey("request-1"))
+	again, _ := queue.Push(time.Minute, notify.HTTP, "hello", WithIdempotencyKey("request-1"))
+	assert.NotEqual(t, tk.Id, again.Id)
+	assert.Equal(t, 0, len(db.keys))
+
+	// the pending tasks are still deduplicated by their ids
+	queue.Push(time.Minute, notify.HTTP, "hello", WithTaskId("order-1001"))
+	queue.Push(time.Minute, notify.HTTP, "hello", WithTaskId("order-1001"))
+	assert.Equal(t, 3, len(queue.TaskQueryTable))
+}
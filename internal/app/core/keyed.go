@@ -0,0 +1,83 @@
+package core
+
+// KeyMode decides what a push does when a task with the same key is pending
+type KeyMode int
+
+const (
+	// the pending task takes the payload of the push and its timer is reset
+	KeyDebounce KeyMode = iota + 1
+	// the push is ignored
+	KeyThrottle
+)
+
+func (km KeyMode) String() string {
+	switch km {
+	case KeyDebounce:
+		return "debounce"
+	case KeyThrottle:
+		return "throttle"
+	default:
+		return "unknown"
+	}
+}
+
+// the pending task with the key, nil if there is none,
+// the caller must hold the lock
+func (dq *DelayQueue) pendingByKey(key string) *Task {
+	if key == "" {
+		return nil
+	}
+	task, ok := dq.keyed[key]
+	if !ok {
+		return nil
+	}
+	// the task may have left the time wheel by a way which does not forget its key
+	if pending, ok := dq.TaskQueryTable[task.Id]; !ok || pending != task {
+		delete(dq.keyed, key)
+		return nil
+	}
+	return task
+}
+
+// the task is no longer pending, the caller must hold the lock
+func (dq *DelayQueue) forgetKey(task *Task) {
+	if task.Key != "" && dq.keyed[task.Key] == task {
+		delete(dq.keyed, task.Key)
+	}
+}
+
+// apply a push to the pending task with the same key, the mode of the push decides what happens,
+// returns a copy of the pending task, and the pending task if it has been changed. the caller must hold the lock
+func (dq *DelayQueue) pushOnKey(pending, pushed *Task) (*Task, *Task) {
+	if pushed.KeyMode == KeyThrottle {
+		return pending.clone(), nil
+	}
+	dq.wheel.remove(pending)
+	pending.TaskMode = pushed.TaskMode
+	pending.TaskData = pushed.TaskData
+	pending.KeyMode = pushed.KeyMode
+	if pushed.Tags != nil {
+		pending.Tags = pushed.Tags
+	}
+	if pushed.RetryPolicy != nil {
+		pending.RetryPolicy = pushed.RetryPolicy
+	}
+	pending.DueAt = pushed.DueAt
+	pending.DueTick = dq.dueTickOf(pushed.DueAt)
+	dq.wheel.add(pending)
+	return pending.clone(), pending
+}
+
+// restore a pending task changed by a debounced push, such as when the change could not be persisted,
+// the caller must hold the lock
+func (dq *DelayQueue) undoPushOnKey(pending, original *Task) {
+	dq.wheel.remove(pending)
+	pending.TaskMode = original.TaskMode
+	pending.TaskData = original.TaskData
+	pending.KeyMode = original.KeyMode
+	pending.Tags = original.Tags
+	pending.RetryPolicy = original.RetryPolicy
+	pending.DueAt = original.DueAt
+	pending.DueTick = original.DueTick
+	dq.wheel.add(pending)
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebouncePush(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	tk, err := queue.Push(30*time.Minute, notify.HTTP, "http://www.google.com|first", WithDebounce("user-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, KeyDebounce, tk.KeyMode)
+
+	// the pending task takes the new payload and its timer is reset
+	again, err := queue.Push(time.Hour, notify.HTTP, "http://www.google.com|second", WithDebounce("user-1"), WithTag("tenant", "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, tk.Id, again.Id)
+	assert.Equal(t, "http://www.google.com|second", again.TaskData)
+	assert.True(t, again.DueAt.After(tk.DueAt))
+	assert.Equal(t, "a", again.Tags["tenant"])
+	assert.Equal(t, 1, len(queue.TaskQueryTable))
+	saved := db.GetList()
+	assert.Equal(t, 1, len(saved))
+	assert.Equal(t, "http://www.google.com|second", saved[0].TaskData)
+	assert.Equal(t, queue.dueTickOf(again.DueAt), queue.TaskQueryTable[tk.Id].DueTick)
+
+	other, _ := queue.Push(time.Hour, notify.HTTP, "hello", WithDebounce("user-2"))
+	assert.NotEqual(t, tk.Id, other.Id)
+
+	// once the task is deleted a new one is added
+	assert.Nil(t, queue.DeleteTask(tk.Id))
+	again, _ = queue.Push(time.Hour, notify.HTTP, "hello", WithDebounce("user-1"))
+	assert.NotEqual(t, tk.Id, again.Id)
+}
+
+func TestThrottlePush(t *testing.T) {
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(newTestMemoryDb()))
+	tk, _ := queue.Push(30*time.Minute, notify.HTTP, "first", WithThrottle("user-1"))
+	again, err := queue.Push(time.Hour, notify.HTTP, "second", WithThrottle("user-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, tk.Id, again.Id)
+	assert.Equal(t, "first", again.TaskData)
+	assert.True(t, tk.DueAt.Equal(again.DueAt))
+	assert.Equal(t, 1, len(queue.TaskQueryTable))
+}
+
+func TestKeyIsReleasedWhenTaskIsDue(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testChanNotify{executed: make(chan string, 10)}
+	queue := testRetryQueue(executor, db, RetryPolicy{MaxAttempts: 1})
+	defer queue.Stop(context.Background())
+
+	queue.Push(50*time.Millisecond, notify.HTTP, "first", WithThrottle("user-1"))
+	queue.Push(50*time.Millisecond, notify.HTTP, "second", WithThrottle("user-1"))
+	assert.Equal(t, "first", <-executor.executed)
+	queue.Push(50*time.Millisecond, notify.HTTP, "third", WithThrottle("user-1"))
+	assert.Equal(t, "third", <-executor.executed)
+}
+
+func TestKeysAreLoadedAfterRestart(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	queue.Start()
+	tk, _ := queue.Push(time.Hour, notify.HTTP, "first", WithDebounce("user-1"))
+	assert.Nil(t, queue.Stop(context.Background()))
+
+	restarted := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	restarted.Start()
+	defer restarted.Stop(context.Background())
+	again, _ := restarted.Push(time.Hour, notify.HTTP, "second", WithDebounce("user-1"))
+	assert.Equal(t, tk.Id, again.Id)
+	assert.Equal(t, 1, len(db.GetList()))
+}
+
+func TestKeyIsTakenAgainOnRetryAndReplay(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	executor := &testFlakyNotify{failTimes: 2, err: errors.New("service unavailable")}
+	queue := testHookQueue(fake, executor, RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Minute})
+	queue.Start()
+	defer queue.Stop(context.Background())
+
+	tk, _ := queue.Push(time.Second, notify.HTTP, "first", WithDebounce("user-1"))
+	testAdvance(t, fake, 1, time.Second)
+	assert.Eventually(t, func() bool { return queue.GetTask(tk.Id) != nil }, 5*time.Second, time.Millisecond)
+
+	// the push during the backoff is applied to the task which is retried
+	again, err := queue.Push(time.Hour, notify.HTTP, "second", WithDebounce("user-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, tk.Id, again.Id)
+	assert.Equal(t, 1, len(queue.TaskQueryTable))
+
+	// the task fails again and is dead lettered, a replayed task takes its key again as well
+	testAdvance(t, fake, 1, time.Hour)
+	assert.Eventually(t, func() bool { return len(queue.ListDeadLetters()) == 1 }, 5*time.Second, time.Millisecond)
+	_, err = queue.ReplayDeadLetter(tk.Id)
+	assert.Nil(t, err)
+	again, _ = queue.Push(time.Hour, notify.HTTP, "third", WithThrottle("user-1"))
+	assert.Equal(t, tk.Id, again.Id)
+	assert.Equal(t, "second", again.TaskData)
+	assert.Equal(t, 1, len(queue.TaskQueryTable))
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"log"
+	"time"
+)
+
+// mark the task in flight before it is executed, so it is not lost if the process crashes during the execution
+func (dq *DelayQueue) acquireLease(task *Task) {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	task.State = TaskRunning
+	task.LeaseUntil = dq.clock.Now().Add(dq.leaseDuration)
+	if task.Schedule != nil && !task.Schedule.FixedDelay {
+		// the next occurrence is due regardless of how this one goes
+		dq.scheduleNext(task)
+	}
+	if err := dq.Persistence.SaveInFlight(task); err != nil {
+		log.Println(err)
+	}
+	// remove the task from the persistent object
+	dq.Persistence.Delete(task.Id)
+}
+
+// the execution is done, the task has succeeded, been added back to the time wheel or been dead lettered,
+// the caller must hold the lock, so the task is not executed again before its lease is released
+func (dq *DelayQueue) releaseLease(task *Task) {
+	if err := dq.Persistence.DeleteInFlight(task.Id); err != nil {
+		log.Println(err)
+	}
+	delete(dq.running, task.Id)
+}
+
+// put the tasks in flight whose lease has expired back to the time wheel,
+// they are the executions which were interrupted by a crash, returns the number of requeued tasks
+func (dq *DelayQueue) requeueExpiredLeases(now time.Time) int {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	requeued := 0
+	for _, task := range dq.Persistence.GetInFlight() {
+		if _, ok := dq.running[task.Id]; ok || task.LeaseUntil.After(now) {
+			continue
+		}
+		if _, ok := dq.TaskQueryTable[task.Id]; !ok {
+			log.Printf("lease of task %s expired at %v, requeue it\n", task.Id, task.LeaseUntil)
+			task.State = TaskPending
+			dq.requeue(task, now)
+			requeued++
+		}
+		if err := dq.Persistence.DeleteInFlight(task.Id); err != nil {
+			log.Println(err)
+		}
+	}
+	return requeued
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskInFlightDuringExecution(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testBlockingNotify{started: make(chan string, 1), release: make(chan struct{})}
+	queue := New(WithTaskExecutor(func(taskMode notify.NotifyMode) notify.Executor { return executor }), WithPersistence(db), WithTick(10*time.Millisecond), WithLeaseDuration(time.Hour))
+	queue.Start()
+	defer queue.Stop(context.Background())
+
+	tk, _ := queue.Push(30*time.Millisecond, notify.HTTP, "hello")
+	assert.Equal(t, "hello", <-executor.started)
+
+	// the task is moved from the task list to the tasks in flight before it is executed
+	inFlight := db.GetInFlight()
+	assert.Equal(t, 1, len(inFlight))
+	assert.Equal(t, tk.Id, inFlight[0].Id)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), inFlight[0].LeaseUntil, time.Second)
+	assert.Equal(t, 0, len(db.GetList()))
+
+	// a running execution is never requeued
+	assert.Equal(t, 0, queue.requeueExpiredLeases(time.Now().Add(2*time.Hour)))
+
+	close(executor.release)
+	assert.Eventually(t, func() bool { return len(db.GetInFlight()) == 0 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, len(db.GetList()))
+}
+
+func TestInterruptedExecutionIsNotLost(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	db := newTestMemoryDb()
+	executor := &testBlockingNotify{started: make(chan string, 1), release: make(chan struct{})}
+	queue := New(WithClock(fake), WithTaskExecutor(func(taskMode notify.NotifyMode) notify.Executor { return executor }), WithPersistence(db), WithLeaseDuration(time.Minute))
+	queue.Start()
+	queue.Push(time.Second, notify.HTTP, "hello")
+	testAdvance(t, fake, 1, time.Second)
+	assert.Equal(t, "hello", <-executor.started)
+
+	// the process goes down while the task is executed
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	queue.Stop(ctx)
+	assert.Equal(t, 1, len(db.GetInFlight()))
+	// the lease expires while the queue is down
+	fake.Advance(time.Minute)
+
+	executed := make(chan string, 1)
+	restarted := testFakeClockQueue(fake, db, executed)
+	defer restarted.Stop(context.Background())
+	testAdvance(t, fake, 1, time.Second)
+	testAssertExecuted(t, executed, "hello")
+	assert.Eventually(t, func() bool { return len(db.GetInFlight()) == 0 }, time.Second, 5*time.Millisecond)
+	close(executor.release)
+}
+
+func TestRequeueExpiredLeases(t *testing.T) {
+	db := newTestMemoryDb()
+	now := time.Now()
+	db.SaveInFlight(&Task{Id: "expired", TaskMode: notify.HTTP, TaskData: "hello", LeaseUntil: now.Add(-time.Second)})
+	db.SaveInFlight(&Task{Id: "leased", TaskMode: notify.HTTP, TaskData: "hello", LeaseUntil: now.Add(time.Minute)})
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+
+	assert.Equal(t, 1, queue.requeueExpiredLeases(now))
+	task := queue.GetTask("expired")
+	assert.NotNil(t, task)
+	assert.True(t, task.LeaseUntil.IsZero())
+	assert.Nil(t, queue.GetTask("leased"))
+	assert.Equal(t, 1, len(db.GetInFlight()))
+	assert.Equal(t, 1, len(db.GetList()))
+
+	assert.Equal(t, 1, queue.requeueExpiredLeases(now.Add(2*time.Minute)))
+	assert.NotNil(t, queue.GetTask("leased"))
+	assert.Equal(t, 0, len(db.GetInFlight()))
+	assert.Equal(t, 2, len(db.GetList()))
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+)
+
+const (
+	// the default number of tasks of a page
+	DEFAULT_LIST_LIMIT = 100
+	// the maximum number of tasks of a page
+	MAX_LIST_LIMIT = 1000
+)
+
+// TaskFilter selects the pending tasks, the zero value of a field matches every task
+type TaskFilter struct {
+	// the due time window, DueAfter is inclusive and DueBefore is exclusive
+	DueAfter  time.Time
+	DueBefore time.Time
+	TaskMode  notify.NotifyMode
+	// the http url or the queue name the task is sent to
+	Target string
+	// every tag must be attached to the task with the same value
+	Tags map[string]string
+	// the page of the tasks ordered by due time
+	Offset int
+	Limit  int
+}
+
+// TaskPage is a page of the tasks selected by a filter
+type TaskPage struct {
+	Tasks []*Task
+	// the number of tasks selected by the filter on all pages
+	Total int
+	// the offset of the next page, it is zero on the last page
+	NextOffset int
+}
+
+// the http url or the queue name the task is sent to, it is the part of the task data before the first |
+func (t *Task) Target() string {
+	if index := strings.Index(t.TaskData, "|"); index >= 0 {
+		return t.TaskData[:index]
+	}
+	return ""
+}
+
+// whether the task is selected by the filter, the page is not considered
+func (f *TaskFilter) Match(task *Task) bool {
+	if !f.DueAfter.IsZero() && task.DueAt.Before(f.DueAfter) {
+		return false
+	}
+	if !f.DueBefore.IsZero() && !task.DueAt.Before(f.DueBefore) {
+		return false
+	}
+	if f.TaskMode != 0 && task.TaskMode != f.TaskMode {
+		return false
+	}
+	if f.Target != "" && task.Target() != f.Target {
+		return false
+	}
+	for key, value := range f.Tags {
+		if tag, ok := task.Tags[key]; !ok || tag != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ListTasks returns a page of the pending tasks selected by the filter, ordered by due time,
+// the tasks which are being executed or have been executed are not listed.
+func (dq *DelayQueue) ListTasks(filter TaskFilter) (*TaskPage, error) {
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = DEFAULT_LIST_LIMIT
+	}
+	if filter.Limit > MAX_LIST_LIMIT {
+		filter.Limit = MAX_LIST_LIMIT
+	}
+	tasks, total, err := dq.Persistence.QueryTasks(filter)
+	if err != nil {
+		return nil, err
+	}
+	page := &TaskPage{Tasks: tasks, Total: total}
+	if next := filter.Offset + len(tasks); len(tasks) > 0 && next < total {
+		page.NextOffset = next
+	}
+	return page, nil
+}
+
+// QueryTasks selects a page of tasks by scanning them,
+// it is for the persistence layers which have no index of the tasks.
+func QueryTasks(tasks []*Task, filter TaskFilter) ([]*Task, int) {
+	selected := []*Task{}
+	for _, task := range tasks {
+		if filter.Match(task) {
+			selected = append(selected, task)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].DueAt.Equal(selected[j].DueAt) {
+			return selected[i].Id < selected[j].Id
+		}
+		return selected[i].DueAt.Before(selected[j].DueAt)
+	})
+	total := len(selected)
+	if filter.Offset >= total {
+		return []*Task{}, total
+	}
+	end := total
+	if filter.Limit > 0 && filter.Offset+filter.Limit < total {
+		end = filter.Offset + filter.Limit
+	}
+	return selected[filter.Offset:end], total
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskTarget(t *testing.T) {
+	assert.Equal(t, "http://www.google.com", (&Task{TaskData: "http://www.google.com|hello|world"}).Target())
+	assert.Equal(t, "", (&Task{TaskData: "hello"}).Target())
+}
+
+func TestListTasks(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	now := time.Now()
+	for i := 1; i <= 30; i++ {
+		tenant := "a"
+		if i%2 == 0 {
+			tenant = "b"
+		}
+		mode := notify.HTTP
+		target := "http://www.google.com"
+		if i%3 == 0 {
+			mode = notify.SubPub
+			target = "queue_name"
+		}
+		queue.PushAt(now.Add(time.Duration(i)*time.Minute), mode, target+"|hello", WithTag("tenant", tenant))
+	}
+
+	// the tasks of tenant a which are due in the next 10 minutes
+	page, err := queue.ListTasks(TaskFilter{DueBefore: now.Add(10*time.Minute + time.Second), Tags: map[string]string{"tenant": "a"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, page.Total)
+	assert.Equal(t, 5, len(page.Tasks))
+	assert.Equal(t, 0, page.NextOffset)
+	for i, task := range page.Tasks {
+		assert.Equal(t, "a", task.Tags["tenant"])
+		assert.WithinDuration(t, now.Add(time.Duration(2*i+1)*time.Minute), task.DueAt, time.Second)
+	}
+
+	page, _ = queue.ListTasks(TaskFilter{TaskMode: notify.SubPub})
+	assert.Equal(t, 10, page.Total)
+	page, _ = queue.ListTasks(TaskFilter{Target: "http://www.google.com", DueAfter: now.Add(20 * time.Minute)})
+	assert.Equal(t, 7, page.Total)
+
+	// read every page
+	seen := map[string]bool{}
+	filter := TaskFilter{Limit: 7}
+	for {
+		page, _ = queue.ListTasks(filter)
+		assert.Equal(t, 30, page.Total)
+		for _, task := range page.Tasks {
+			seen[task.Id] = true
+		}
+		if page.NextOffset == 0 {
+			break
+		}
+		filter.Offset = page.NextOffset
+	}
+	assert.Equal(t, 30, len(seen))
+
+	page, _ = queue.ListTasks(TaskFilter{Offset: 100})
+	assert.Equal(t, 0, len(page.Tasks))
+	assert.Equal(t, 0, page.NextOffset)
+}
@@ -0,0 +1,276 @@
+package core
+
+import (
+	"strings"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
+)
+
+const (
+	// the default duration of one tick of the time wheel
+	DEFAULT_TICK = time.Second
+	// the default lease of an execution, it is longer than the timeout of the http notify
+	DEFAULT_LEASE_DURATION = time.Minute
+)
+
+// LatePolicy decides what to do with tasks that became overdue while the delay queue was not running
+type LatePolicy uint
+
+const (
+	// execute the overdue tasks right away
+	LateRun LatePolicy = iota + 1
+	// drop the overdue tasks
+	LateSkip
+	// move the overdue tasks to the dead letters
+	LateDeadLetter
+)
+
+func (lp LatePolicy) String() string {
+	switch lp {
+	case LateRun:
+		return "run"
+	case LateSkip:
+		return "skip"
+	case LateDeadLetter:
+		return "dead-letter"
+	default:
+		return "unknown"
+	}
+}
+
+func StringToLatePolicy(policy string) LatePolicy {
+	switch strings.ToLower(policy) {
+	case "run":
+		return LateRun
+	case "skip":
+		return LateSkip
+	case "dead-letter":
+		return LateDeadLetter
+	default:
+		return LatePolicy(0)
+	}
+}
+
+// Option configures the delay queue when it is created
+type Option func(dq *DelayQueue)
+
+// TaskOption configures a task when it is pushed
+type TaskOption func(task *Task)
+
+// WithTick sets the duration of one tick of the time wheel, it is the resolution of the delay queue,
+// every delay is rounded to a whole number of ticks.
+func WithTick(tick time.Duration) Option {
+	return func(dq *DelayQueue) {
+		if tick > 0 {
+			dq.tick = tick
+		}
+	}
+}
+
+// WithWheelSizes sets the number of slots of each level of the time wheel, starting from the lowest level,
+// every slot of a level covers a full round of the level below it.
+func WithWheelSizes(sizes ...int) Option {
+	return func(dq *DelayQueue) {
+		if len(sizes) == 0 {
+			return
+		}
+		for _, size := range sizes {
+			if size <= 0 {
+				return
+			}
+		}
+		dq.wheelSizes = sizes
+	}
+}
+
+// WithLatePolicy sets the policy for tasks which became overdue while the delay queue was down,
+// the default policy is LateRun.
+func WithLatePolicy(policy LatePolicy) Option {
+	return func(dq *DelayQueue) {
+		if policy >= LateRun && policy <= LateDeadLetter {
+			dq.latePolicy = policy
+		}
+	}
+}
+
+// WithLateTolerance sets how long a task can be overdue and still be executed regardless of the late policy,
+// so a quick restart does not skip the tasks which were due while restarting.
+func WithLateTolerance(tolerance time.Duration) Option {
+	return func(dq *DelayQueue) {
+		if tolerance >= 0 {
+			dq.lateTolerance = tolerance
+		}
+	}
+}
+
+// WithPersistence sets the persistence layer of the delay queue
+func WithPersistence(persistence Persistence) Option {
+	return func(dq *DelayQueue) {
+		if persistence != nil {
+			dq.Persistence = persistence
+		}
+	}
+}
+
+// WithTaskExecutor sets the factory method which builds the executor of each notify mode
+func WithTaskExecutor(serviceBuilder BuildExecutor) Option {
+	return func(dq *DelayQueue) {
+		if serviceBuilder != nil {
+			dq.TaskExecutor = serviceBuilder
+		}
+	}
+}
+
+// WithDefaultRetryPolicy sets the retry policy of the tasks which are pushed without their own policy
+func WithDefaultRetryPolicy(policy RetryPolicy) Option {
+	return func(dq *DelayQueue) {
+		dq.retryPolicy = policy
+	}
+}
+
+// WithLeaseDuration sets how long an execution can take,
+// a task whose execution is not done by then is put back to the time wheel, such as after a crash.
+func WithLeaseDuration(lease time.Duration) Option {
+	return func(dq *DelayQueue) {
+		if lease > 0 {
+			dq.leaseDuration = lease
+		}
+	}
+}
+
+// WithWorkerPool sets the maximum number of executions which run at the same time,
+// and the number of due tasks of each notify mode which can wait for a worker.
+func WithWorkerPool(workers, buffer int) Option {
+	return func(dq *DelayQueue) {
+		if workers > 0 {
+			dq.poolWorkers = workers
+		}
+		if buffer >= 0 {
+			dq.poolBuffer = buffer
+		}
+	}
+}
+
+// WithModeConcurrency caps the executions of a notify mode which run at the same time,
+// the number of workers of the pool is the cap of the modes without their own.
+func WithModeConcurrency(mode notify.NotifyMode, limit int) Option {
+	return func(dq *DelayQueue) {
+		if limit > 0 {
+			dq.modeLimits[mode] = limit
+		}
+	}
+}
+
+// WithStatusRetention sets how long the final state of a task can be queried after it is executed,
+// cancelled or dead lettered, zero means the final states are not kept.
+func WithStatusRetention(retention time.Duration) Option {
+	return func(dq *DelayQueue) {
+		if retention >= 0 {
+			dq.statusRetention = retention
+		}
+	}
+}
+
+// WithIdempotencyRetention sets how long the idempotency key of a pushed task is kept,
+// a push with the same key within the retention returns the task instead of adding another one.
+// zero means the keys are not kept, only the pending and running tasks are deduplicated by their ids.
+func WithIdempotencyRetention(retention time.Duration) Option {
+	return func(dq *DelayQueue) {
+		if retention >= 0 {
+			dq.idempotencyRetention = retention
+		}
+	}
+}
+
+// WithClock sets the clock which drives the time wheel and stamps the tasks,
+// such as a fake clock which a test advances on demand.
+func WithClock(c clock.Clock) Option {
+	return func(dq *DelayQueue) {
+		if c != nil {
+			dq.clock = c
+		}
+	}
+}
+
+// WithHook registers a hook which is called on the events of the given type, as the On methods of the delay queue do.
+// The hooks are called one event after another on their own goroutine, at most the size set by WithHookQueueSize
+// events wait for them, DEFAULT_HOOK_QUEUE_SIZE by default. The events past it are dropped and logged,
+// DroppedEvents returns how many were dropped, so a hook should be quick or hand the events over.
+func WithHook(eventType EventType, hook ActionEvent) Option {
+	return func(dq *DelayQueue) {
+		dq.hooks.add(eventType, hook)
+	}
+}
+
+// WithHookQueueSize sets how many events can wait for the hooks, the events past it are dropped
+func WithHookQueueSize(size int) Option {
+	return func(dq *DelayQueue) {
+		if size > 0 {
+			dq.hooks.size = size
+		}
+	}
+}
+
+// WithTaskId sets the id of a task instead of a generated one,
+// it is an idempotency key too, pushing a task with the same id again returns the existing task.
+func WithTaskId(taskId string) TaskOption {
+	return func(task *Task) {
+		if taskId != "" {
+			task.Id = taskId
+		}
+	}
+}
+
+// WithIdempotencyKey sets the idempotency key of a task, such as the id of a request retried by the client,
+// pushing a task with the same key again returns the existing task.
+func WithIdempotencyKey(key string) TaskOption {
+	return func(task *Task) {
+		task.IdempotencyKey = key
+	}
+}
+
+// WithDebounce gives a task a logical key, pushing a task with the same key while it is pending
+// replaces its payload and resets its timer instead of adding another task.
+func WithDebounce(key string) TaskOption {
+	return func(task *Task) {
+		task.Key = key
+		task.KeyMode = KeyDebounce
+	}
+}
+
+// WithThrottle gives a task a logical key, pushing a task with the same key while it is pending
+// is ignored and the pending task is returned.
+func WithThrottle(key string) TaskOption {
+	return func(task *Task) {
+		task.Key = key
+		task.KeyMode = KeyThrottle
+	}
+}
+
+// WithTags attaches key/value pairs to a task, they are persisted and returned with the task
+func WithTags(tags map[string]string) TaskOption {
+	return func(task *Task) {
+		for key, value := range tags {
+			WithTag(key, value)(task)
+		}
+	}
+}
+
+// WithTag attaches a key/value pair to a task
+func WithTag(key, value string) TaskOption {
+	return func(task *Task) {
+		if task.Tags == nil {
+			task.Tags = map[string]string{}
+		}
+		task.Tags[key] = value
+	}
+}
+
+// WithRetryPolicy sets the retry policy of a task
+func WithRetryPolicy(policy RetryPolicy) TaskOption {
+	return func(task *Task) {
+		task.RetryPolicy = &policy
+	}
+}
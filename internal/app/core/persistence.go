@@ -1,10 +1,45 @@
 package core
 
+import "time"
+
 type Persistence interface {
 	Save(task *Task) error
 	GetList() []*Task
 	Delete(taskId string) error
+	// save or delete many tasks in one operation
+	SaveBatch(tasks []*Task) error
+	DeleteBatch(taskIds []string) error
 	RemoveAll() error
-	GetWheelTimePointer() int
-	SaveWheelTimePointer(index int) error
+	// a page of the tasks selected by the filter ordered by due time, and the number of all selected tasks
+	QueryTasks(filter TaskFilter) ([]*Task, int, error)
+	// the pointer of the time wheel and the time it was saved at
+	GetWheelTimePointer() (int, time.Time)
+	SaveWheelTimePointer(index int, savedAt time.Time) error
+	// the dead letters are the tasks which will not be executed any more
+	SaveDeadLetter(task *Task) error
+	GetDeadLetters() []*Task
+	DeleteDeadLetter(taskId string) error
+	RemoveAllDeadLetters() error
+	// the tasks in flight are being executed, they are kept until the execution succeeds
+	SaveInFlight(task *Task) error
+	GetInFlight() []*Task
+	DeleteInFlight(taskId string) error
+	// the tasks which reached a final state, they expire after the retention
+	SaveStatus(task *Task, retention time.Duration) error
+	GetStatus(taskId string) *Task
+	// the pending occurrences of the paused schedules, by the id of the schedule
+	SaveSchedule(task *Task) error
+	GetSchedule(scheduleId string) *Task
+	GetSchedules() []*Task
+	DeleteSchedule(scheduleId string) error
+	// the tasks of the chains which wait for their parent tasks to succeed
+	SaveWaiting(task *Task) error
+	GetWaiting(taskId string) *Task
+	GetWaitingList() []*Task
+	DeleteWaiting(taskId string) error
+	// claim an idempotency key for the task until the retention expires,
+	// returns the task which has claimed the key before, or nil if the key is claimed by the given task
+	ClaimIdempotencyKey(key string, task *Task, retention time.Duration) (*Task, error)
+	// release an idempotency key if it is still claimed by the task, such as when the task could not be persisted
+	ReleaseIdempotencyKey(key string, taskId string) error
 }
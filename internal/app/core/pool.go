@@ -0,0 +1,197 @@
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
+)
+
+const (
+	// the default number of executions which run at the same time
+	DEFAULT_POOL_WORKERS = 256
+	// the default number of due tasks of one notify mode which wait for a worker
+	DEFAULT_POOL_BUFFER = 10000
+)
+
+// PoolStats is a snapshot of the worker pool which executes the due tasks
+type PoolStats struct {
+	// the maximum number of executions which run at the same time
+	Workers int
+	// the number of tasks handed to the pool and the number of finished executions
+	Submitted uint64
+	Completed uint64
+	// the number of tasks waiting for a worker
+	Pending int
+	// the number of executions which are running
+	Running int
+	// how long the tasks waited for a worker on average and at most
+	AvgQueueDelay time.Duration
+	MaxQueueDelay time.Duration
+	// the stats of each notify mode
+	Modes map[notify.NotifyMode]ModeStats
+}
+
+// ModeStats is a snapshot of the executions of one notify mode
+type ModeStats struct {
+	// the maximum number of executions of the notify mode which run at the same time
+	Limit   int
+	Pending int
+	Running int
+}
+
+// a due task waiting for a worker
+type poolJob struct {
+	task       *Task
+	enqueuedAt time.Time
+}
+
+// every notify mode has its own lane, so a slow downstream of one mode does not hold up the others
+type poolLane struct {
+	limit   int
+	pending chan *poolJob
+	running int32
+}
+
+// executes the due tasks with a bounded number of goroutines
+type workerPool struct {
+	mutex   sync.Mutex
+	closed  bool
+	workers int
+	buffer  int
+	// the concurrency caps of the notify modes, the number of workers is the cap of the other modes
+	limits map[notify.NotifyMode]int
+	lanes  map[notify.NotifyMode]*poolLane
+	// a token is taken by every running execution
+	slots chan struct{}
+	run   func(task *Task)
+	// tells how long the tasks wait for a worker
+	clock clock.Clock
+
+	submitted       uint64
+	started         uint64
+	completed       uint64
+	totalQueueDelay int64
+	maxQueueDelay   int64
+}
+
+func newWorkerPool(workers, buffer int, limits map[notify.NotifyMode]int, c clock.Clock, run func(task *Task)) *workerPool {
+	return &workerPool{
+		workers: workers,
+		buffer:  buffer,
+		limits:  limits,
+		lanes:   map[notify.NotifyMode]*poolLane{},
+		slots:   make(chan struct{}, workers),
+		run:     run,
+		clock:   c,
+	}
+}
+
+// hand a due task to the pool, it blocks while the pending buffer of the notify mode is full,
+// returns false if the task is not accepted because the pool or the delay queue is stopped
+func (wp *workerPool) submit(task *Task, stopped <-chan struct{}) bool {
+	wp.mutex.Lock()
+	if wp.closed {
+		wp.mutex.Unlock()
+		return false
+	}
+	lane := wp.laneOf(task.TaskMode)
+	wp.mutex.Unlock()
+
+	select {
+	case lane.pending <- &poolJob{task: task, enqueuedAt: wp.clock.Now()}:
+		atomic.AddUint64(&wp.submitted, 1)
+		return true
+	case <-stopped:
+		return false
+	}
+}
+
+// the lane of a notify mode, it is created with its workers on first use,
+// the caller must hold the lock
+func (wp *workerPool) laneOf(mode notify.NotifyMode) *poolLane {
+	if lane, ok := wp.lanes[mode]; ok {
+		return lane
+	}
+	limit, ok := wp.limits[mode]
+	if !ok || limit > wp.workers {
+		limit = wp.workers
+	}
+	lane := &poolLane{limit: limit, pending: make(chan *poolJob, wp.buffer)}
+	for i := 0; i < limit; i++ {
+		go wp.work(lane)
+	}
+	wp.lanes[mode] = lane
+	return lane
+}
+
+func (wp *workerPool) work(lane *poolLane) {
+	for job := range lane.pending {
+		wp.slots <- struct{}{}
+		wp.recordQueueDelay(wp.clock.Now().Sub(job.enqueuedAt))
+		atomic.AddInt32(&lane.running, 1)
+		wp.run(job.task)
+		atomic.AddInt32(&lane.running, -1)
+		<-wp.slots
+		atomic.AddUint64(&wp.completed, 1)
+	}
+}
+
+func (wp *workerPool) recordQueueDelay(delay time.Duration) {
+	atomic.AddUint64(&wp.started, 1)
+	atomic.AddInt64(&wp.totalQueueDelay, int64(delay))
+	for {
+		max := atomic.LoadInt64(&wp.maxQueueDelay)
+		if int64(delay) <= max || atomic.CompareAndSwapInt64(&wp.maxQueueDelay, max, int64(delay)) {
+			return
+		}
+	}
+}
+
+// no task is accepted any more, the workers exit after the pending tasks are executed,
+// the caller makes sure no submit is in progress
+func (wp *workerPool) close() {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+	if wp.closed {
+		return
+	}
+	wp.closed = true
+	for _, lane := range wp.lanes {
+		close(lane.pending)
+	}
+}
+
+func (wp *workerPool) stats() PoolStats {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+	stats := PoolStats{
+		Workers:       wp.workers,
+		Submitted:     atomic.LoadUint64(&wp.submitted),
+		Completed:     atomic.LoadUint64(&wp.completed),
+		MaxQueueDelay: time.Duration(atomic.LoadInt64(&wp.maxQueueDelay)),
+		Modes:         map[notify.NotifyMode]ModeStats{},
+	}
+	if started := atomic.LoadUint64(&wp.started); started > 0 {
+		stats.AvgQueueDelay = time.Duration(atomic.LoadInt64(&wp.totalQueueDelay) / int64(started))
+	}
+	for mode, lane := range wp.lanes {
+		modeStats := ModeStats{
+			Limit:   lane.limit,
+			Pending: len(lane.pending),
+			Running: int(atomic.LoadInt32(&lane.running)),
+		}
+		stats.Pending += modeStats.Pending
+		stats.Running += modeStats.Running
+		stats.Modes[mode] = modeStats
+	}
+	return stats
+}
+
+// PoolStats returns the stats of the worker pool which executes the due tasks,
+// a growing queueing delay means the workers can not keep up with the due tasks.
+func (dq *DelayQueue) PoolStats() PoolStats {
+	return dq.pool.stats()
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// records the highest number of executions which run at the same time
+type testConcurrencyNotify struct {
+	running  int64
+	peak     int64
+	executed int64
+	duration time.Duration
+}
+
+func (tn *testConcurrencyNotify) DoDelayTask(contents string) error {
+	running := atomic.AddInt64(&tn.running, 1)
+	for {
+		peak := atomic.LoadInt64(&tn.peak)
+		if running <= peak || atomic.CompareAndSwapInt64(&tn.peak, peak, running) {
+			break
+		}
+	}
+	time.Sleep(tn.duration)
+	atomic.AddInt64(&tn.running, -1)
+	atomic.AddInt64(&tn.executed, 1)
+	return nil
+}
+
+func TestWorkerPoolLimitsConcurrency(t *testing.T) {
+	httpExecutor := &testConcurrencyNotify{duration: 20 * time.Millisecond}
+	pubExecutor := &testConcurrencyNotify{duration: 20 * time.Millisecond}
+	queue := New(
+		WithTaskExecutor(func(taskMode notify.NotifyMode) notify.Executor {
+			if taskMode == notify.HTTP {
+				return httpExecutor
+			}
+			return pubExecutor
+		}),
+		WithPersistence(newTestMemoryDb()),
+		WithTick(10*time.Millisecond),
+		WithWorkerPool(4, 100),
+		WithModeConcurrency(notify.HTTP, 1),
+	)
+	queue.Start()
+	defer queue.Stop(context.Background())
+
+	for i := 0; i < 10; i++ {
+		queue.Push(30*time.Millisecond, notify.HTTP, "hello")
+		queue.Push(30*time.Millisecond, notify.SubPub, "hello")
+	}
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&httpExecutor.executed) == 10 && atomic.LoadInt64(&pubExecutor.executed) == 10
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&httpExecutor.peak))
+	assert.True(t, atomic.LoadInt64(&pubExecutor.peak) <= 4)
+
+	stats := queue.PoolStats()
+	assert.Equal(t, 4, stats.Workers)
+	assert.Equal(t, uint64(20), stats.Submitted)
+	assert.Eventually(t, func() bool { return queue.PoolStats().Completed == 20 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, stats.Modes[notify.HTTP].Limit)
+	assert.Equal(t, 4, stats.Modes[notify.SubPub].Limit)
+	// the http tasks waited for each other
+	assert.True(t, stats.MaxQueueDelay >= 100*time.Millisecond, "max queue delay %v", stats.MaxQueueDelay)
+	assert.True(t, stats.AvgQueueDelay > 0)
+}
+
+func TestWorkerPoolBuffer(t *testing.T) {
+	executor := &testBlockingNotify{started: make(chan string, 10), release: make(chan struct{})}
+	queue := New(
+		WithTaskExecutor(func(taskMode notify.NotifyMode) notify.Executor { return executor }),
+		WithPersistence(newTestMemoryDb()),
+		WithWorkerPool(1, 1),
+	)
+	for i := 0; i < 3; i++ {
+		queue.Push(time.Second, notify.HTTP, "hello")
+	}
+
+	// one task is running and one is pending, the time wheel waits for the buffer
+	processed := make(chan int)
+	go func() { processed <- queue.catchUp(queue.refTime.Add(time.Second)) }()
+	assert.Equal(t, "hello", <-executor.started)
+	assert.Eventually(t, func() bool { return queue.PoolStats().Pending == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 1, queue.PoolStats().Running)
+	select {
+	case <-processed:
+		assert.Fail(t, "the time wheel does not wait for the pending buffer")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(executor.release)
+	assert.Equal(t, 1, <-processed)
+	assert.Nil(t, queue.Stop(context.Background()))
+	assert.Equal(t, uint64(3), queue.PoolStats().Completed)
+}
+
+func TestWorkerPoolQueueDelayOnTheClockOfTheQueue(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	executor := &testBlockingNotify{started: make(chan string, 10), release: make(chan struct{})}
+	queue := New(
+		WithClock(fake),
+		WithTaskExecutor(func(taskMode notify.NotifyMode) notify.Executor { return executor }),
+		WithPersistence(newTestMemoryDb()),
+		WithWorkerPool(1, 1),
+	)
+	queue.Push(time.Second, notify.HTTP, "first")
+	queue.Push(time.Second, notify.HTTP, "second")
+	assert.Equal(t, 1, queue.catchUp(queue.refTime.Add(time.Second)))
+	<-executor.started
+	assert.Equal(t, 1, queue.PoolStats().Pending)
+
+	// the second task waits for the worker while the clock moves on
+	fake.Advance(5 * time.Second)
+	close(executor.release)
+	assert.Nil(t, queue.Stop(context.Background()))
+	stats := queue.PoolStats()
+	assert.Equal(t, 5*time.Second, stats.MaxQueueDelay)
+	assert.Equal(t, 2500*time.Millisecond, stats.AvgQueueDelay)
+}
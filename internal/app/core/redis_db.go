@@ -8,8 +8,11 @@ import (
 	"log"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
 	"github.com/raymondmars/go-delayqueue/internal/pkg/common"
 )
 
@@ -19,36 +22,131 @@ const (
 	// task key prefix
 	TASK_KEY_PREFIX        = "delaytk_"
 	TIME_POINTER_CACHE_KEY = "delay_timewheel_index"
+	// dead letter key prefix
+	DEAD_LETTER_KEY_PREFIX = "delaydl_"
+	// in flight key prefix
+	IN_FLIGHT_KEY_PREFIX = "delayif_"
+	// task status key prefix
+	STATUS_KEY_PREFIX = "delayst_"
+	// task index key prefix
+	INDEX_KEY_PREFIX = "delayix_"
+	// paused schedule key prefix
+	SCHEDULE_KEY_PREFIX = "delaysc_"
+	// idempotency key prefix
+	IDEMPOTENCY_KEY_PREFIX = "delayik_"
+	// waiting task key prefix
+	WAITING_KEY_PREFIX = "delaywt_"
 )
 
 var redisInstance *redisDb
 
 type redisDb struct {
 	Client *redis.Client
+	// prefixed to every key
+	Namespace string
 	// task list store task id
 	TaskListKey string
-	Context     context.Context
+	// dead letter list store task id
+	DeadLetterListKey string
+	// in flight list store task id
+	InFlightListKey string
+	Context         context.Context
+}
+
+// the time wheel pointer saved with the time it was saved at
+type wheelPointer struct {
+	Index   int
+	SavedAt time.Time
 }
 
 // singleton method
 func getRedisDb() *redisDb {
 
 	lock.Do(func() {
-		dbNumber, _ := strconv.Atoi(common.GetEvnWithDefaultVal("REDIS_DB", "0"))
-		redisInstance = &redisDb{
-			Client: redis.NewClient(&redis.Options{
-				Addr:     common.GetEvnWithDefaultVal("REDIS_ADDR", "localhost:6379"),
-				Password: common.GetEvnWithDefaultVal("REDIS_PWD", ""),
-				DB:       dbNumber,
-			}),
-			TaskListKey: common.GetEvnWithDefaultVal("DELAY_QUEUE_LIST_KEY", "__delay_queue_list__"),
-			Context:     context.Background(),
-		}
+		redisInstance = newRedisDb(newRedisClient(), "")
 	})
 
 	return redisInstance
 }
 
+// NewRedisPersistence creates a persistence layer on redis,
+// the namespace is prefixed to every key, so several delay queues can share one redis database.
+func NewRedisPersistence(client *redis.Client, namespace string) Persistence {
+	return newRedisDb(client, namespace)
+}
+
+func newRedisDb(client *redis.Client, namespace string) *redisDb {
+	return &redisDb{
+		Client:            client,
+		Namespace:         namespace,
+		TaskListKey:       namespace + common.GetEvnWithDefaultVal("DELAY_QUEUE_LIST_KEY", "__delay_queue_list__"),
+		DeadLetterListKey: namespace + common.GetEvnWithDefaultVal("DELAY_QUEUE_DEAD_LETTER_LIST_KEY", "__delay_queue_dead_letters__"),
+		InFlightListKey:   namespace + common.GetEvnWithDefaultVal("DELAY_QUEUE_IN_FLIGHT_LIST_KEY", "__delay_queue_in_flight__"),
+		Context:           context.Background(),
+	}
+}
+
+// create a redis client from the environment variables
+func newRedisClient() *redis.Client {
+	dbNumber, _ := strconv.Atoi(common.GetEvnWithDefaultVal("REDIS_DB", "0"))
+	return redis.NewClient(&redis.Options{
+		Addr:     common.GetEvnWithDefaultVal("REDIS_ADDR", "localhost:6379"),
+		Password: common.GetEvnWithDefaultVal("REDIS_PWD", ""),
+		DB:       dbNumber,
+	})
+}
+
+func (rd *redisDb) taskKey(taskId string) string {
+	return fmt.Sprintf("%s%s%s", rd.Namespace, TASK_KEY_PREFIX, taskId)
+}
+
+func (rd *redisDb) deadLetterKey(taskId string) string {
+	return fmt.Sprintf("%s%s%s", rd.Namespace, DEAD_LETTER_KEY_PREFIX, taskId)
+}
+
+func (rd *redisDb) inFlightKey(taskId string) string {
+	return fmt.Sprintf("%s%s%s", rd.Namespace, IN_FLIGHT_KEY_PREFIX, taskId)
+}
+
+func (rd *redisDb) statusKey(taskId string) string {
+	return fmt.Sprintf("%s%s%s", rd.Namespace, STATUS_KEY_PREFIX, taskId)
+}
+
+func (rd *redisDb) scheduleKey(scheduleId string) string {
+	return fmt.Sprintf("%s%s%s", rd.Namespace, SCHEDULE_KEY_PREFIX, scheduleId)
+}
+
+func (rd *redisDb) waitingKey(taskId string) string {
+	return fmt.Sprintf("%s%s%s", rd.Namespace, WAITING_KEY_PREFIX, taskId)
+}
+
+func (rd *redisDb) idempotencyKey(key string) string {
+	return fmt.Sprintf("%s%s%s", rd.Namespace, IDEMPOTENCY_KEY_PREFIX, key)
+}
+
+// the key of an index, such as the due time of the tasks, or the tasks of a notify mode
+func (rd *redisDb) indexKey(name string) string {
+	return rd.Namespace + INDEX_KEY_PREFIX + name
+}
+
+func (rd *redisDb) modeIndexKey(mode notify.NotifyMode) string {
+	return rd.indexKey(fmt.Sprintf("mode_%d", mode))
+}
+
+func (rd *redisDb) targetIndexKey(target string) string {
+	return rd.indexKey("target_" + target)
+}
+
+// the key is prefixed by its length, so a tag whose key or value has a = has its own index,
+// such as a=b/c and a/b=c
+func (rd *redisDb) tagIndexKey(key, value string) string {
+	return rd.indexKey(fmt.Sprintf("tag_%d_%s=%s", len(key), key, value))
+}
+
+func (rd *redisDb) pointerKey() string {
+	return rd.Namespace + TIME_POINTER_CACHE_KEY
+}
+
 // save task to redis
 func (rd *redisDb) Save(task *Task) error {
 	tk, err := json.Marshal(task)
@@ -58,11 +156,15 @@ func (rd *redisDb) Save(task *Task) error {
 	}
 
 	if string(tk) != "" {
-		key := fmt.Sprintf("%s%s", TASK_KEY_PREFIX, task.Id)
+		key := rd.taskKey(task.Id)
 		if val, _ := rd.Client.Get(rd.Context, key).Result(); val == "" {
 			rd.Client.LPush(rd.Context, rd.TaskListKey, task.Id)
+		} else {
+			// the mode, target or tags may have been changed
+			rd.unindex(rd.Client, val)
 		}
 		result := rd.Client.Set(rd.Context, key, string(tk), 0)
+		rd.index(rd.Client, task)
 		return result.Err()
 
 	} else {
@@ -77,7 +179,7 @@ func (rd *redisDb) GetList() []*Task {
 	tasks := []*Task{}
 	if listArray != nil && len(listArray) > 0 {
 		for _, item := range listArray {
-			key := fmt.Sprintf("%s%s", TASK_KEY_PREFIX, item)
+			key := rd.taskKey(item)
 			taskCmd := rd.Client.Get(rd.Context, key)
 			if val, err := taskCmd.Result(); err == nil {
 				entity := Task{}
@@ -93,35 +195,474 @@ func (rd *redisDb) GetList() []*Task {
 
 // remove task from redis
 func (rd *redisDb) Delete(taskId string) error {
+	if val, _ := rd.Client.Get(rd.Context, rd.taskKey(taskId)).Result(); val != "" {
+		rd.unindex(rd.Client, val)
+	}
 	rd.Client.LRem(rd.Context, rd.TaskListKey, 0, taskId)
-	rd.Client.Del(rd.Context, fmt.Sprintf("%s%s", TASK_KEY_PREFIX, taskId))
+	rd.Client.Del(rd.Context, rd.taskKey(taskId))
 
 	return nil
 }
 
+// the saved values of the tasks, read in one round trip, an empty value means the task is not saved
+func (rd *redisDb) getValues(taskIds []string) ([]string, error) {
+	cmds := make([]*redis.StringCmd, len(taskIds))
+	_, err := rd.Client.Pipelined(rd.Context, func(pipe redis.Pipeliner) error {
+		for i, taskId := range taskIds {
+			cmds[i] = pipe.Get(rd.Context, rd.taskKey(taskId))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	values := make([]string, len(taskIds))
+	for i, cmd := range cmds {
+		values[i] = cmd.Val()
+	}
+	return values, nil
+}
+
+// save many tasks to redis in one transaction
+func (rd *redisDb) SaveBatch(tasks []*Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	values := make([]string, len(tasks))
+	taskIds := make([]string, len(tasks))
+	for i, task := range tasks {
+		tk, err := json.Marshal(task)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		values[i] = string(tk)
+		taskIds[i] = task.Id
+	}
+	saved, err := rd.getValues(taskIds)
+	if err != nil {
+		return err
+	}
+	_, err = rd.Client.TxPipelined(rd.Context, func(pipe redis.Pipeliner) error {
+		for i, task := range tasks {
+			if saved[i] == "" {
+				pipe.LPush(rd.Context, rd.TaskListKey, task.Id)
+			} else {
+				rd.unindex(pipe, saved[i])
+			}
+			pipe.Set(rd.Context, rd.taskKey(task.Id), values[i], 0)
+			rd.index(pipe, task)
+		}
+		return nil
+	})
+	return err
+}
+
+// remove many tasks from redis in one transaction
+func (rd *redisDb) DeleteBatch(taskIds []string) error {
+	if len(taskIds) == 0 {
+		return nil
+	}
+	saved, err := rd.getValues(taskIds)
+	if err != nil {
+		return err
+	}
+	_, err = rd.Client.TxPipelined(rd.Context, func(pipe redis.Pipeliner) error {
+		for i, taskId := range taskIds {
+			if saved[i] != "" {
+				rd.unindex(pipe, saved[i])
+			}
+			pipe.LRem(rd.Context, rd.TaskListKey, 0, taskId)
+			pipe.Del(rd.Context, rd.taskKey(taskId))
+		}
+		return nil
+	})
+	return err
+}
+
 // remove all tasks from redis
 func (rd *redisDb) RemoveAll() error {
 	listResult := rd.Client.LRange(rd.Context, rd.TaskListKey, 0, -1)
 	listArray, _ := listResult.Result()
 	if listArray != nil && len(listArray) > 0 {
 		for _, tkId := range listArray {
-			rd.Client.Del(rd.Context, fmt.Sprintf("%s%s", TASK_KEY_PREFIX, tkId))
+			rd.Client.Del(rd.Context, rd.taskKey(tkId))
 		}
 	}
 	rd.Client.Del(rd.Context, rd.TaskListKey)
+	// remove the indexes
+	indexKeys, _ := rd.Client.SMembers(rd.Context, rd.indexKey("keys")).Result()
+	for _, key := range indexKeys {
+		rd.Client.Del(rd.Context, key)
+	}
+	rd.Client.Del(rd.Context, rd.indexKey("due"), rd.indexKey("keys"))
 	return nil
 }
 
-func (rd *redisDb) SaveWheelTimePointer(index int) error {
-	cmd := rd.Client.Set(rd.Context, TIME_POINTER_CACHE_KEY, index, 0)
+func (rd *redisDb) SaveWheelTimePointer(index int, savedAt time.Time) error {
+	pointer, err := json.Marshal(&wheelPointer{Index: index, SavedAt: savedAt})
+	if err != nil {
+		return err
+	}
+	cmd := rd.Client.Set(rd.Context, rd.pointerKey(), string(pointer), 0)
 	return cmd.Err()
 }
 
-func (rd *redisDb) GetWheelTimePointer() int {
-	if result := rd.Client.Get(rd.Context, TIME_POINTER_CACHE_KEY); result.Err() == nil {
+func (rd *redisDb) GetWheelTimePointer() (int, time.Time) {
+	result := rd.Client.Get(rd.Context, rd.pointerKey())
+	if result.Err() != nil {
+		return 0, time.Time{}
+	}
+	pointer := wheelPointer{}
+	if err := json.Unmarshal([]byte(result.Val()), &pointer); err != nil {
+		// the pointer saved by the old version is a plain index
 		index, _ := strconv.Atoi(result.Val())
-		return index
-	} else {
-		return 0
+		return index, time.Time{}
+	}
+	return pointer.Index, pointer.SavedAt
+}
+
+// save a task to the dead letters
+func (rd *redisDb) SaveDeadLetter(task *Task) error {
+	tk, err := json.Marshal(task)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	key := rd.deadLetterKey(task.Id)
+	if val, _ := rd.Client.Get(rd.Context, key).Result(); val == "" {
+		rd.Client.LPush(rd.Context, rd.DeadLetterListKey, task.Id)
+	}
+	return rd.Client.Set(rd.Context, key, string(tk), 0).Err()
+}
+
+// get the dead letters from redis
+func (rd *redisDb) GetDeadLetters() []*Task {
+	listArray, _ := rd.Client.LRange(rd.Context, rd.DeadLetterListKey, 0, -1).Result()
+	tasks := []*Task{}
+	for _, item := range listArray {
+		if val, err := rd.Client.Get(rd.Context, rd.deadLetterKey(item)).Result(); err == nil {
+			entity := Task{}
+			if err := json.Unmarshal([]byte(val), &entity); err == nil {
+				tasks = append(tasks, &entity)
+			}
+		}
+	}
+	return tasks
+}
+
+// remove a dead letter from redis
+func (rd *redisDb) DeleteDeadLetter(taskId string) error {
+	rd.Client.LRem(rd.Context, rd.DeadLetterListKey, 0, taskId)
+	return rd.Client.Del(rd.Context, rd.deadLetterKey(taskId)).Err()
+}
+
+// remove all dead letters from redis
+func (rd *redisDb) RemoveAllDeadLetters() error {
+	listArray, _ := rd.Client.LRange(rd.Context, rd.DeadLetterListKey, 0, -1).Result()
+	for _, tkId := range listArray {
+		rd.Client.Del(rd.Context, rd.deadLetterKey(tkId))
+	}
+	return rd.Client.Del(rd.Context, rd.DeadLetterListKey).Err()
+}
+
+// save a task in flight to redis
+func (rd *redisDb) SaveInFlight(task *Task) error {
+	tk, err := json.Marshal(task)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	key := rd.inFlightKey(task.Id)
+	if val, _ := rd.Client.Get(rd.Context, key).Result(); val == "" {
+		rd.Client.LPush(rd.Context, rd.InFlightListKey, task.Id)
+	}
+	return rd.Client.Set(rd.Context, key, string(tk), 0).Err()
+}
+
+// get the tasks in flight from redis
+func (rd *redisDb) GetInFlight() []*Task {
+	listArray, _ := rd.Client.LRange(rd.Context, rd.InFlightListKey, 0, -1).Result()
+	tasks := []*Task{}
+	for _, item := range listArray {
+		if val, err := rd.Client.Get(rd.Context, rd.inFlightKey(item)).Result(); err == nil {
+			entity := Task{}
+			if err := json.Unmarshal([]byte(val), &entity); err == nil {
+				tasks = append(tasks, &entity)
+			}
+		}
+	}
+	return tasks
+}
+
+// remove a task in flight from redis
+func (rd *redisDb) DeleteInFlight(taskId string) error {
+	rd.Client.LRem(rd.Context, rd.InFlightListKey, 0, taskId)
+	return rd.Client.Del(rd.Context, rd.inFlightKey(taskId)).Err()
+}
+
+// save the final state of a task to redis, it expires after the retention
+func (rd *redisDb) SaveStatus(task *Task, retention time.Duration) error {
+	tk, err := json.Marshal(task)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return rd.Client.Set(rd.Context, rd.statusKey(task.Id), string(tk), retention).Err()
+}
+
+// get the final state of a task from redis
+func (rd *redisDb) GetStatus(taskId string) *Task {
+	val, err := rd.Client.Get(rd.Context, rd.statusKey(taskId)).Result()
+	if err != nil {
+		return nil
+	}
+	entity := Task{}
+	if err := json.Unmarshal([]byte(val), &entity); err != nil {
+		log.Println(err)
+		return nil
+	}
+	return &entity
+}
+
+// save the pending occurrence of a paused schedule into redis
+func (rd *redisDb) SaveSchedule(task *Task) error {
+	if task.Schedule == nil {
+		return errors.New("the task has no schedule")
+	}
+	tk, err := json.Marshal(task)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return rd.Client.Set(rd.Context, rd.scheduleKey(task.Schedule.Id), string(tk), 0).Err()
+}
+
+// get the pending occurrence of a paused schedule from redis
+func (rd *redisDb) GetSchedule(scheduleId string) *Task {
+	val, err := rd.Client.Get(rd.Context, rd.scheduleKey(scheduleId)).Result()
+	if err != nil {
+		return nil
+	}
+	entity := Task{}
+	if err := json.Unmarshal([]byte(val), &entity); err != nil {
+		log.Println(err)
+		return nil
+	}
+	return &entity
+}
+
+// get the pending occurrences of all the paused schedules from redis
+func (rd *redisDb) GetSchedules() []*Task {
+	return rd.scanTasks(SCHEDULE_KEY_PREFIX)
+}
+
+// remove the pending occurrence of a paused schedule from redis
+func (rd *redisDb) DeleteSchedule(scheduleId string) error {
+	return rd.Client.Del(rd.Context, rd.scheduleKey(scheduleId)).Err()
+}
+
+// save a task of a chain which waits for its parent tasks into redis
+func (rd *redisDb) SaveWaiting(task *Task) error {
+	tk, err := json.Marshal(task)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return rd.Client.Set(rd.Context, rd.waitingKey(task.Id), string(tk), 0).Err()
+}
+
+// get a task of a chain which waits for its parent tasks from redis
+func (rd *redisDb) GetWaiting(taskId string) *Task {
+	val, err := rd.Client.Get(rd.Context, rd.waitingKey(taskId)).Result()
+	if err != nil {
+		return nil
+	}
+	entity := Task{}
+	if err := json.Unmarshal([]byte(val), &entity); err != nil {
+		log.Println(err)
+		return nil
+	}
+	return &entity
+}
+
+// get all the tasks of the chains which wait for their parent tasks from redis
+func (rd *redisDb) GetWaitingList() []*Task {
+	return rd.scanTasks(WAITING_KEY_PREFIX)
+}
+
+// the tasks saved under the keys with the prefix, they are not kept in a list so the keys are scanned
+func (rd *redisDb) scanTasks(prefix string) []*Task {
+	tasks := []*Task{}
+	iter := rd.Client.Scan(rd.Context, 0, rd.Namespace+prefix+"*", 100).Iterator()
+	for iter.Next(rd.Context) {
+		if val, err := rd.Client.Get(rd.Context, iter.Val()).Result(); err == nil {
+			entity := Task{}
+			if err := json.Unmarshal([]byte(val), &entity); err == nil {
+				tasks = append(tasks, &entity)
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Println(err)
+	}
+	return tasks
+}
+
+// remove a task of a chain which waits for its parent tasks from redis
+func (rd *redisDb) DeleteWaiting(taskId string) error {
+	return rd.Client.Del(rd.Context, rd.waitingKey(taskId)).Err()
+}
+
+// claim an idempotency key in redis, the task is saved with the key so it can be returned to the later pushes
+func (rd *redisDb) ClaimIdempotencyKey(key string, task *Task, retention time.Duration) (*Task, error) {
+	tk, err := json.Marshal(task)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	for {
+		claimed, err := rd.Client.SetNX(rd.Context, rd.idempotencyKey(key), string(tk), retention).Result()
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			return nil, nil
+		}
+		val, err := rd.Client.Get(rd.Context, rd.idempotencyKey(key)).Result()
+		if err == redis.Nil {
+			// the key expired in between, claim it again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entity := Task{}
+		if err := json.Unmarshal([]byte(val), &entity); err != nil {
+			return nil, err
+		}
+		return &entity, nil
+	}
+}
+
+func (rd *redisDb) ReleaseIdempotencyKey(key string, taskId string) error {
+	redisKey := rd.idempotencyKey(key)
+	// the key is only deleted if it is not claimed again in between
+	return rd.Client.Watch(rd.Context, func(tx *redis.Tx) error {
+		val, err := tx.Get(rd.Context, redisKey).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entity := Task{}
+		if err := json.Unmarshal([]byte(val), &entity); err != nil {
+			return err
+		}
+		if entity.Id != taskId {
+			return nil
+		}
+		_, err = tx.TxPipelined(rd.Context, func(pipe redis.Pipeliner) error {
+			pipe.Del(rd.Context, redisKey)
+			return nil
+		})
+		return err
+	}, redisKey)
+}
+
+// the milliseconds since the unix epoch, the score of the due time index
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// the set indexes of a task, the due time is indexed by a sorted set
+func (rd *redisDb) setIndexKeys(task *Task) []string {
+	keys := []string{rd.modeIndexKey(task.TaskMode)}
+	if target := task.Target(); target != "" {
+		keys = append(keys, rd.targetIndexKey(target))
+	}
+	for key, value := range task.Tags {
+		keys = append(keys, rd.tagIndexKey(key, value))
+	}
+	return keys
+}
+
+// add a task to the indexes, the commands are sent by the client or queued on a pipeline
+func (rd *redisDb) index(c redis.Cmdable, task *Task) {
+	c.ZAdd(rd.Context, rd.indexKey("due"), &redis.Z{Score: float64(unixMilli(task.DueAt)), Member: task.Id})
+	for _, key := range rd.setIndexKeys(task) {
+		c.SAdd(rd.Context, key, task.Id)
+		// remember the index, so it is removed with all tasks
+		c.SAdd(rd.Context, rd.indexKey("keys"), key)
+	}
+}
+
+// remove a saved task from the indexes
+func (rd *redisDb) unindex(c redis.Cmdable, val string) {
+	task := Task{}
+	if err := json.Unmarshal([]byte(val), &task); err != nil {
+		return
+	}
+	c.ZRem(rd.Context, rd.indexKey("due"), task.Id)
+	for _, key := range rd.setIndexKeys(&task) {
+		c.SRem(rd.Context, key, task.Id)
+	}
+}
+
+// query a page of tasks by the indexes,
+// the due time index is intersected with the indexes of the mode, target and tags of the filter
+func (rd *redisDb) QueryTasks(filter TaskFilter) ([]*Task, int, error) {
+	source := rd.indexKey("due")
+	keys := []string{source}
+	if filter.TaskMode != 0 {
+		keys = append(keys, rd.modeIndexKey(filter.TaskMode))
+	}
+	if filter.Target != "" {
+		keys = append(keys, rd.targetIndexKey(filter.Target))
+	}
+	for key, value := range filter.Tags {
+		keys = append(keys, rd.tagIndexKey(key, value))
+	}
+	if len(keys) > 1 {
+		// keep the due time as the score of the intersection
+		weights := make([]float64, len(keys))
+		weights[0] = 1
+		source = rd.indexKey("query_" + uuid.New().String())
+		defer rd.Client.Del(rd.Context, source)
+		if err := rd.Client.ZInterStore(rd.Context, source, &redis.ZStore{Keys: keys, Weights: weights}).Err(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	min, max := "-inf", "+inf"
+	if !filter.DueAfter.IsZero() {
+		min = strconv.FormatInt(unixMilli(filter.DueAfter), 10)
+	}
+	if !filter.DueBefore.IsZero() {
+		max = "(" + strconv.FormatInt(unixMilli(filter.DueBefore), 10)
+	}
+	total, err := rd.Client.ZCount(rd.Context, source, min, max).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	ids, err := rd.Client.ZRangeByScore(rd.Context, source, &redis.ZRangeBy{
+		Min:    min,
+		Max:    max,
+		Offset: int64(filter.Offset),
+		Count:  int64(filter.Limit),
+	}).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	tasks := []*Task{}
+	for _, id := range ids {
+		if val, err := rd.Client.Get(rd.Context, rd.taskKey(id)).Result(); err == nil {
+			entity := Task{}
+			if err := json.Unmarshal([]byte(val), &entity); err == nil {
+				tasks = append(tasks, &entity)
+			}
+		}
 	}
+	return tasks, int(total), nil
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/raymondmars/go-delayqueue/internal/app/notify"
@@ -17,27 +18,37 @@ func testBeforeClearDb() {
 }
 func TestSaveTaskIntoDb(t *testing.T) {
 	testBeforeClearDb()
+	dueAt := time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC)
+	createdAt := dueAt.Add(-time.Hour)
 	task := &Task{
-		Id:            "123",
-		CycleCount:    5,
-		WheelPosition: 10,
-		TaskMode:      notify.HTTP,
-		TaskData:      "hello,world",
+		Id:        "123",
+		CreatedAt: createdAt,
+		DueAt:     dueAt,
+		DueTick:   310,
+		TaskMode:  notify.HTTP,
+		TaskData:  "hello,world",
+		Tags:      map[string]string{"tenant": "a", "order_id": "1001"},
+		Attempts:  2,
+		LastError: "service unavailable",
 	}
 	testRedisDb.Save(task)
 	list := testRedisDb.GetList()
 	assert.Equal(t, 1, len(list))
-	assert.Equal(t, "123 5 10 1 hello,world", list[0].String())
+	assert.Equal(t, "123 310 1 hello,world", list[0].String())
+	assert.True(t, dueAt.Equal(list[0].DueAt))
+	assert.True(t, createdAt.Equal(list[0].CreatedAt))
+	assert.Equal(t, task.Tags, list[0].Tags)
+	assert.Equal(t, 2, list[0].Attempts)
+	assert.Equal(t, "service unavailable", list[0].LastError)
 }
 
 func TestRemoveTaskFromDb(t *testing.T) {
 	testBeforeClearDb()
 	task := &Task{
-		Id:            "123",
-		CycleCount:    5,
-		WheelPosition: 10,
-		TaskMode:      notify.HTTP,
-		TaskData:      "hello,world",
+		Id:       "123",
+		DueTick:  310,
+		TaskMode: notify.HTTP,
+		TaskData: "hello,world",
 	}
 	testRedisDb.Save(task)
 	list := testRedisDb.GetList()
@@ -52,11 +63,10 @@ func TestRemoveAllTasksFromDb(t *testing.T) {
 	counts := 1000
 	for i := 0; i < counts; i++ {
 		task := &Task{
-			Id:            fmt.Sprintf("1%d", i),
-			CycleCount:    5 * i,
-			WheelPosition: 10,
-			TaskMode:      notify.HTTP,
-			TaskData:      "hello,world",
+			Id:       fmt.Sprintf("1%d", i),
+			DueTick:  int64(5 * i),
+			TaskMode: notify.HTTP,
+			TaskData: "hello,world",
 		}
 		testRedisDb.Save(task)
 	}
@@ -69,9 +79,212 @@ func TestSaveAndGetTimeWheelPointer(t *testing.T) {
 	testBeforeClearDb()
 	testRedisDb.Client.Del(context.Background(), TIME_POINTER_CACHE_KEY)
 
-	assert.Equal(t, 0, testRedisDb.GetWheelTimePointer())
-	testRedisDb.SaveWheelTimePointer(100)
-	assert.Equal(t, 100, testRedisDb.GetWheelTimePointer())
+	index, savedAt := testRedisDb.GetWheelTimePointer()
+	assert.Equal(t, 0, index)
+	assert.True(t, savedAt.IsZero())
+	now := time.Now()
+	testRedisDb.SaveWheelTimePointer(100, now)
+	index, savedAt = testRedisDb.GetWheelTimePointer()
+	assert.Equal(t, 100, index)
+	assert.True(t, now.Equal(savedAt))
+
+	// the pointer saved by the old version
+	testRedisDb.Client.Set(context.Background(), TIME_POINTER_CACHE_KEY, 200, 0)
+	index, savedAt = testRedisDb.GetWheelTimePointer()
+	assert.Equal(t, 200, index)
+	assert.True(t, savedAt.IsZero())
+}
+
+func TestSaveDeadLetterIntoDb(t *testing.T) {
+	testBeforeClearDb()
+	testRedisDb.Client.Del(context.Background(), testRedisDb.DeadLetterListKey)
+	task := &Task{
+		Id:       "123",
+		TaskMode: notify.HTTP,
+		TaskData: "hello,world",
+	}
+	assert.Nil(t, testRedisDb.SaveDeadLetter(task))
+	ids, _ := testRedisDb.Client.LRange(context.Background(), testRedisDb.DeadLetterListKey, 0, -1).Result()
+	assert.Equal(t, []string{"123"}, ids)
+}
+
+func TestGetAndDeleteDeadLettersFromDb(t *testing.T) {
+	testBeforeClearDb()
+	testRedisDb.RemoveAllDeadLetters()
+	testRedisDb.SaveDeadLetter(&Task{Id: "1", TaskMode: notify.HTTP, TaskData: "hello", Attempts: 3, LastError: "failed"})
+	testRedisDb.SaveDeadLetter(&Task{Id: "2", TaskMode: notify.HTTP, TaskData: "world"})
+	deadLetters := testRedisDb.GetDeadLetters()
+	assert.Equal(t, 2, len(deadLetters))
+
+	assert.Nil(t, testRedisDb.DeleteDeadLetter("1"))
+	deadLetters = testRedisDb.GetDeadLetters()
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, "2", deadLetters[0].Id)
+
+	assert.Nil(t, testRedisDb.RemoveAllDeadLetters())
+	assert.Equal(t, 0, len(testRedisDb.GetDeadLetters()))
+}
+
+func TestSaveInFlightIntoDb(t *testing.T) {
+	testBeforeClearDb()
+	testRedisDb.DeleteInFlight("1")
+	leaseUntil := time.Now().Add(time.Minute)
+	assert.Nil(t, testRedisDb.SaveInFlight(&Task{Id: "1", TaskMode: notify.HTTP, TaskData: "hello", LeaseUntil: leaseUntil}))
+	assert.Nil(t, testRedisDb.SaveInFlight(&Task{Id: "1", TaskMode: notify.HTTP, TaskData: "hello", LeaseUntil: leaseUntil}))
+	inFlight := testRedisDb.GetInFlight()
+	assert.Equal(t, 1, len(inFlight))
+	assert.True(t, leaseUntil.Equal(inFlight[0].LeaseUntil))
+
+	assert.Nil(t, testRedisDb.DeleteInFlight("1"))
+	assert.Equal(t, 0, len(testRedisDb.GetInFlight()))
+}
+
+func TestSaveStatusIntoDb(t *testing.T) {
+	testBeforeClearDb()
+	task := &Task{Id: "123", TaskMode: notify.HTTP, TaskData: "hello", State: TaskSucceeded, FinishedAt: time.Now()}
+	assert.Nil(t, testRedisDb.SaveStatus(task, time.Minute))
+	status := testRedisDb.GetStatus("123")
+	assert.NotNil(t, status)
+	assert.Equal(t, TaskSucceeded, status.State)
+	ttl, _ := testRedisDb.Client.TTL(context.Background(), testRedisDb.statusKey("123")).Result()
+	assert.True(t, ttl > 0 && ttl <= time.Minute)
+
+	assert.Nil(t, testRedisDb.GetStatus("not-exist"))
+}
+
+func TestSaveScheduleIntoDb(t *testing.T) {
+	testBeforeClearDb()
+	testRedisDb.DeleteSchedule("heartbeat")
+	task := &Task{Id: "123", TaskMode: notify.HTTP, TaskData: "hello", Schedule: &Schedule{Id: "heartbeat", Interval: time.Minute, Occurrences: 2, Paused: true}}
+	assert.Nil(t, testRedisDb.SaveSchedule(task))
+	assert.NotNil(t, testRedisDb.SaveSchedule(&Task{Id: "456"}))
+	paused := testRedisDb.GetSchedule("heartbeat")
+	assert.NotNil(t, paused)
+	assert.Equal(t, "123", paused.Id)
+	assert.Equal(t, *task.Schedule, *paused.Schedule)
+	ids := []string{}
+	for _, paused := range testRedisDb.GetSchedules() {
+		ids = append(ids, paused.Id)
+	}
+	assert.Contains(t, ids, "123")
+
+	assert.Nil(t, testRedisDb.DeleteSchedule("heartbeat"))
+	assert.Nil(t, testRedisDb.GetSchedule("heartbeat"))
+}
+
+func TestClaimIdempotencyKeyInDb(t *testing.T) {
+	testBeforeClearDb()
+	testRedisDb.Client.Del(context.Background(), testRedisDb.idempotencyKey("request-1"))
+	claimed, err := testRedisDb.ClaimIdempotencyKey("request-1", &Task{Id: "1", TaskMode: notify.HTTP, TaskData: "hello"}, time.Minute)
+	assert.Nil(t, err)
+	assert.Nil(t, claimed)
+	claimed, err = testRedisDb.ClaimIdempotencyKey("request-1", &Task{Id: "2", TaskMode: notify.HTTP, TaskData: "hello"}, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", claimed.Id)
+	ttl, _ := testRedisDb.Client.TTL(context.Background(), testRedisDb.idempotencyKey("request-1")).Result()
+	assert.True(t, ttl > 0 && ttl <= time.Minute)
+
+	// only the task which has claimed the key releases it
+	assert.Nil(t, testRedisDb.ReleaseIdempotencyKey("request-1", "2"))
+	claimed, _ = testRedisDb.ClaimIdempotencyKey("request-1", &Task{Id: "2"}, time.Minute)
+	assert.Equal(t, "1", claimed.Id)
+	assert.Nil(t, testRedisDb.ReleaseIdempotencyKey("request-1", "1"))
+	claimed, _ = testRedisDb.ClaimIdempotencyKey("request-1", &Task{Id: "2"}, time.Minute)
+	assert.Nil(t, claimed)
+}
+
+func TestSaveWaitingIntoDb(t *testing.T) {
+	testBeforeClearDb()
+	task := &Task{Id: "b", TaskMode: notify.HTTP, TaskData: "hello", State: TaskWaiting, Parents: []string{"a"}, DelayAfterParents: time.Minute}
+	assert.Nil(t, testRedisDb.SaveWaiting(task))
+	waiting := testRedisDb.GetWaiting("b")
+	assert.NotNil(t, waiting)
+	assert.Equal(t, []string{"a"}, waiting.Parents)
+	assert.Equal(t, time.Minute, waiting.DelayAfterParents)
+	ids := []string{}
+	for _, waiting := range testRedisDb.GetWaitingList() {
+		ids = append(ids, waiting.Id)
+	}
+	assert.Contains(t, ids, "b")
+
+	assert.Nil(t, testRedisDb.DeleteWaiting("b"))
+	assert.Nil(t, testRedisDb.GetWaiting("b"))
+}
+
+func TestQueryTasksFromDb(t *testing.T) {
+	testBeforeClearDb()
+	now := time.Now()
+	for i := 1; i <= 10; i++ {
+		tenant := "a"
+		if i%2 == 0 {
+			tenant = "b"
+		}
+		testRedisDb.Save(&Task{
+			Id:       fmt.Sprintf("%d", i),
+			DueAt:    now.Add(time.Duration(i) * time.Minute),
+			TaskMode: notify.HTTP,
+			TaskData: "http://www.google.com|hello",
+			Tags:     map[string]string{"tenant": tenant},
+		})
+	}
+
+	tasks, total, err := testRedisDb.QueryTasks(TaskFilter{DueBefore: now.Add(6 * time.Minute), Tags: map[string]string{"tenant": "a"}, Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, total)
+	assert.Equal(t, 2, len(tasks))
+	assert.Equal(t, "1", tasks[0].Id)
+	assert.Equal(t, "3", tasks[1].Id)
+
+	// the indexes follow the updates and deletions
+	testRedisDb.Save(&Task{Id: "1", DueAt: now.Add(time.Minute), TaskMode: notify.SubPub, TaskData: "queue_name|hello", Tags: map[string]string{"tenant": "b"}})
+	testRedisDb.Delete("3")
+	_, total, _ = testRedisDb.QueryTasks(TaskFilter{Tags: map[string]string{"tenant": "a"}, Limit: 10})
+	assert.Equal(t, 3, total)
+	tasks, total, _ = testRedisDb.QueryTasks(TaskFilter{Target: "queue_name", Limit: 10})
+	assert.Equal(t, 1, total)
+	assert.Equal(t, notify.SubPub, tasks[0].TaskMode)
+
+	testRedisDb.RemoveAll()
+	_, total, _ = testRedisDb.QueryTasks(TaskFilter{Limit: 10})
+	assert.Equal(t, 0, total)
+}
+
+func TestQueryTasksByTagsWithEqualSignsFromDb(t *testing.T) {
+	testBeforeClearDb()
+	testRedisDb.Save(&Task{Id: "1", DueAt: time.Now().Add(time.Minute), TaskMode: notify.HTTP, TaskData: "hello", Tags: map[string]string{"a=b": "c"}})
+	testRedisDb.Save(&Task{Id: "2", DueAt: time.Now().Add(time.Minute), TaskMode: notify.HTTP, TaskData: "hello", Tags: map[string]string{"a": "b=c"}})
+
+	tasks, total, err := testRedisDb.QueryTasks(TaskFilter{Tags: map[string]string{"a": "b=c"}, Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, "2", tasks[0].Id)
+	tasks, total, _ = testRedisDb.QueryTasks(TaskFilter{Tags: map[string]string{"a=b": "c"}, Limit: 10})
+	assert.Equal(t, 1, total)
+	assert.Equal(t, "1", tasks[0].Id)
+}
+
+func TestTagIndexKeys(t *testing.T) {
+	rd := newRedisDb(nil, "")
+	assert.NotEqual(t, rd.tagIndexKey("a=b", "c"), rd.tagIndexKey("a", "b=c"))
+	assert.Equal(t, rd.tagIndexKey("tenant", "a"), rd.tagIndexKey("tenant", "a"))
+}
+
+func TestRedisNamespaces(t *testing.T) {
+	testBeforeClearDb()
+	tenantDb := NewRedisPersistence(testRedisDb.Client, "tenant_a:")
+	tenantDb.RemoveAll()
+
+	tenantDb.Save(&Task{Id: "123", TaskMode: notify.HTTP, TaskData: "hello,world"})
+	assert.Equal(t, 1, len(tenantDb.GetList()))
+	assert.Equal(t, 0, len(testRedisDb.GetList()))
+
+	tenantDb.SaveWheelTimePointer(100, time.Now())
+	testRedisDb.SaveWheelTimePointer(200, time.Now())
+	index, _ := tenantDb.GetWheelTimePointer()
+	assert.Equal(t, 100, index)
+
+	tenantDb.RemoveAll()
+	assert.Equal(t, 0, len(tenantDb.GetList()))
 }
 
 func BenchmarkSaveToDb(b *testing.B) {
@@ -81,14 +294,28 @@ func BenchmarkSaveToDb(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		u := uuid.New()
 		task := &Task{
-			Id:            u.String(),
-			CycleCount:    5 * i,
-			WheelPosition: 10,
-			TaskMode:      notify.SubPub,
-			TaskData:      "hello,world",
+			Id:       u.String(),
+			DueTick:  int64(5 * i),
+			TaskMode: notify.SubPub,
+			TaskData: "hello,world",
 		}
 		testRedisDb.Save(task)
 	}
 	b.StopTimer()
 	testRedisDb.RemoveAll()
 }
+
+func TestSaveAndDeleteBatchInDb(t *testing.T) {
+	testBeforeClearDb()
+	tasks := []*Task{}
+	for i := 0; i < 3; i++ {
+		tasks = append(tasks, &Task{Id: fmt.Sprintf("batch-%d", i), DueTick: int64(10 + i), TaskMode: notify.HTTP, TaskData: "hello"})
+	}
+	assert.Nil(t, testRedisDb.SaveBatch(tasks))
+	assert.Equal(t, 3, len(testRedisDb.GetList()))
+
+	assert.Nil(t, testRedisDb.DeleteBatch([]string{"batch-0", "batch-2", "not-exist"}))
+	list := testRedisDb.GetList()
+	assert.Equal(t, 1, len(list))
+	assert.Equal(t, "batch-1", list[0].Id)
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	DEFAULT_RETRY_MAX_ATTEMPTS    = 3
+	DEFAULT_RETRY_INITIAL_BACKOFF = time.Second
+	DEFAULT_RETRY_MAX_BACKOFF     = 5 * time.Minute
+	DEFAULT_RETRY_MULTIPLIER      = 2
+	DEFAULT_RETRY_JITTER          = 0.2
+)
+
+// RetryPolicy decides whether and when a failed task is executed again
+type RetryPolicy struct {
+	// the maximum number of executions including the first one, 1 means the task is never retried
+	MaxAttempts int
+	// the delay before the first retry
+	InitialBackoff time.Duration
+	// the upper limit of the delay between two executions
+	MaxBackoff time.Duration
+	// the delay is multiplied by it after every retry
+	Multiplier float64
+	// the random factor of the delay, 0.2 means the delay varies by up to 20% in both directions
+	Jitter float64
+	// decides whether an error is worth retrying, IsRetryable is used when it is nil.
+	// it is not persisted with the task.
+	Retryable func(err error) bool `json:"-"`
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    DEFAULT_RETRY_MAX_ATTEMPTS,
+		InitialBackoff: DEFAULT_RETRY_INITIAL_BACKOFF,
+		MaxBackoff:     DEFAULT_RETRY_MAX_BACKOFF,
+		Multiplier:     DEFAULT_RETRY_MULTIPLIER,
+		Jitter:         DEFAULT_RETRY_JITTER,
+	}
+}
+
+// IsRetryable reports whether an error is worth retrying,
+// errors which have a Retryable method (such as notify.PermanentError) decide by themselves,
+// all other errors are retryable.
+func IsRetryable(err error) bool {
+	var retryable interface{ Retryable() bool }
+	if errors.As(err, &retryable) {
+		return retryable.Retryable()
+	}
+	return true
+}
+
+// whether the task should be executed again after the given number of failed attempts
+func (rp *RetryPolicy) ShouldRetry(attempts int, err error) bool {
+	if attempts >= rp.MaxAttempts {
+		return false
+	}
+	if rp.Retryable != nil {
+		return rp.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// the delay before the next execution after the given number of failed attempts
+func (rp *RetryPolicy) Backoff(attempts int) time.Duration {
+	multiplier := rp.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	backoff := float64(rp.InitialBackoff) * math.Pow(multiplier, float64(attempts-1))
+	if rp.MaxBackoff > 0 && backoff > float64(rp.MaxBackoff) {
+		backoff = float64(rp.MaxBackoff)
+	}
+	if rp.Jitter > 0 {
+		backoff = backoff * (1 + rp.Jitter*(rand.Float64()*2-1))
+	}
+	return time.Duration(backoff)
+}
+
+// the policy of the task, or the default policy of the delay queue
+func (dq *DelayQueue) retryPolicyOf(task *Task) *RetryPolicy {
+	if task.RetryPolicy == nil {
+		return &dq.retryPolicy
+	}
+	if task.RetryPolicy.Retryable == nil && dq.retryPolicy.Retryable != nil {
+		// the classifier is not persisted, fall back to the one of the default policy
+		policy := *task.RetryPolicy
+		policy.Retryable = dq.retryPolicy.Retryable
+		return &policy
+	}
+	return task.RetryPolicy
+}
+
+// execute a due task, a failed task is added back to the time wheel until its retry policy gives up
+func (dq *DelayQueue) runTask(task *Task) {
+	dq.acquireLease(task)
+	startedAt := dq.clock.Now()
+	err := dq.ExecuteTask(task.TaskMode, task.TaskData)
+	duration := dq.clock.Now().Sub(startedAt)
+
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	defer dq.releaseLease(task)
+	if err == nil {
+		dq.finish(task, TaskSucceeded)
+		dq.emit(EventSuccess, task, nil, duration)
+		dq.scheduleAfterDone(task)
+		return
+	}
+
+	task.Attempts++
+	task.LastError = err.Error()
+	task.LastAttemptAt = dq.clock.Now()
+	dq.emit(EventFailure, task, err, duration)
+	policy := dq.retryPolicyOf(task)
+	if !policy.ShouldRetry(task.Attempts, err) {
+		log.Printf("task %s failed after %d attempts: %v\n", task.Id, task.Attempts, err)
+		dq.deadLetter(task)
+		dq.scheduleAfterDone(task)
+		return
+	}
+
+	backoff := policy.Backoff(task.Attempts)
+	log.Printf("task %s failed on attempt %d: %v, retry in %v\n", task.Id, task.Attempts, err, backoff)
+	task.State = TaskFailed
+	// persist the attempts, so the retries go on after a restart
+	dq.requeue(task, dq.clock.Now().Add(backoff))
+}
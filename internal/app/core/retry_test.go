@@ -0,0 +1,148 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// fails until it has been executed the given number of times
+type testFlakyNotify struct {
+	executed  int64
+	failTimes int64
+	err       error
+}
+
+func (tn *testFlakyNotify) DoDelayTask(contents string) error {
+	if atomic.AddInt64(&tn.executed, 1) <= tn.failTimes {
+		return tn.err
+	}
+	return nil
+}
+
+func testRetryQueue(executor notify.Executor, db Persistence, policy RetryPolicy) *DelayQueue {
+	queue := New(
+		WithTaskExecutor(func(taskMode notify.NotifyMode) notify.Executor { return executor }),
+		WithPersistence(db),
+		WithTick(10*time.Millisecond),
+		WithDefaultRetryPolicy(policy),
+	)
+	queue.Start()
+	return queue
+}
+
+// a started delay queue on a fake clock, with the default tick
+func testFakeRetryQueue(fake *clock.Fake, executor notify.Executor, db Persistence, policy RetryPolicy) *DelayQueue {
+	queue := New(
+		WithClock(fake),
+		WithTaskExecutor(func(taskMode notify.NotifyMode) notify.Executor { return executor }),
+		WithPersistence(db),
+		WithDefaultRetryPolicy(policy),
+	)
+	queue.Start()
+	return queue
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: 10 * time.Second, Multiplier: 2}
+	assert.Equal(t, time.Second, policy.Backoff(1))
+	assert.Equal(t, 2*time.Second, policy.Backoff(2))
+	assert.Equal(t, 4*time.Second, policy.Backoff(3))
+	assert.Equal(t, 10*time.Second, policy.Backoff(5))
+
+	policy.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(2)
+		assert.True(t, backoff >= 1600*time.Millisecond && backoff <= 2400*time.Millisecond, "backoff %v", backoff)
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3}
+	err := errors.New("connection refused")
+	assert.True(t, policy.ShouldRetry(1, err))
+	assert.True(t, policy.ShouldRetry(2, err))
+	assert.False(t, policy.ShouldRetry(3, err))
+	assert.False(t, policy.ShouldRetry(1, notify.NewPermanentError(err)))
+
+	policy.Retryable = func(err error) bool { return err.Error() != "connection refused" }
+	assert.False(t, policy.ShouldRetry(1, err))
+	assert.True(t, policy.ShouldRetry(1, errors.New("timeout")))
+}
+
+func TestRetryFailedTask(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testFlakyNotify{failTimes: 2, err: errors.New("service unavailable")}
+	queue := testRetryQueue(executor, db, RetryPolicy{MaxAttempts: 3, InitialBackoff: 20 * time.Millisecond, Multiplier: 1})
+	defer queue.Stop(context.Background())
+
+	tk, _ := queue.Push(10*time.Millisecond, notify.HTTP, "hello")
+	assert.Eventually(t, func() bool {
+		task := queue.GetTask(tk.Id)
+		return task != nil && task.Attempts == 1
+	}, time.Second, 5*time.Millisecond)
+	// the attempts are persisted
+	db.Lock()
+	assert.Equal(t, 1, db.tasks[tk.Id].Attempts)
+	db.Unlock()
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&executor.executed) == 3 }, time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool { return len(db.GetList()) == 0 }, time.Second, 5*time.Millisecond)
+	assert.Nil(t, queue.GetTask(tk.Id))
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testFlakyNotify{failTimes: 100, err: errors.New("service unavailable")}
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	queue := testFakeRetryQueue(fake, executor, db, RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Second})
+	defer queue.Stop(context.Background())
+
+	tk, _ := queue.Push(time.Second, notify.HTTP, "hello")
+	testAdvance(t, fake, 1, time.Second)
+	assert.Eventually(t, func() bool {
+		task := queue.GetTask(tk.Id)
+		return task != nil && task.Attempts == 1
+	}, time.Second, time.Millisecond)
+	testAdvance(t, fake, 1, time.Second)
+	assert.Eventually(t, func() bool { return len(db.GetList()) == 0 }, time.Second, time.Millisecond)
+
+	// the task is not retried any more
+	testAdvance(t, fake, 1, time.Minute)
+	assert.Equal(t, uint64(2), queue.PoolStats().Submitted)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&executor.executed))
+	assert.Nil(t, queue.GetTask(tk.Id))
+}
+
+func TestRetryPolicyOfTask(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testFlakyNotify{failTimes: 3, err: errors.New("service unavailable")}
+	// the default policy never retries
+	queue := testRetryQueue(executor, db, RetryPolicy{MaxAttempts: 1})
+	defer queue.Stop(context.Background())
+
+	queue.Push(10*time.Millisecond, notify.HTTP, "hello", WithRetryPolicy(RetryPolicy{MaxAttempts: 5, InitialBackoff: 10 * time.Millisecond}))
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&executor.executed) == 4 }, time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool { return len(db.GetList()) == 0 }, time.Second, 5*time.Millisecond)
+}
+
+func TestPermanentErrorIsNotRetried(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testFlakyNotify{failTimes: 100, err: notify.NewPermanentError(errors.New("invalid notify contents"))}
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	queue := testFakeRetryQueue(fake, executor, db, RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second})
+	defer queue.Stop(context.Background())
+
+	queue.Push(time.Second, notify.HTTP, "hello")
+	testAdvance(t, fake, 1, time.Second)
+	assert.Eventually(t, func() bool { return len(db.GetList()) == 0 }, time.Second, time.Millisecond)
+	testAdvance(t, fake, 1, time.Minute)
+	assert.Equal(t, uint64(1), queue.PoolStats().Submitted)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&executor.executed))
+}
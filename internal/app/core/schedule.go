@@ -0,0 +1,363 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/cron"
+)
+
+// Schedule makes a task recurring, every occurrence is a task of its own which shares the id of the schedule,
+// the next occurrence is added to the time wheel when the current one is due,
+// or when it is done if the schedule has a fixed delay.
+type Schedule struct {
+	// the logical id shared by all occurrences
+	Id string
+	// the cron expression, the seconds field is optional, such as 0 9 * * MON-FRI
+	Cron string
+	// the interval between two occurrences, it is used instead of a cron expression
+	Interval time.Duration `json:",omitempty"`
+	// by default an interval schedule has a fixed rate, the occurrences keep their pace from the first one
+	// even if an execution runs long, and the missed ones are skipped.
+	// with a fixed delay the next occurrence is due an interval after the current one is done.
+	FixedDelay bool `json:",omitempty"`
+	// the IANA time zone of the cron expression, such as Asia/Shanghai, UTC is used when it is empty
+	TimeZone string `json:",omitempty"`
+	// no occurrence is before StartAt or after EndAt, the zero time means no limit
+	StartAt time.Time
+	EndAt   time.Time
+	// the maximum number of occurrences, zero means no limit
+	MaxOccurrences int
+	// the number of occurrences so far, including the one of the task
+	Occurrences int
+	// whether the occurrence after the one of the task has been added, so a retry does not add it again
+	NextScheduled bool
+	// the occurrence of a paused schedule is kept aside until the schedule is resumed
+	Paused bool `json:",omitempty"`
+}
+
+func (s *Schedule) validate(tick time.Duration) error {
+	if s.MaxOccurrences < 0 {
+		return errors.New("the max occurrences can not be negative")
+	}
+	if s.Cron != "" && s.Interval != 0 {
+		return errors.New("the schedule can not have both a cron expression and an interval")
+	}
+	if s.Cron == "" {
+		if s.Interval <= 0 {
+			return errors.New("the schedule needs a cron expression or a positive interval")
+		}
+		if s.Interval < tick {
+			return errors.New("the interval is shorter than the tick of the time wheel")
+		}
+	} else if s.FixedDelay {
+		return errors.New("only an interval schedule can have a fixed delay")
+	}
+	return nil
+}
+
+// the time of the next occurrence after the given time, the zero time if the schedule is over
+func (s *Schedule) next(after time.Time) (time.Time, error) {
+	if s.MaxOccurrences > 0 && s.Occurrences >= s.MaxOccurrences {
+		return time.Time{}, nil
+	}
+	return s.following(after)
+}
+
+// the time of the first occurrence after the given time regardless of the number of occurrences,
+// the zero time if it is after the end of the schedule
+func (s *Schedule) following(after time.Time) (time.Time, error) {
+	if s.Interval > 0 {
+		next := after.Add(s.Interval)
+		if !s.StartAt.IsZero() && after.Before(s.StartAt) {
+			next = s.StartAt
+		}
+		if !s.EndAt.IsZero() && next.After(s.EndAt) {
+			return time.Time{}, nil
+		}
+		return next, nil
+	}
+	expr, err := cron.Parse(s.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	loc := time.UTC
+	if s.TimeZone != "" {
+		if loc, err = time.LoadLocation(s.TimeZone); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if !s.StartAt.IsZero() && after.Before(s.StartAt) {
+		// the start time itself can be an occurrence
+		after = s.StartAt.Add(-time.Second)
+	}
+	next := expr.Next(after.In(loc))
+	if !s.EndAt.IsZero() && next.After(s.EndAt) {
+		return time.Time{}, nil
+	}
+	return next, nil
+}
+
+// Add a recurring task to the delay queue, returns the task of the first occurrence.
+// The id of the schedule is generated if it is empty.
+func (dq *DelayQueue) PushSchedule(schedule Schedule, taskMode notify.NotifyMode, taskData interface{}, opts ...TaskOption) (*Task, error) {
+	if schedule.Id == "" {
+		schedule.Id = uuid.New().String()
+	}
+	if err := schedule.validate(dq.tick); err != nil {
+		return nil, err
+	}
+	schedule.Occurrences = 0
+	schedule.NextScheduled = false
+	schedule.Paused = false
+	dueAt, err := schedule.next(dq.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	if dueAt.IsZero() {
+		return nil, errors.New("the schedule has no occurrence")
+	}
+	schedule.Occurrences = 1
+	return dq.internalPush(dueAt, "", taskMode, taskDataToString(taskData), true, append(opts, func(task *Task) {
+		task.Schedule = &schedule
+	})...)
+}
+
+// add the next occurrence of a recurring task to the time wheel,
+// the caller must hold the lock
+func (dq *DelayQueue) scheduleNext(task *Task) {
+	if task.Schedule.NextScheduled {
+		return
+	}
+	task.updateSchedule(func(schedule *Schedule) { schedule.NextScheduled = true })
+
+	schedule := *task.Schedule
+	schedule.NextScheduled = false
+	// the missed occurrences are skipped, such as after a downtime
+	now := dq.clock.Now()
+	after := now
+	if task.DueAt.After(after) {
+		after = task.DueAt
+	} else if schedule.Interval > 0 && !schedule.FixedDelay {
+		// a fixed rate keeps the pace of the due times
+		after = task.DueAt.Add(now.Sub(task.DueAt) / schedule.Interval * schedule.Interval)
+	}
+	dueAt, err := schedule.next(after)
+	if err != nil {
+		log.Printf("schedule %s stopped: %v\n", schedule.Id, err)
+		return
+	}
+	if dueAt.IsZero() {
+		log.Printf("schedule %s is over after %d occurrences\n", schedule.Id, schedule.Occurrences)
+		return
+	}
+	schedule.Occurrences++
+
+	next := &Task{
+		Id:          uuid.New().String(),
+		CreatedAt:   dq.clock.Now(),
+		DueAt:       dueAt,
+		TaskMode:    task.TaskMode,
+		TaskData:    task.TaskData,
+		State:       TaskPending,
+		RetryPolicy: task.RetryPolicy,
+		Schedule:    &schedule,
+	}
+	if task.Tags != nil {
+		next.Tags = task.clone().Tags
+	}
+	if schedule.Paused {
+		// the schedule was paused while the occurrence was running
+		if err := dq.Persistence.SaveSchedule(next); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	next.DueTick = dq.dueTickOf(dueAt)
+	dq.wheel.add(next)
+	dq.TaskQueryTable[next.Id] = next
+	dq.rememberOccurrence(next)
+	dq.Persistence.Save(next)
+	dq.emit(EventPush, next, nil, 0)
+}
+
+// add the next occurrence of a schedule with a fixed delay once the current one is done,
+// the caller must hold the lock
+func (dq *DelayQueue) scheduleAfterDone(task *Task) {
+	if task.Schedule != nil && task.Schedule.FixedDelay {
+		dq.scheduleNext(task)
+	}
+}
+
+// remember a pending occurrence of a schedule, so the occurrences of a schedule are found without scanning the pending tasks,
+// the caller must hold the lock
+func (dq *DelayQueue) rememberOccurrence(task *Task) {
+	if task.Schedule == nil {
+		return
+	}
+	occurrences, ok := dq.scheduled[task.Schedule.Id]
+	if !ok {
+		occurrences = SlotRecorder{}
+		dq.scheduled[task.Schedule.Id] = occurrences
+	}
+	occurrences[task.Id] = task
+}
+
+// forget an occurrence which has left the time wheel, the caller must hold the lock
+func (dq *DelayQueue) forgetOccurrence(task *Task) {
+	if task.Schedule == nil {
+		return
+	}
+	occurrences := dq.scheduled[task.Schedule.Id]
+	if occurrences[task.Id] == task {
+		delete(occurrences, task.Id)
+	}
+	if len(occurrences) == 0 {
+		delete(dq.scheduled, task.Schedule.Id)
+	}
+}
+
+// the pending occurrences of a schedule, the retries of an earlier occurrence included,
+// the caller must hold the lock
+func (dq *DelayQueue) pendingOccurrences(scheduleId string) []*Task {
+	occurrences := dq.scheduled[scheduleId]
+	tasks := []*Task{}
+	for taskId, task := range occurrences {
+		// the task may have left the time wheel by a way which does not forget it
+		if pending, ok := dq.TaskQueryTable[taskId]; !ok || pending != task {
+			delete(occurrences, taskId)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	if len(occurrences) == 0 {
+		delete(dq.scheduled, scheduleId)
+	}
+	return tasks
+}
+
+// whether the task is the occurrence which the next occurrences of the schedule are added after
+func (t *Task) isNextOccurrenceOf(scheduleId string) bool {
+	return t.Schedule != nil && t.Schedule.Id == scheduleId && !t.Schedule.NextScheduled
+}
+
+// change the schedule of a task, the schedule may be shared with the copies of the task,
+// so it is never changed in place
+func (t *Task) updateSchedule(update func(schedule *Schedule)) {
+	schedule := *t.Schedule
+	update(&schedule)
+	t.Schedule = &schedule
+}
+
+// Pause a schedule, its pending occurrence is taken off the time wheel and persisted aside.
+// If the occurrence is being executed, the execution goes on and the next occurrence is kept aside.
+func (dq *DelayQueue) PauseSchedule(scheduleId string) error {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	if dq.Persistence.GetSchedule(scheduleId) != nil {
+		return errors.New("the schedule is already paused")
+	}
+	for _, task := range dq.pendingOccurrences(scheduleId) {
+		if !task.isNextOccurrenceOf(scheduleId) {
+			continue
+		}
+		task.updateSchedule(func(schedule *Schedule) { schedule.Paused = true })
+		if err := dq.Persistence.SaveSchedule(task); err != nil {
+			return err
+		}
+		dq.wheel.remove(task)
+		delete(dq.TaskQueryTable, task.Id)
+		dq.forgetOccurrence(task)
+		dq.Persistence.Delete(task.Id)
+		return nil
+	}
+	for _, task := range dq.running {
+		if task.isNextOccurrenceOf(scheduleId) {
+			if task.Schedule.Paused {
+				return errors.New("the schedule is already paused")
+			}
+			task.updateSchedule(func(schedule *Schedule) { schedule.Paused = true })
+			return nil
+		}
+	}
+	return errors.New("schedule not found")
+}
+
+// Resume a paused schedule, returns its pending occurrence.
+// The occurrence keeps its due time if it is still ahead, otherwise the occurrences missed during the pause are skipped.
+func (dq *DelayQueue) ResumeSchedule(scheduleId string) (*Task, error) {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	task := dq.Persistence.GetSchedule(scheduleId)
+	if task == nil {
+		for _, task := range dq.running {
+			if task.isNextOccurrenceOf(scheduleId) && task.Schedule.Paused {
+				task.updateSchedule(func(schedule *Schedule) { schedule.Paused = false })
+				return task.clone(), nil
+			}
+		}
+		return nil, errors.New("the schedule is not paused")
+	}
+	task.updateSchedule(func(schedule *Schedule) { schedule.Paused = false })
+	if now := dq.clock.Now(); !task.DueAt.After(now) {
+		dueAt, err := task.Schedule.following(now)
+		if err != nil {
+			return nil, err
+		}
+		if dueAt.IsZero() {
+			dq.Persistence.DeleteSchedule(scheduleId)
+			return nil, errors.New("the schedule is over")
+		}
+		task.DueAt = dueAt
+	}
+	task.DueTick = dq.dueTickOf(task.DueAt)
+	task.State = TaskPending
+	dq.wheel.add(task)
+	dq.TaskQueryTable[task.Id] = task
+	dq.rememberOccurrence(task)
+	if err := dq.Persistence.Save(task); err != nil {
+		log.Println(err)
+	}
+	if err := dq.Persistence.DeleteSchedule(scheduleId); err != nil {
+		log.Println(err)
+	}
+	return task.clone(), nil
+}
+
+// Cancel a schedule, its pending occurrences are cancelled, the paused one included.
+// If an occurrence is being executed, the execution goes on but no occurrence follows it.
+func (dq *DelayQueue) CancelSchedule(scheduleId string) error {
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	found := false
+	if task := dq.Persistence.GetSchedule(scheduleId); task != nil {
+		if err := dq.Persistence.DeleteSchedule(scheduleId); err != nil {
+			return err
+		}
+		dq.finish(task, TaskCancelled)
+		dq.emit(EventDelete, task, nil, 0)
+		found = true
+	}
+	for _, task := range dq.pendingOccurrences(scheduleId) {
+		dq.wheel.remove(task)
+		delete(dq.TaskQueryTable, task.Id)
+		dq.forgetOccurrence(task)
+		dq.Persistence.Delete(task.Id)
+		dq.finish(task, TaskCancelled)
+		dq.emit(EventDelete, task, nil, 0)
+		found = true
+	}
+	for _, task := range dq.running {
+		if task.isNextOccurrenceOf(scheduleId) {
+			task.updateSchedule(func(schedule *Schedule) { schedule.NextScheduled = true })
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("schedule not found")
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleNext(t *testing.T) {
+	from := time.Date(2023, 2, 1, 9, 30, 0, 0, time.UTC)
+	schedule := Schedule{Cron: "0 9 * * *"}
+	next, err := schedule.next(from)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2023, 2, 2, 9, 0, 0, 0, time.UTC), next)
+
+	schedule.TimeZone = "Asia/Shanghai"
+	next, _ = schedule.next(from)
+	assert.Equal(t, time.Date(2023, 2, 2, 1, 0, 0, 0, time.UTC), next.UTC())
+
+	schedule = Schedule{Cron: "0 9 * * *", StartAt: time.Date(2023, 3, 1, 9, 0, 0, 0, time.UTC)}
+	next, _ = schedule.next(from)
+	assert.Equal(t, schedule.StartAt, next)
+
+	schedule = Schedule{Cron: "0 9 * * *", EndAt: time.Date(2023, 2, 2, 8, 0, 0, 0, time.UTC)}
+	next, _ = schedule.next(from)
+	assert.True(t, next.IsZero())
+
+	schedule = Schedule{Cron: "0 9 * * *", MaxOccurrences: 2, Occurrences: 2}
+	next, _ = schedule.next(from)
+	assert.True(t, next.IsZero())
+
+	_, err = (&Schedule{Cron: "0 9 * *"}).next(from)
+	assert.NotNil(t, err)
+	_, err = (&Schedule{Cron: "0 9 * * *", TimeZone: "Mars/Olympus_Mons"}).next(from)
+	assert.NotNil(t, err)
+}
+
+func TestPushSchedule(t *testing.T) {
+	testBeforeSetUp()
+	_, err := dq.PushSchedule(Schedule{Cron: "every day"}, notify.HTTP, "hello")
+	assert.NotNil(t, err)
+	_, err = dq.PushSchedule(Schedule{Cron: "0 9 * * *", EndAt: time.Now().Add(-time.Hour)}, notify.HTTP, "hello")
+	assert.NotNil(t, err)
+
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("time zone database is not available")
+	}
+	tk, err := dq.PushSchedule(Schedule{Id: "daily-report", Cron: "0 9 * * *", TimeZone: "Europe/London"}, notify.HTTP, "hello", WithTag("tenant", "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, "daily-report", tk.Schedule.Id)
+	assert.Equal(t, 1, tk.Schedule.Occurrences)
+	dueAt := tk.DueAt.In(loc)
+	assert.Equal(t, 9, dueAt.Hour())
+	assert.Equal(t, 0, dueAt.Minute())
+	assert.Equal(t, "a", dq.GetTask(tk.Id).Tags["tenant"])
+}
+
+func TestRecurringTaskIsExecutedOnEveryOccurrence(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	db := newTestMemoryDb()
+	executor := &testFlakyNotify{failTimes: 1, err: errors.New("service unavailable")}
+	queue := New(
+		WithClock(fake),
+		WithPersistence(db),
+		WithTick(100*time.Millisecond),
+		WithTaskExecutor(func(taskMode notify.NotifyMode) notify.Executor { return executor }),
+		WithDefaultRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: 100 * time.Millisecond}),
+	)
+	queue.Start()
+	defer queue.Stop(context.Background())
+
+	tk, err := queue.PushSchedule(Schedule{Cron: "* * * * * *", MaxOccurrences: 3}, notify.HTTP, "hello")
+	assert.Nil(t, err)
+	waitFor := func(executed int64, pending int) {
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt64(&executor.executed) == executed && len(db.GetList()) == pending
+		}, 5*time.Second, time.Millisecond)
+	}
+	// the first occurrence is retried once, the next occurrence is pushed once an occurrence starts
+	testAdvance(t, fake, 1, time.Second)
+	waitFor(1, 2)
+	testAdvance(t, fake, 1, 100*time.Millisecond)
+	waitFor(2, 1)
+	testAdvance(t, fake, 1, 900*time.Millisecond)
+	waitFor(3, 1)
+	testAdvance(t, fake, 1, time.Second)
+	waitFor(4, 0)
+	testAdvance(t, fake, 1, 2*time.Second)
+	assert.Equal(t, uint64(4), queue.PoolStats().Submitted)
+
+	// every occurrence shares the schedule id
+	db.Lock()
+	defer db.Unlock()
+	occurrences := map[int]bool{}
+	for _, status := range db.statuses {
+		assert.Equal(t, tk.Schedule.Id, status.Schedule.Id)
+		assert.Equal(t, TaskSucceeded, status.State)
+		occurrences[status.Schedule.Occurrences] = true
+	}
+	assert.Equal(t, map[int]bool{1: true, 2: true, 3: true}, occurrences)
+}
+
+func TestIntervalSchedule(t *testing.T) {
+	from := time.Date(2023, 2, 1, 9, 30, 0, 0, time.UTC)
+	schedule := Schedule{Interval: time.Minute}
+	next, err := schedule.next(from)
+	assert.Nil(t, err)
+	assert.Equal(t, from.Add(time.Minute), next)
+	schedule.StartAt = from.Add(time.Hour)
+	next, _ = schedule.next(from)
+	assert.Equal(t, schedule.StartAt, next)
+
+	assert.NotNil(t, (&Schedule{}).validate(time.Second))
+	assert.NotNil(t, (&Schedule{Cron: "0 9 * * *", Interval: time.Minute}).validate(time.Second))
+	assert.NotNil(t, (&Schedule{Cron: "0 9 * * *", FixedDelay: true}).validate(time.Second))
+	assert.NotNil(t, (&Schedule{Interval: time.Millisecond}).validate(time.Second))
+	assert.Nil(t, (&Schedule{Interval: time.Minute, FixedDelay: true}).validate(time.Second))
+}
+
+// the due times of the occurrences of a schedule, ordered by occurrence
+func testOccurrenceDueTimes(db *testMemoryDb, count int) []time.Time {
+	db.Lock()
+	defer db.Unlock()
+	dueTimes := make([]time.Time, count)
+	for _, status := range db.statuses {
+		if status.Schedule.Occurrences <= count {
+			dueTimes[status.Schedule.Occurrences-1] = status.DueAt
+		}
+	}
+	return dueTimes
+}
+
+func TestFixedRateAndFixedDelay(t *testing.T) {
+	for _, fixedDelay := range []bool{false, true} {
+		db := newTestMemoryDb()
+		executor := &testConcurrencyNotify{duration: 150 * time.Millisecond}
+		queue := testRetryQueue(executor, db, RetryPolicy{MaxAttempts: 1})
+
+		_, err := queue.PushSchedule(Schedule{Interval: 100 * time.Millisecond, FixedDelay: fixedDelay, MaxOccurrences: 3}, notify.HTTP, "hello")
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool { return atomic.LoadInt64(&executor.executed) == 3 }, 3*time.Second, 10*time.Millisecond)
+		assert.Nil(t, queue.Stop(context.Background()))
+
+		dueTimes := testOccurrenceDueTimes(db, 3)
+		for i := 1; i < 3; i++ {
+			interval := dueTimes[i].Sub(dueTimes[i-1])
+			if fixedDelay {
+				// the next occurrence waits for the execution of the current one, a task may start up to a tick early
+				assert.True(t, interval >= 230*time.Millisecond, "interval %v", interval)
+			} else {
+				// the executions overlap and the pace is kept
+				assert.Equal(t, 100*time.Millisecond, interval)
+			}
+		}
+		if !fixedDelay {
+			assert.True(t, atomic.LoadInt64(&executor.peak) > 1)
+		}
+	}
+}
+
+func TestPauseResumeAndCancelSchedule(t *testing.T) {
+	db := newTestMemoryDb()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db))
+	tk, err := queue.PushSchedule(Schedule{Id: "heartbeat", Interval: time.Hour}, notify.HTTP, "hello")
+	assert.Nil(t, err)
+	// the occurrences are found by the ids of their schedules
+	assert.Equal(t, tk.Id, queue.scheduled["heartbeat"][tk.Id].Id)
+
+	assert.Nil(t, queue.PauseSchedule("heartbeat"))
+	assert.Equal(t, 0, len(queue.scheduled))
+	assert.Nil(t, queue.GetTask(tk.Id))
+	assert.Equal(t, 0, len(db.GetList()))
+	paused := db.GetSchedule("heartbeat")
+	assert.Equal(t, tk.Id, paused.Id)
+	assert.True(t, paused.Schedule.Paused)
+	assert.NotNil(t, queue.PauseSchedule("heartbeat"))
+	assert.NotNil(t, queue.PauseSchedule("not-exist"))
+
+	// the pending occurrence keeps its due time
+	resumed, err := queue.ResumeSchedule("heartbeat")
+	assert.Nil(t, err)
+	assert.Equal(t, tk.Id, resumed.Id)
+	assert.True(t, tk.DueAt.Equal(resumed.DueAt))
+	assert.False(t, resumed.Schedule.Paused)
+	assert.NotNil(t, queue.GetTask(tk.Id))
+	assert.Equal(t, 1, len(queue.scheduled["heartbeat"]))
+	assert.Nil(t, db.GetSchedule("heartbeat"))
+	_, err = queue.ResumeSchedule("heartbeat")
+	assert.NotNil(t, err)
+
+	// the occurrences missed during the pause are skipped
+	assert.Nil(t, queue.PauseSchedule("heartbeat"))
+	paused = db.GetSchedule("heartbeat")
+	paused.DueAt = time.Now().Add(-3 * time.Hour)
+	db.SaveSchedule(paused)
+	resumed, _ = queue.ResumeSchedule("heartbeat")
+	assert.True(t, resumed.DueAt.After(time.Now().Add(59*time.Minute)))
+	assert.Equal(t, 1, resumed.Schedule.Occurrences)
+
+	assert.Nil(t, queue.CancelSchedule("heartbeat"))
+	assert.Nil(t, queue.GetTask(tk.Id))
+	assert.Equal(t, 0, len(queue.scheduled))
+	status, _ := queue.GetTaskStatus(tk.Id)
+	assert.Equal(t, TaskCancelled, status.State)
+	assert.NotNil(t, queue.CancelSchedule("heartbeat"))
+
+	// a paused schedule can be cancelled too
+	queue.PushSchedule(Schedule{Id: "heartbeat", Interval: time.Hour}, notify.HTTP, "hello")
+	assert.Nil(t, queue.PauseSchedule("heartbeat"))
+	assert.Nil(t, queue.CancelSchedule("heartbeat"))
+	assert.Nil(t, db.GetSchedule("heartbeat"))
+}
+
+func TestPauseRunningFixedDelaySchedule(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testBlockingNotify{started: make(chan string, 10), release: make(chan struct{})}
+	queue := testRetryQueue(executor, db, RetryPolicy{MaxAttempts: 1})
+	defer queue.Stop(context.Background())
+
+	_, err := queue.PushSchedule(Schedule{Id: "sync", Interval: 50 * time.Millisecond, FixedDelay: true}, notify.HTTP, "hello")
+	assert.Nil(t, err)
+	<-executor.started
+	assert.Nil(t, queue.PauseSchedule("sync"))
+	close(executor.release)
+
+	// the next occurrence is kept aside once the running one is done
+	assert.Eventually(t, func() bool { return db.GetSchedule("sync") != nil }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, db.GetSchedule("sync").Schedule.Occurrences)
+	assert.Equal(t, 0, len(db.GetList()))
+
+	_, err = queue.ResumeSchedule("sync")
+	assert.Nil(t, err)
+	<-executor.started
+	assert.Nil(t, queue.CancelSchedule("sync"))
+}
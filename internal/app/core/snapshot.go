@@ -0,0 +1,405 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// the version of the snapshot format which is written by Export,
+// the records of version 1 have no kind, they are all pending tasks
+const SNAPSHOT_VERSION = 2
+
+// the kinds of the records of a snapshot
+const (
+	// a task on the time wheel
+	snapshotPending = "pending"
+	// a task which is being executed, it is imported as a pending task so it is executed again
+	snapshotRunning = "running"
+	// a task of a chain which waits for its parent tasks
+	snapshotWaiting = "waiting"
+	// the pending occurrence of a paused schedule
+	snapshotPaused = "paused_schedule"
+	// a task which will not be executed any more
+	snapshotDeadLetter = "dead_letter"
+)
+
+// the first line of a snapshot, every following line is a record
+type snapshotHeader struct {
+	Version int `json:"version"`
+	// the tick of the time wheel and the time it corresponds to,
+	// the due times of the tasks without one are calculated from them
+	Pointer     int64         `json:"pointer"`
+	PointerTime time.Time     `json:"pointer_time"`
+	Tick        time.Duration `json:"tick"`
+	ExportedAt  time.Time     `json:"exported_at"`
+	// the number of the records
+	Tasks int `json:"tasks"`
+}
+
+// a task of a snapshot with the kind of its record
+type snapshotRecord struct {
+	Kind string `json:"kind,omitempty"`
+	*Task
+}
+
+func isSnapshotKind(kind string) bool {
+	switch kind {
+	case snapshotPending, snapshotRunning, snapshotWaiting, snapshotPaused, snapshotDeadLetter:
+		return true
+	default:
+		return false
+	}
+}
+
+// ImportConflict is what an import does with a task whose id is already pending
+type ImportConflict int
+
+const (
+	// keep the pending task and skip the imported one
+	ImportSkip ImportConflict = iota
+	// replace the pending task by the imported one
+	ImportOverwrite
+)
+
+// ImportOptions tells how the tasks of a snapshot are imported
+type ImportOptions struct {
+	Conflict ImportConflict
+	// shift the due times by the time passed since the export, so the tasks keep the delays they had then,
+	// such as to reproduce an issue locally. otherwise the tasks keep their due times.
+	Rebase bool
+}
+
+// ImportResult counts the tasks of an import
+type ImportResult struct {
+	Imported    int
+	Overwritten int
+	Skipped     int
+}
+
+// Export writes the tasks, the pointer of the time wheel and its time reference as JSON Lines, returns the number of exported tasks.
+// The pending and running tasks, the tasks of the chains waiting for their parents, the paused schedules
+// and the dead letters are exported.
+// A delay queue which is not started exports the tasks of its persistence, so they are not executed meanwhile.
+func (dq *DelayQueue) Export(w io.Writer) (int, error) {
+	header := snapshotHeader{Version: SNAPSHOT_VERSION, Tick: dq.tick, ExportedAt: dq.clock.Now()}
+	records := []snapshotRecord{}
+	// a task which is pending and in flight at once, such as after a crash, is exported once
+	exported := map[string]bool{}
+	add := func(kind string, tasks ...*Task) {
+		for _, task := range tasks {
+			if kind != snapshotDeadLetter {
+				if exported[task.Id] {
+					continue
+				}
+				exported[task.Id] = true
+			}
+			records = append(records, snapshotRecord{Kind: kind, Task: task})
+		}
+	}
+	if dq.IsReady() {
+		dq.mutex.RLock()
+		header.Pointer = dq.wheel.currentTick
+		header.PointerTime = dq.timeOfTick(dq.wheel.currentTick)
+		for _, task := range dq.TaskQueryTable {
+			add(snapshotPending, task.clone())
+		}
+		for _, task := range dq.running {
+			add(snapshotRunning, task.clone())
+		}
+		dq.mutex.RUnlock()
+	} else {
+		pointer, savedAt := dq.Persistence.GetWheelTimePointer()
+		header.Pointer = int64(pointer)
+		header.PointerTime = savedAt
+		add(snapshotPending, dq.Persistence.GetList()...)
+		add(snapshotRunning, dq.Persistence.GetInFlight()...)
+	}
+	// the persistence is scanned without holding the time wheel,
+	// a released child of a chain which is still saved as waiting is exported once as pending
+	dq.exportStored(add)
+	header.Tasks = len(records)
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(&header); err != nil {
+		return 0, err
+	}
+	for i := range records {
+		if err := encoder.Encode(&records[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(records), nil
+}
+
+// the records which are only kept by the persistence
+func (dq *DelayQueue) exportStored(add func(kind string, tasks ...*Task)) {
+	add(snapshotWaiting, dq.Persistence.GetWaitingList()...)
+	add(snapshotPaused, dq.Persistence.GetSchedules()...)
+	add(snapshotDeadLetter, dq.Persistence.GetDeadLetters()...)
+}
+
+// Import adds the tasks of a snapshot written by Export. The snapshot is read completely before any task is added,
+// a malformed snapshot adds nothing. The waiting tasks, the paused schedules and the dead letters are saved first,
+// then the pending tasks are persisted in one operation, the running tasks of the snapshot are pending again.
+// An imported task conflicts with the pending or waiting task with its id, and with the pending or paused occurrence
+// of its schedule, they are all replaced on overwrite. A task which is being executed is never replaced.
+// An overdue task is executed on the next tick.
+// A delay queue which is not started only persists the tasks, they are loaded when it starts.
+func (dq *DelayQueue) Import(r io.Reader, options ImportOptions) (*ImportResult, error) {
+	decoder := json.NewDecoder(r)
+	header := snapshotHeader{}
+	if err := decoder.Decode(&header); err != nil {
+		return nil, fmt.Errorf("invalid snapshot header: %v", err)
+	}
+	if header.Version < 1 || header.Version > SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+	records := []snapshotRecord{}
+	seen := map[string]bool{}
+	seenDeadLetters := map[string]bool{}
+	for {
+		record := snapshotRecord{Task: &Task{}}
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid task %d of the snapshot: %v", len(records)+1, err)
+		}
+		if record.Kind == "" {
+			record.Kind = snapshotPending
+		}
+		if !isSnapshotKind(record.Kind) {
+			return nil, fmt.Errorf("the task %d of the snapshot has an unknown kind %s", len(records)+1, record.Kind)
+		}
+		if record.Id == "" {
+			return nil, fmt.Errorf("the task %d of the snapshot has no id", len(records)+1)
+		}
+		if record.Kind == snapshotPaused && record.Schedule == nil {
+			return nil, fmt.Errorf("the paused schedule %s of the snapshot has no schedule", record.Id)
+		}
+		ids := seen
+		if record.Kind == snapshotDeadLetter {
+			ids = seenDeadLetters
+		}
+		if ids[record.Id] {
+			return nil, fmt.Errorf("the task %s appears twice in the snapshot", record.Id)
+		}
+		ids[record.Id] = true
+		records = append(records, record)
+	}
+
+	now := dq.clock.Now()
+	shift := time.Duration(0)
+	if options.Rebase && !header.ExportedAt.IsZero() {
+		shift = now.Sub(header.ExportedAt)
+	}
+	for _, record := range records {
+		task := record.Task
+		switch record.Kind {
+		case snapshotPending, snapshotRunning:
+			if task.DueAt.IsZero() {
+				// a task saved by an older version only has its tick
+				pointerTime := header.PointerTime
+				if pointerTime.IsZero() {
+					pointerTime = header.ExportedAt
+				}
+				task.DueAt = pointerTime.Add(time.Duration(task.DueTick-header.Pointer) * header.Tick)
+			}
+			task.DueAt = task.DueAt.Add(shift)
+			task.State = TaskPending
+			task.LeaseUntil = time.Time{}
+		case snapshotPaused:
+			task.DueAt = task.DueAt.Add(shift)
+		}
+	}
+
+	dq.mutex.Lock()
+	defer dq.mutex.Unlock()
+	ready := dq.IsReady()
+	pending := SlotRecorder{}
+	if ready {
+		pending = dq.TaskQueryTable
+	} else {
+		for _, task := range dq.Persistence.GetList() {
+			pending[task.Id] = task
+		}
+	}
+	// the pending occurrences by the ids of their schedules
+	occurrences := SlotRecorder{}
+	for _, task := range pending {
+		if task.Schedule != nil && task.isNextOccurrenceOf(task.Schedule.Id) {
+			occurrences[task.Schedule.Id] = task
+		}
+	}
+	running := SlotRecorder{}
+	for _, task := range dq.Persistence.GetInFlight() {
+		running[task.Id] = task
+	}
+	for _, task := range dq.running {
+		running[task.Id] = task
+	}
+	deadLetters := map[string]bool{}
+	for _, task := range dq.Persistence.GetDeadLetters() {
+		deadLetters[task.Id] = true
+	}
+
+	result := &ImportResult{}
+	imported := []*Task{}
+	// the ids of the imported tasks which replace pending tasks
+	updated := map[string]bool{}
+	stored := []snapshotRecord{}
+	// the records of the delay queue which are replaced
+	stale := []snapshotRecord{}
+	for _, record := range records {
+		conflicts := []snapshotRecord{}
+		if record.Kind == snapshotDeadLetter {
+			// the dead letter is replaced when the imported one is saved
+			if deadLetters[record.Id] {
+				conflicts = append(conflicts, record)
+			}
+		} else if _, ok := running[record.Id]; ok {
+			result.Skipped++
+			continue
+		} else {
+			conflicts = dq.importConflicts(record.Task, pending, occurrences)
+		}
+		if len(conflicts) > 0 {
+			if options.Conflict != ImportOverwrite {
+				result.Skipped++
+				continue
+			}
+			stale = append(stale, conflicts...)
+			result.Overwritten++
+		} else {
+			result.Imported++
+		}
+		if record.Kind == snapshotPending || record.Kind == snapshotRunning {
+			record.DueTick = dq.dueTickOf(record.DueAt)
+			imported = append(imported, record.Task)
+			if _, ok := pending[record.Id]; ok {
+				updated[record.Id] = true
+			}
+		} else {
+			stored = append(stored, record)
+		}
+	}
+
+	// the waiting tasks are saved first, so the children are there when a parent is due
+	for _, record := range stored {
+		if err := dq.saveImported(record); err != nil {
+			return nil, err
+		}
+	}
+	if err := dq.Persistence.SaveBatch(imported); err != nil {
+		return nil, err
+	}
+	dq.removeStale(stale, imported, stored, ready)
+	if !ready {
+		return result, nil
+	}
+	for _, task := range imported {
+		dq.wheel.add(task)
+		dq.TaskQueryTable[task.Id] = task
+		if task.Key != "" && dq.pendingByKey(task.Key) == nil {
+			dq.keyed[task.Key] = task
+		}
+		dq.rememberOccurrence(task)
+		if updated[task.Id] {
+			dq.emit(EventUpdate, task, nil, 0)
+		} else {
+			dq.emit(EventPush, task, nil, 0)
+		}
+	}
+	for _, record := range stored {
+		if record.Kind == snapshotWaiting {
+			dq.emit(EventPush, record.Task, nil, 0)
+		}
+	}
+	return result, nil
+}
+
+// the records of the delay queue an imported task conflicts with, the caller must hold the lock
+func (dq *DelayQueue) importConflicts(task *Task, pending SlotRecorder, occurrences SlotRecorder) []snapshotRecord {
+	conflicts := []snapshotRecord{}
+	if old, ok := pending[task.Id]; ok {
+		conflicts = append(conflicts, snapshotRecord{Kind: snapshotPending, Task: old})
+	}
+	if old := dq.Persistence.GetWaiting(task.Id); old != nil {
+		conflicts = append(conflicts, snapshotRecord{Kind: snapshotWaiting, Task: old})
+	}
+	if task.Schedule != nil && task.isNextOccurrenceOf(task.Schedule.Id) {
+		if old, ok := occurrences[task.Schedule.Id]; ok && old.Id != task.Id {
+			conflicts = append(conflicts, snapshotRecord{Kind: snapshotPending, Task: old})
+		}
+		if old := dq.Persistence.GetSchedule(task.Schedule.Id); old != nil {
+			conflicts = append(conflicts, snapshotRecord{Kind: snapshotPaused, Task: old})
+		}
+	}
+	return conflicts
+}
+
+// save an imported record which is not on the time wheel
+func (dq *DelayQueue) saveImported(record snapshotRecord) error {
+	switch record.Kind {
+	case snapshotWaiting:
+		return dq.Persistence.SaveWaiting(record.Task)
+	case snapshotPaused:
+		return dq.Persistence.SaveSchedule(record.Task)
+	default:
+		return dq.Persistence.SaveDeadLetter(record.Task)
+	}
+}
+
+// remove the records replaced by an import which have not been overwritten by the imported records with the same keys,
+// the caller must hold the lock
+func (dq *DelayQueue) removeStale(stale []snapshotRecord, imported []*Task, stored []snapshotRecord, ready bool) {
+	importedIds := map[string]bool{}
+	for _, task := range imported {
+		importedIds[task.Id] = true
+	}
+	storedKeys := map[string]bool{}
+	for _, record := range stored {
+		if record.Kind == snapshotPaused {
+			storedKeys[record.Kind+record.Schedule.Id] = true
+		} else {
+			storedKeys[record.Kind+record.Id] = true
+		}
+	}
+	removed := map[*Task]bool{}
+	for _, record := range stale {
+		old := record.Task
+		if removed[old] {
+			continue
+		}
+		removed[old] = true
+		var err error
+		switch record.Kind {
+		case snapshotPending:
+			if ready {
+				dq.wheel.remove(old)
+				dq.forgetKey(old)
+				dq.forgetOccurrence(old)
+				delete(dq.TaskQueryTable, old.Id)
+			}
+			if !importedIds[old.Id] {
+				err = dq.Persistence.Delete(old.Id)
+				if ready {
+					dq.emit(EventDelete, old, nil, 0)
+				}
+			}
+		case snapshotWaiting:
+			if !storedKeys[snapshotWaiting+old.Id] {
+				err = dq.Persistence.DeleteWaiting(old.Id)
+			}
+		case snapshotPaused:
+			if !storedKeys[snapshotPaused+old.Schedule.Id] {
+				err = dq.Persistence.DeleteSchedule(old.Schedule.Id)
+			}
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportAndImportSnapshot(t *testing.T) {
+	start := time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	source := testFakeClockQueue(fake, newTestMemoryDb(), make(chan string, 10))
+	defer source.Stop(context.Background())
+	source.Push(time.Hour, notify.HTTP, "a", WithTaskId("a"))
+	source.Push(2*time.Hour, notify.HTTP, "b", WithTaskId("b"), WithTag("tenant", "a"))
+	testAdvance(t, fake, 1, 10*time.Minute)
+
+	snapshot := &bytes.Buffer{}
+	exported, err := source.Export(snapshot)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, exported)
+	lines := strings.Split(strings.TrimSpace(snapshot.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	header := snapshotHeader{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &header))
+	assert.Equal(t, SNAPSHOT_VERSION, header.Version)
+	assert.Equal(t, 2, header.Tasks)
+	assert.Equal(t, start.Add(10*time.Minute), header.PointerTime)
+
+	executed := make(chan string, 10)
+	target := testFakeClockQueue(fake, newTestMemoryDb(), executed)
+	defer target.Stop(context.Background())
+	target.Push(5*time.Hour, notify.HTTP, "old", WithTaskId("a"))
+
+	result, err := target.Import(bytes.NewReader(snapshot.Bytes()), ImportOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, ImportResult{Imported: 1, Skipped: 1}, *result)
+	assert.Equal(t, "old", target.GetTask("a").TaskData)
+	assert.Equal(t, "a", target.GetTask("b").Tags["tenant"])
+
+	result, err = target.Import(bytes.NewReader(snapshot.Bytes()), ImportOptions{Conflict: ImportOverwrite})
+	assert.Nil(t, err)
+	assert.Equal(t, ImportResult{Overwritten: 2}, *result)
+	assert.Equal(t, 2, len(target.TaskQueryTable))
+	assert.Equal(t, 2, len(target.Persistence.GetList()))
+
+	// the tasks keep their due times
+	task := target.GetTask("a")
+	assert.Equal(t, "a", task.TaskData)
+	assert.Equal(t, start.Add(time.Hour), task.DueAt)
+	testAdvance(t, fake, 2, 50*time.Minute)
+	testAssertExecuted(t, executed, "a")
+	assert.NotNil(t, target.GetTask("b"))
+}
+
+func TestExportAndImportEveryKindOfTask(t *testing.T) {
+	start := time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	sourceDb := newTestMemoryDb()
+	source := testFakeClockQueue(fake, sourceDb, make(chan string, 10))
+	defer source.Stop(context.Background())
+	_, err := source.PushChain([]ChainTask{
+		{Id: "first", Delay: time.Hour, TaskMode: notify.HTTP, TaskData: "first"},
+		{Id: "second", Delay: time.Minute, TaskMode: notify.HTTP, TaskData: "second", DependsOn: []string{"first"}},
+	})
+	assert.Nil(t, err)
+	_, err = source.PushSchedule(Schedule{Id: "report", Interval: time.Hour}, notify.HTTP, "report")
+	assert.Nil(t, err)
+	assert.Nil(t, source.PauseSchedule("report"))
+	sourceDb.SaveDeadLetter(&Task{Id: "failed", TaskMode: notify.HTTP, TaskData: "failed", State: TaskDeadLettered, LastError: "service unavailable"})
+
+	snapshot := &bytes.Buffer{}
+	exported, err := source.Export(snapshot)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, exported)
+	kinds := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(snapshot.String()), "\n")[1:] {
+		record := snapshotRecord{Task: &Task{}}
+		assert.Nil(t, json.Unmarshal([]byte(line), &record))
+		kinds[record.Id] = record.Kind
+	}
+	assert.Equal(t, snapshotPending, kinds["first"])
+	assert.Equal(t, snapshotWaiting, kinds["second"])
+	assert.Equal(t, snapshotPaused, kinds[sourceDb.GetSchedule("report").Id])
+	assert.Equal(t, snapshotDeadLetter, kinds["failed"])
+
+	// the pending task with the id of the waiting one and the pending occurrence of the schedule are replaced
+	targetDb := newTestMemoryDb()
+	executed := make(chan string, 10)
+	target := testFakeClockQueue(fake, targetDb, executed)
+	defer target.Stop(context.Background())
+	target.Push(5*time.Hour, notify.HTTP, "old", WithTaskId("second"))
+	occurrence, err := target.PushSchedule(Schedule{Id: "report", Interval: 2 * time.Hour}, notify.HTTP, "old report")
+	assert.Nil(t, err)
+
+	result, err := target.Import(bytes.NewReader(snapshot.Bytes()), ImportOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, ImportResult{Imported: 2, Skipped: 2}, *result)
+	assert.Equal(t, "old", target.GetTask("second").TaskData)
+
+	result, err = target.Import(bytes.NewReader(snapshot.Bytes()), ImportOptions{Conflict: ImportOverwrite})
+	assert.Nil(t, err)
+	assert.Equal(t, ImportResult{Overwritten: 4}, *result)
+	assert.Nil(t, target.GetTask("second"))
+	assert.Nil(t, target.GetTask(occurrence.Id))
+	assert.Equal(t, 1, len(targetDb.GetList()))
+	assert.Equal(t, []string{"first"}, targetDb.GetWaiting("second").Parents)
+	assert.Equal(t, "report", targetDb.GetSchedule("report").TaskData)
+	assert.Equal(t, "service unavailable", targetDb.GetDeadLetters()[0].LastError)
+
+	// the chain goes on and the schedule resumes on the target
+	testAdvance(t, fake, 2, time.Hour)
+	testAssertExecuted(t, executed, "first")
+	assert.Eventually(t, func() bool { return target.GetTask("second") != nil }, 5*time.Second, time.Millisecond)
+	testAdvance(t, fake, 2, time.Minute)
+	testAssertExecuted(t, executed, "second")
+	resumed, err := target.ResumeSchedule("report")
+	assert.Nil(t, err)
+	assert.Equal(t, "report", resumed.TaskData)
+}
+
+func TestImportIntoStoppedQueue(t *testing.T) {
+	start := time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start.Add(time.Hour))
+	db := newTestMemoryDb()
+	queue := New(WithClock(fake), WithPersistence(db), WithTaskExecutor(testFactory))
+
+	// the task saved by an older version has no due time, it is due 60 ticks after the pointer
+	snapshot := `{"version":1,"pointer":100,"pointer_time":"2023-02-01T09:00:00Z","tick":1000000000,"exported_at":"2023-02-01T09:00:00Z","tasks":2}
+{"Id":"a","DueTick":160,"TaskMode":1,"TaskData":"a"}
+{"Id":"b","DueAt":"2023-02-01T10:00:00Z","TaskMode":1,"TaskData":"b","State":2,"LeaseUntil":"2023-02-01T09:30:00Z"}
+`
+	result, err := queue.Import(strings.NewReader(snapshot), ImportOptions{Rebase: true})
+	assert.Nil(t, err)
+	assert.Equal(t, ImportResult{Imported: 2}, *result)
+	// the tasks are only persisted and keep the delays they had at the export
+	assert.Equal(t, 0, len(queue.TaskQueryTable))
+	db.Lock()
+	assert.Equal(t, start.Add(time.Hour+time.Minute), db.tasks["a"].DueAt)
+	assert.Equal(t, start.Add(2*time.Hour), db.tasks["b"].DueAt)
+	assert.Equal(t, TaskPending, db.tasks["b"].State)
+	assert.True(t, db.tasks["b"].LeaseUntil.IsZero())
+	db.Unlock()
+
+	result, _ = queue.Import(strings.NewReader(snapshot), ImportOptions{})
+	assert.Equal(t, ImportResult{Skipped: 2}, *result)
+
+	// a queue which is not started exports its persistence
+	exported := &bytes.Buffer{}
+	count, err := queue.Export(exported)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+}
+
+// pushes a task while the waiting tasks are scanned
+type testPushingOnScanDb struct {
+	*testMemoryDb
+	queue *DelayQueue
+}
+
+func (td *testPushingOnScanDb) GetWaitingList() []*Task {
+	if td.queue != nil {
+		td.queue.Push(time.Hour, notify.HTTP, "pushed during the scan")
+	}
+	return td.testMemoryDb.GetWaitingList()
+}
+
+func TestExportDoesNotHoldTheTimeWheelWhileScanning(t *testing.T) {
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	db := &testPushingOnScanDb{testMemoryDb: newTestMemoryDb()}
+	queue := testFakeClockQueue(fake, db, make(chan string, 10))
+	queue.Push(time.Hour, notify.HTTP, "a")
+	db.queue = queue
+
+	exported := make(chan int, 1)
+	go func() {
+		count, err := queue.Export(&bytes.Buffer{})
+		assert.Nil(t, err)
+		exported <- count
+	}()
+	select {
+	case count := <-exported:
+		assert.Equal(t, 1, count)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the export holds the time wheel while the persistence is scanned")
+	}
+	assert.Equal(t, 2, len(db.GetList()))
+	assert.Nil(t, queue.Stop(context.Background()))
+}
+
+func TestImportInvalidSnapshot(t *testing.T) {
+	queue := New(WithPersistence(newTestMemoryDb()), WithTaskExecutor(testFactory))
+	task := `{"Id":"a","DueAt":"2023-02-01T10:00:00Z","TaskMode":1,"TaskData":"a"}` + "\n"
+	for _, snapshot := range []string{
+		"",
+		`{"version":3}` + "\n" + task,
+		`{"version":2}` + "\n" + `{"kind":"archived","Id":"a"}` + "\n",
+		`{"version":2}` + "\n" + `{"kind":"paused_schedule","Id":"a"}` + "\n",
+		`{"version":1}` + "\n" + task + "not json\n",
+		`{"version":1}` + "\n" + task + task,
+		`{"version":1}` + "\n" + `{"TaskData":"no id"}` + "\n",
+	} {
+		_, err := queue.Import(strings.NewReader(snapshot), ImportOptions{})
+		assert.NotNil(t, err, snapshot)
+	}
+	assert.Equal(t, 0, len(queue.Persistence.GetList()))
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// the default time the final state of a task is kept
+	DEFAULT_STATUS_RETENTION = 24 * time.Hour
+)
+
+// TaskState is the stage of the lifecycle of a task
+type TaskState uint
+
+const (
+	// the task waits on the time wheel for its due time
+	TaskPending TaskState = iota + 1
+	// the task is being executed
+	TaskRunning
+	// the task has been executed successfully
+	TaskSucceeded
+	// the last execution of the task failed, it waits on the time wheel for a retry
+	TaskFailed
+	// the task has been deleted before it was executed
+	TaskCancelled
+	// the task failed for good and has been moved to the dead letters
+	TaskDeadLettered
+	// the task waits for its parent tasks to succeed before it is added to the time wheel
+	TaskWaiting
+)
+
+func (ts TaskState) String() string {
+	switch ts {
+	case TaskPending:
+		return "pending"
+	case TaskRunning:
+		return "running"
+	case TaskSucceeded:
+		return "succeeded"
+	case TaskFailed:
+		return "failed"
+	case TaskCancelled:
+		return "cancelled"
+	case TaskDeadLettered:
+		return "dead-lettered"
+	case TaskWaiting:
+		return "waiting"
+	default:
+		return "unknown"
+	}
+}
+
+// whether the task will not be executed any more
+func (ts TaskState) IsFinal() bool {
+	return ts == TaskSucceeded || ts == TaskCancelled || ts == TaskDeadLettered
+}
+
+// GetTaskStatus returns a snapshot of a task with its lifecycle state,
+// the tasks which reached a final state are kept for the status retention of the delay queue.
+func (dq *DelayQueue) GetTaskStatus(taskId string) (*Task, error) {
+	dq.mutex.RLock()
+	defer dq.mutex.RUnlock()
+	if task := dq.lookupTask(taskId); task != nil {
+		return task, nil
+	}
+	return nil, ErrTaskNotFound
+}
+
+// a copy of a pending, running or finished task, nil if it is unknown,
+// the caller must hold the lock
+func (dq *DelayQueue) lookupTask(taskId string) *Task {
+	if task, ok := dq.TaskQueryTable[taskId]; ok {
+		return task.clone()
+	}
+	if task, ok := dq.running[taskId]; ok {
+		return task.clone()
+	}
+	if task := dq.Persistence.GetWaiting(taskId); task != nil {
+		return task
+	}
+	return dq.Persistence.GetStatus(taskId)
+}
+
+// record the final state of a task and settle its child tasks, the caller must hold the lock
+func (dq *DelayQueue) finish(task *Task, state TaskState) {
+	task.State = state
+	task.FinishedAt = dq.clock.Now()
+	if dq.statusRetention > 0 {
+		if err := dq.Persistence.SaveStatus(task, dq.statusRetention); err != nil {
+			log.Println(err)
+		}
+	}
+	if len(task.Children) > 0 {
+		dq.settleChildren(task)
+	}
+}
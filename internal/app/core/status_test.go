@@ -0,0 +1,81 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+func testTaskState(queue *DelayQueue, taskId string) TaskState {
+	task, err := queue.GetTaskStatus(taskId)
+	if err != nil {
+		return TaskState(0)
+	}
+	return task.State
+}
+
+func TestTaskLifecycle(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testBlockingNotify{started: make(chan string, 1), release: make(chan struct{})}
+	queue := New(WithTaskExecutor(func(taskMode notify.NotifyMode) notify.Executor { return executor }), WithPersistence(db), WithTick(10*time.Millisecond))
+	queue.Start()
+	defer queue.Stop(context.Background())
+
+	_, err := queue.GetTaskStatus("not-exist")
+	assert.NotNil(t, err)
+
+	tk, _ := queue.Push(30*time.Millisecond, notify.HTTP, "hello")
+	assert.Equal(t, TaskPending, tk.State)
+	assert.Equal(t, TaskPending, testTaskState(queue, tk.Id))
+
+	assert.Equal(t, "hello", <-executor.started)
+	assert.Equal(t, TaskRunning, testTaskState(queue, tk.Id))
+
+	close(executor.release)
+	assert.Eventually(t, func() bool { return testTaskState(queue, tk.Id) == TaskSucceeded }, time.Second, 5*time.Millisecond)
+	task, _ := queue.GetTaskStatus(tk.Id)
+	assert.False(t, task.FinishedAt.IsZero())
+	assert.Nil(t, queue.GetTask(tk.Id))
+
+	tk, _ = queue.Push(time.Hour, notify.HTTP, "later")
+	assert.Nil(t, queue.DeleteTask(tk.Id))
+	assert.Equal(t, TaskCancelled, testTaskState(queue, tk.Id))
+}
+
+func TestFailedTaskLifecycle(t *testing.T) {
+	db := newTestMemoryDb()
+	executor := &testFlakyNotify{failTimes: 100, err: errors.New("service unavailable")}
+	queue := testRetryQueue(executor, db, RetryPolicy{MaxAttempts: 2, InitialBackoff: 50 * time.Millisecond})
+	defer queue.Stop(context.Background())
+
+	tk, _ := queue.Push(10*time.Millisecond, notify.HTTP, "hello")
+	assert.Eventually(t, func() bool { return testTaskState(queue, tk.Id) == TaskFailed }, time.Second, 5*time.Millisecond)
+	// the state is persisted with the task
+	db.Lock()
+	assert.Equal(t, TaskFailed, db.tasks[tk.Id].State)
+	db.Unlock()
+
+	assert.Eventually(t, func() bool { return testTaskState(queue, tk.Id) == TaskDeadLettered }, time.Second, 5*time.Millisecond)
+	task, _ := queue.GetTaskStatus(tk.Id)
+	assert.Equal(t, 2, task.Attempts)
+	assert.Equal(t, "service unavailable", task.LastError)
+
+	// a replayed dead letter is pending again
+	queue.ReplayDeadLetter(tk.Id)
+	assert.Equal(t, TaskPending, testTaskState(queue, tk.Id))
+}
+
+func TestStatusRetention(t *testing.T) {
+	db := newTestMemoryDb()
+	testBeforeSetUp()
+	queue := New(WithTaskExecutor(testFactory), WithPersistence(db), WithStatusRetention(0))
+	tk, _ := queue.Push(time.Hour, notify.HTTP, "later")
+	queue.DeleteTask(tk.Id)
+	_, err := queue.GetTaskStatus(tk.Id)
+	assert.NotNil(t, err)
+	assert.Nil(t, db.GetStatus(tk.Id))
+}
@@ -2,26 +2,89 @@ package core
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/raymondmars/go-delayqueue/internal/app/notify"
 )
 
 type Task struct {
 	Id string
-	// the number of cycles of the task on the time wheel,
-	// when it is equal to 0, the task is executed
-	CycleCount int
-	// the position of the task on the time wheel
-	WheelPosition int
+	// the time the task was pushed
+	CreatedAt time.Time
+	// the time at which the task is due
+	DueAt time.Time
+	// the absolute tick of the time wheel on which the task is executed, it is the tick nearest to DueAt
+	DueTick int64
+	// the cycles and the slot of a task saved by the single time wheel of the older versions,
+	// they are only read to load such a task
+	CycleCount     int `json:",omitempty"`
+	LegacyPosition int `json:"WheelPosition,omitempty"`
+	// the level of the time wheel the task is currently on
+	WheelLevel int `json:"-"`
+	// the position of the task on its level of the time wheel
+	WheelPosition int `json:"-"`
 	// the task mode,
 	// which is used by the factory method to determine which implementation object to use
 	TaskMode notify.NotifyMode
 	// task method parameters
 	TaskData string
+	// the key/value pairs attached to the task, such as tenant, order_id or source service
+	Tags map[string]string `json:",omitempty"`
+	// the key supplied by the client, a push with the same key returns this task instead of adding another one
+	IdempotencyKey string `json:",omitempty"`
+	// the parent tasks of a task of a chain which have not succeeded yet
+	Parents []string `json:",omitempty"`
+	// the tasks of a chain which wait for the task to succeed
+	Children []string `json:",omitempty"`
+	// the delay of a task of a chain from the time its last parent succeeded
+	DelayAfterParents time.Duration `json:",omitempty"`
+	// the logical key of a debounced or throttled task, at most one task with the key is pending
+	Key     string  `json:",omitempty"`
+	KeyMode KeyMode `json:",omitempty"`
+	// the number of failed executions
+	Attempts int
+	// the error of the last failed execution
+	LastError string `json:",omitempty"`
+	// the time of the last failed execution
+	LastAttemptAt time.Time
+	// the time the task was moved to the dead letters
+	DeadLetteredAt time.Time
+	// the deadline of the lease of an execution in flight,
+	// the task is put back to the time wheel if it is not done by then
+	LeaseUntil time.Time
+	// the stage of the lifecycle of the task
+	State TaskState
+	// the time the task reached a final state
+	FinishedAt time.Time
+	// the schedule of a recurring task, it is nil for a one-shot task
+	Schedule *Schedule `json:",omitempty"`
+	// the retry policy of the task, the default policy of the delay queue is used when it is nil
+	RetryPolicy *RetryPolicy `json:",omitempty"`
 
-	Next *Task
+	Next *Task `json:"-"`
+	prev *Task
 }
 
 func (t *Task) String() string {
-	return fmt.Sprintf("%s %d %d %d %s", t.Id, t.CycleCount, t.WheelPosition, t.TaskMode, t.TaskData)
+	return fmt.Sprintf("%s %d %d %s", t.Id, t.DueTick, t.TaskMode, t.TaskData)
+}
+
+// a copy of the task which is not linked in the time wheel
+func (t *Task) clone() *Task {
+	task := *t
+	task.Next = nil
+	task.prev = nil
+	if t.Tags != nil {
+		task.Tags = make(map[string]string, len(t.Tags))
+		for key, value := range t.Tags {
+			task.Tags[key] = value
+		}
+	}
+	if t.Parents != nil {
+		task.Parents = append([]string{}, t.Parents...)
+	}
+	if t.Children != nil {
+		task.Children = append([]string{}, t.Children...)
+	}
+	return &task
 }
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"log"
+	"time"
+)
+
+// Drive the time wheel by the clock of the delay queue.
+// The time of every tick is calculated from the reference time instead of waiting one tick after another,
+// so slow slots, GC pauses or persistence calls do not add up to a drift,
+// and when the loop falls behind, every missed tick is processed in order.
+func (dq *DelayQueue) runTimeWheel() {
+	defer dq.workers.Done()
+	for {
+		dq.mutex.RLock()
+		next := dq.timeOfTick(dq.wheel.currentTick + 1)
+		dq.mutex.RUnlock()
+
+		if wait := next.Sub(dq.clock.Now()); wait > 0 {
+			timer := dq.clock.NewTimer(wait)
+			select {
+			case <-timer.C():
+			case <-dq.stopped:
+				timer.Stop()
+				return
+			}
+		}
+		select {
+		case <-dq.stopped:
+			return
+		default:
+		}
+		if missed := dq.catchUp(dq.clock.Now()) - 1; missed > 0 {
+			log.Printf("time wheel caught up %d missed ticks\n", missed)
+		}
+	}
+}
+
+// process every tick that is due by the given time, returns the number of processed ticks
+func (dq *DelayQueue) catchUp(now time.Time) int {
+	processed := 0
+	for {
+		dq.mutex.Lock()
+		if dq.wheel.currentTick >= dq.elapsedTickOf(now) {
+			dq.mutex.Unlock()
+			return processed
+		}
+		dueTasks := dq.wheel.advance()
+		for _, task := range dueTasks {
+			// remove task from query table
+			delete(dq.TaskQueryTable, task.Id)
+			dq.forgetKey(task)
+			dq.forgetOccurrence(task)
+			dq.running[task.Id] = task
+			dq.emit(EventDue, task, nil, now.Sub(task.DueAt))
+		}
+		dq.mutex.Unlock()
+
+		for _, task := range dueTasks {
+			// Hand the tasks to the worker pool, so the time wheel is not slowed down by the notifications,
+			// and a burst of due tasks does not overwhelm the downstream services.
+			// When the pending buffer is full the time wheel waits, the lag shows it.
+			// If there is an exception in the task, the task is added back to the queue
+			// according to its retry policy, the delay queue does not handle the specific business exception.
+			// This can ensure the business simplicity of the delay queue and avoid problems that are difficult to maintain.
+			dq.executions.Add(1)
+			if !dq.pool.submit(task, dq.stopped) {
+				// the task is still persisted, it is loaded again on the next start
+				dq.executions.Done()
+				dq.mutex.Lock()
+				delete(dq.running, task.Id)
+				dq.mutex.Unlock()
+			}
+		}
+		processed++
+	}
+}
+
+// Lag returns how far the time wheel is behind the wall clock,
+// it is zero when every tick has been processed on time.
+func (dq *DelayQueue) Lag() time.Duration {
+	if !dq.IsReady() {
+		return 0
+	}
+	dq.mutex.RLock()
+	next := dq.timeOfTick(dq.wheel.currentTick + 1)
+	dq.mutex.RUnlock()
+
+	if lag := dq.clock.Now().Sub(next); lag > 0 {
+		return lag
+	}
+	return 0
+}
+
+// round the delay to the nearest number of ticks
+func (dq *DelayQueue) delayToTicks(delay time.Duration) int64 {
+	return int64((delay + dq.tick/2) / dq.tick)
+}
+
+// the wall clock time at which a tick is due
+func (dq *DelayQueue) timeOfTick(tick int64) time.Time {
+	return dq.refTime.Add(time.Duration(tick-dq.refTick) * dq.tick)
+}
+
+// the tick nearest to the given time
+func (dq *DelayQueue) dueTickOf(t time.Time) int64 {
+	return dq.refTick + dq.delayToTicks(t.Sub(dq.refTime))
+}
+
+// the latest tick which has started by the given time
+func (dq *DelayQueue) elapsedTickOf(t time.Time) int64 {
+	return dq.refTick + int64(t.Sub(dq.refTime)/dq.tick)
+}
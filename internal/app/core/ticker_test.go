@@ -0,0 +1,57 @@
+package core
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatchUpMissedTicks(t *testing.T) {
+	testBeforeSetUp()
+	tk1, _ := dq.Push(1*time.Second, notify.HTTP, "hello1")
+	tk2, _ := dq.Push(3*time.Second, notify.HTTP, "hello2")
+	tk3, _ := dq.Push(8*time.Second, notify.HTTP, "hello3")
+
+	// nothing is due yet
+	assert.Equal(t, 0, dq.catchUp(dq.refTime.Add(500*time.Millisecond)))
+	assert.Equal(t, int64(0), dq.wheel.currentTick)
+
+	// the loop fell behind 5 ticks
+	assert.Equal(t, 5, dq.catchUp(dq.refTime.Add(5*time.Second+100*time.Millisecond)))
+	assert.Equal(t, int64(5), dq.wheel.currentTick)
+	assert.Nil(t, dq.GetTask(tk1.Id))
+	assert.Nil(t, dq.GetTask(tk2.Id))
+	assert.NotNil(t, dq.GetTask(tk3.Id))
+
+	assert.Equal(t, 3, dq.catchUp(dq.refTime.Add(8*time.Second)))
+	assert.Nil(t, dq.GetTask(tk3.Id))
+}
+
+func TestPushWhileLagging(t *testing.T) {
+	testBeforeSetUp()
+	// the time wheel is 10 ticks behind the wall clock
+	dq.refTime = time.Now().Add(-10 * time.Second)
+	tk, _ := dq.Push(5*time.Second, notify.HTTP, "hello")
+	// the due tick follows the wall clock, not the lagging pointer
+	assert.Equal(t, int64(15), tk.DueTick)
+
+	tk, _ = dq.PushAt(time.Now().Add(3*time.Second), notify.HTTP, "hello")
+	assert.Equal(t, int64(13), tk.DueTick)
+}
+
+func TestLag(t *testing.T) {
+	testBeforeSetUp()
+	assert.Equal(t, time.Duration(0), dq.Lag())
+
+	atomic.StoreInt32(&dq.ready, 1)
+	assert.Equal(t, time.Duration(0), dq.Lag())
+
+	dq.refTime = time.Now().Add(-3 * time.Second)
+	assert.InDelta(t, float64(2*time.Second), float64(dq.Lag()), float64(100*time.Millisecond))
+
+	dq.catchUp(time.Now())
+	assert.Equal(t, time.Duration(0), dq.Lag())
+}
@@ -0,0 +1,148 @@
+package core
+
+// wheelLevel is one level of the hierarchical time wheel
+type wheelLevel struct {
+	slots []wheel
+	// the number of ticks covered by one slot of this level
+	span int64
+	// the number of ticks covered by a full round of this level
+	interval int64
+}
+
+// timingWheel is a hierarchical time wheel.
+// Level 0 moves forward one slot on every tick, and every slot of level n
+// covers a full round of level n-1, with the default sizes the levels are
+// seconds, minutes, hours and days.
+// A task is always kept on the lowest level whose round still covers its due tick,
+// when the slot holding it is reached the task is moved down a level (cascade),
+// so a tick only walks the tasks that are actually due.
+type timingWheel struct {
+	levels []*wheelLevel
+	// the most recent tick that has been processed
+	currentTick int64
+}
+
+func newTimingWheel(sizes ...int) *timingWheel {
+	tw := &timingWheel{}
+	span := int64(1)
+	for _, size := range sizes {
+		tw.levels = append(tw.levels, &wheelLevel{
+			slots:    make([]wheel, size),
+			span:     span,
+			interval: span * int64(size),
+		})
+		span = span * int64(size)
+	}
+	return tw
+}
+
+// add a task to the level and slot that matches its due tick,
+// a task that is already due will be executed on the next tick.
+func (tw *timingWheel) add(task *Task) {
+	if task.DueTick <= tw.currentTick {
+		task.DueTick = tw.currentTick + 1
+	}
+	tw.place(task)
+}
+
+func (tw *timingWheel) place(task *Task) {
+	delay := task.DueTick - tw.currentTick
+	level := len(tw.levels) - 1
+	for i, lv := range tw.levels {
+		if delay < lv.interval {
+			level = i
+			break
+		}
+	}
+	// tasks beyond the top level round stay on the top level,
+	// they are checked again every time their slot comes around
+	lv := tw.levels[level]
+	index := int((task.DueTick / lv.span) % int64(len(lv.slots)))
+
+	task.WheelLevel = level
+	task.WheelPosition = index
+	// Insert a new task into the head of the linked list.
+	// Since there is no order relationship between tasks,
+	// this implementation is the easiest
+	head := lv.slots[index].NotifyTasks
+	task.prev = nil
+	task.Next = head
+	if head != nil {
+		head.prev = task
+	}
+	lv.slots[index].NotifyTasks = task
+}
+
+// remove a task from the slot it is linked in
+func (tw *timingWheel) remove(task *Task) {
+	slot := &tw.levels[task.WheelLevel].slots[task.WheelPosition]
+	if task.prev != nil {
+		task.prev.Next = task.Next
+	} else if slot.NotifyTasks == task {
+		slot.NotifyTasks = task.Next
+	} else {
+		// not linked in the wheel
+		return
+	}
+	if task.Next != nil {
+		task.Next.prev = task.prev
+	}
+	task.Next = nil
+	task.prev = nil
+}
+
+// move the pointer forward one tick and return the tasks which are due
+func (tw *timingWheel) advance() []*Task {
+	tw.currentTick++
+	tick := tw.currentTick
+
+	// cascade from the top level, so tasks can fall through several levels in one tick
+	for i := len(tw.levels) - 1; i > 0; i-- {
+		lv := tw.levels[i]
+		if tick%lv.span != 0 {
+			continue
+		}
+		for p := lv.detach(int((tick / lv.span) % int64(len(lv.slots)))); p != nil; {
+			next := p.Next
+			p.Next = nil
+			p.prev = nil
+			tw.place(p)
+			p = next
+		}
+	}
+
+	lv := tw.levels[0]
+	dueTasks := []*Task{}
+	for p := lv.detach(int(tick % int64(len(lv.slots)))); p != nil; {
+		next := p.Next
+		p.Next = nil
+		p.prev = nil
+		dueTasks = append(dueTasks, p)
+		p = next
+	}
+	return dueTasks
+}
+
+// the number of tasks on a slot of a level
+func (tw *timingWheel) quantity(level, index int) int {
+	k := 0
+	for p := tw.levels[level].slots[index].NotifyTasks; p != nil; p = p.Next {
+		k++
+	}
+	return k
+}
+
+func (tw *timingWheel) clear() {
+	for _, lv := range tw.levels {
+		for i := 0; i < len(lv.slots); i++ {
+			lv.slots[i].NotifyTasks = nil
+		}
+	}
+}
+
+// take the whole linked list off a slot
+func (lv *wheelLevel) detach(index int) *Task {
+	head := lv.slots[index].NotifyTasks
+	lv.slots[index].NotifyTasks = nil
+	return head
+}
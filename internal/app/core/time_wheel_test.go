@@ -0,0 +1,106 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimingWheelPlaceTaskOnLevels(t *testing.T) {
+	tw := newTimingWheel(SECONDS_WHEEL_SIZE, MINUTES_WHEEL_SIZE, HOURS_WHEEL_SIZE, DAYS_WHEEL_SIZE)
+	cases := []struct {
+		dueTick  int64
+		level    int
+		position int
+	}{
+		{1, 0, 1},
+		{59, 0, 59},
+		{60, 1, 1},
+		{3599, 1, 59},
+		{3600, 2, 1},
+		{86399, 2, 23},
+		{86400, 3, 1},
+		{86400 * 400, 3, 35},
+	}
+	for _, c := range cases {
+		task := &Task{DueTick: c.dueTick}
+		tw.add(task)
+		assert.Equal(t, c.level, task.WheelLevel, "due tick %d", c.dueTick)
+		assert.Equal(t, c.position, task.WheelPosition, "due tick %d", c.dueTick)
+	}
+}
+
+func TestTimingWheelCascade(t *testing.T) {
+	tw := newTimingWheel(SECONDS_WHEEL_SIZE, MINUTES_WHEEL_SIZE, HOURS_WHEEL_SIZE, DAYS_WHEEL_SIZE)
+	task := &Task{Id: "1", DueTick: 3725}
+	tw.add(task)
+	assert.Equal(t, 2, task.WheelLevel)
+
+	for tw.currentTick < 3600 {
+		assert.Empty(t, tw.advance())
+	}
+	// moved down to the minutes level
+	assert.Equal(t, 1, task.WheelLevel)
+	assert.Equal(t, 2, task.WheelPosition)
+
+	for tw.currentTick < 3720 {
+		assert.Empty(t, tw.advance())
+	}
+	// moved down to the seconds level
+	assert.Equal(t, 0, task.WheelLevel)
+	assert.Equal(t, 5, task.WheelPosition)
+
+	for tw.currentTick < 3724 {
+		assert.Empty(t, tw.advance())
+	}
+	dueTasks := tw.advance()
+	assert.Equal(t, 1, len(dueTasks))
+	assert.Equal(t, "1", dueTasks[0].Id)
+}
+
+func TestTimingWheelExecuteOnDueTick(t *testing.T) {
+	tw := newTimingWheel(4, 3, 2)
+	tw.currentTick = 7
+	dueTicks := map[int64]bool{}
+	// include ticks beyond the round of the top level
+	for _, dueTick := range []int64{8, 11, 12, 19, 24, 31, 32, 100, 101} {
+		tw.add(&Task{DueTick: dueTick})
+		dueTicks[dueTick] = true
+	}
+
+	executed := 0
+	for tw.currentTick < 200 {
+		for _, task := range tw.advance() {
+			assert.Equal(t, tw.currentTick, task.DueTick)
+			assert.True(t, dueTicks[task.DueTick])
+			executed++
+		}
+	}
+	assert.Equal(t, len(dueTicks), executed)
+}
+
+func TestTimingWheelRemove(t *testing.T) {
+	tw := newTimingWheel(SECONDS_WHEEL_SIZE, MINUTES_WHEEL_SIZE)
+	tk1 := &Task{Id: "1", DueTick: 10}
+	tk2 := &Task{Id: "2", DueTick: 10}
+	tk3 := &Task{Id: "3", DueTick: 10}
+	tw.add(tk1)
+	tw.add(tk2)
+	tw.add(tk3)
+	assert.Equal(t, 3, tw.quantity(0, 10))
+
+	tw.remove(tk2)
+	assert.Equal(t, 2, tw.quantity(0, 10))
+	tw.remove(tk3)
+	tw.remove(tk3)
+	assert.Equal(t, 1, tw.quantity(0, 10))
+	tw.remove(tk1)
+	assert.Equal(t, 0, tw.quantity(0, 10))
+
+	// a task which is already due is executed on the next tick
+	tk4 := &Task{Id: "4", DueTick: 0}
+	tw.add(tk4)
+	dueTasks := tw.advance()
+	assert.Equal(t, 1, len(dueTasks))
+	assert.Equal(t, "4", dueTasks[0].Id)
+}
@@ -0,0 +1,223 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/raymondmars/go-delayqueue/internal/app/core"
+	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+)
+
+// an item of the push batch message
+type pushItemMessage struct {
+	// seconds or a duration such as 10m, it is not used if due_at is set
+	Delay string `json:"delay"`
+	// a unix timestamp in seconds or a RFC3339 time
+	DueAt          string            `json:"due_at"`
+	Mode           int               `json:"mode"`
+	Target         string            `json:"target"`
+	Data           string            `json:"data"`
+	Tags           map[string]string `json:"tags"`
+	Id             string            `json:"id"`
+	IdempotencyKey string            `json:"idempotency_key"`
+	Debounce       string            `json:"debounce"`
+	Throttle       string            `json:"throttle"`
+}
+
+// an item of the update batch message
+type updateItemMessage struct {
+	Id     string `json:"id"`
+	Mode   int    `json:"mode"`
+	Target string `json:"target"`
+	Data   string `json:"data"`
+}
+
+// the result of an item of a batch command, the id of its task or its error
+type batchItemResult struct {
+	Id      string          `json:"id,omitempty"`
+	Code    ResponseErrCode `json:"code,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+func (m *pushItemMessage) pushItem() (core.PushItem, ResponseErrCode, error) {
+	item := core.PushItem{TaskData: fmt.Sprintf("%s|%s", m.Target, m.Data)}
+	item.TaskMode = notify.NotifyMode(m.Mode)
+	if item.TaskMode != notify.HTTP && item.TaskMode != notify.SubPub {
+		return item, INVALID_PUSH_MESSAGE, errors.New("Invalid notify way.")
+	}
+	if m.DueAt != "" {
+		dueAt, err := parseDueTime(m.DueAt)
+		if err != nil {
+			return item, INVALID_DELAY_TIME, err
+		}
+		item.DueAt = dueAt
+	} else if item.Delay = parseDelay(m.Delay); item.Delay <= 0 {
+		return item, INVALID_DELAY_TIME, errors.New("Invalid delay.")
+	}
+	if m.Debounce != "" && m.Throttle != "" {
+		return item, INVALID_PUSH_MESSAGE, errors.New("Only one of debounce and throttle can be set.")
+	}
+	if len(m.Tags) > 0 {
+		item.Options = append(item.Options, core.WithTags(m.Tags))
+	}
+	if m.Id != "" {
+		item.Options = append(item.Options, core.WithTaskId(m.Id))
+	}
+	if m.IdempotencyKey != "" {
+		item.Options = append(item.Options, core.WithIdempotencyKey(m.IdempotencyKey))
+	}
+	if m.Debounce != "" {
+		item.Options = append(item.Options, core.WithDebounce(m.Debounce))
+	}
+	if m.Throttle != "" {
+		item.Options = append(item.Options, core.WithThrottle(m.Throttle))
+	}
+	return item, 0, nil
+}
+
+// parse the json array of a batch command
+func parseBatch(value string, items interface{}) error {
+	if err := json.Unmarshal([]byte(strings.TrimSpace(value)), items); err != nil {
+		return errors.New("Invalid batch.")
+	}
+	return nil
+}
+
+func batchTooLarge(size int) *Response {
+	if size <= MAX_BATCH_SIZE {
+		return nil
+	}
+	return &Response{
+		Status:    Fail,
+		ErrorCode: INVALID_MESSAGE,
+		Message:   fmt.Sprintf("The batch has more than %d items.", MAX_BATCH_SIZE),
+	}
+}
+
+func batchItemResultOf(result core.BatchResult, errorCode ResponseErrCode) batchItemResult {
+	if result.Err == nil {
+		return batchItemResult{Id: result.Id}
+	}
+	if errors.Is(result.Err, core.ErrTaskNotFound) {
+		errorCode = TASK_NOT_FOUND
+	}
+	return batchItemResult{Code: errorCode, Message: result.Err.Error()}
+}
+
+func batchResponse(results []batchItemResult) *Response {
+	result, _ := json.Marshal(results)
+	return &Response{
+		Status:  Ok,
+		Message: string(result),
+	}
+}
+
+func (p *processor) pushBatch(queue *core.DelayQueue, value string) *Response {
+	messages := []pushItemMessage{}
+	if err := parseBatch(value, &messages); err != nil {
+		return &Response{
+			Status:    Fail,
+			ErrorCode: INVALID_PUSH_MESSAGE,
+			Message:   err.Error(),
+		}
+	}
+	if resp := batchTooLarge(len(messages)); resp != nil {
+		return resp
+	}
+	results := make([]batchItemResult, len(messages))
+	items := []core.PushItem{}
+	// the positions of the valid items in the batch
+	positions := []int{}
+	for i, message := range messages {
+		item, errorCode, err := message.pushItem()
+		if err != nil {
+			results[i] = batchItemResult{Code: errorCode, Message: err.Error()}
+			continue
+		}
+		items = append(items, item)
+		positions = append(positions, i)
+	}
+	pushed, err := queue.PushBatch(items)
+	if err != nil {
+		return &Response{
+			Status:    Fail,
+			ErrorCode: PUSH_FAILED,
+			Message:   err.Error(),
+		}
+	}
+	for i, result := range pushed {
+		results[positions[i]] = batchItemResultOf(result, PUSH_FAILED)
+	}
+	return batchResponse(results)
+}
+
+func (p *processor) updateBatch(queue *core.DelayQueue, value string) *Response {
+	messages := []updateItemMessage{}
+	if err := parseBatch(value, &messages); err != nil {
+		return &Response{
+			Status:    Fail,
+			ErrorCode: INVALID_MESSAGE,
+			Message:   err.Error(),
+		}
+	}
+	if resp := batchTooLarge(len(messages)); resp != nil {
+		return resp
+	}
+	results := make([]batchItemResult, len(messages))
+	items := []core.UpdateItem{}
+	positions := []int{}
+	for i, message := range messages {
+		mode := notify.NotifyMode(message.Mode)
+		if mode != notify.HTTP && mode != notify.SubPub {
+			results[i] = batchItemResult{Code: INVALID_MESSAGE, Message: "Invalid notify way."}
+			continue
+		}
+		items = append(items, core.UpdateItem{
+			TaskId:   strings.TrimSpace(message.Id),
+			TaskMode: mode,
+			TaskData: fmt.Sprintf("%s|%s", message.Target, message.Data),
+		})
+		positions = append(positions, i)
+	}
+	updated, err := queue.UpdateBatch(items)
+	if err != nil {
+		return &Response{
+			Status:    Fail,
+			ErrorCode: UPDATE_FAILED,
+			Message:   err.Error(),
+		}
+	}
+	for i, result := range updated {
+		results[positions[i]] = batchItemResultOf(result, UPDATE_FAILED)
+	}
+	return batchResponse(results)
+}
+
+func (p *processor) deleteBatch(queue *core.DelayQueue, value string) *Response {
+	taskIds := []string{}
+	if err := parseBatch(value, &taskIds); err != nil {
+		return &Response{
+			Status:    Fail,
+			ErrorCode: INVALID_MESSAGE,
+			Message:   err.Error(),
+		}
+	}
+	if resp := batchTooLarge(len(taskIds)); resp != nil {
+		return resp
+	}
+	deleted, err := queue.DeleteBatch(taskIds)
+	if err != nil {
+		return &Response{
+			Status:    Fail,
+			ErrorCode: DELETE_FAILED,
+			Message:   err.Error(),
+		}
+	}
+	results := make([]batchItemResult, len(deleted))
+	for i, result := range deleted {
+		results[i] = batchItemResultOf(result, DELETE_FAILED)
+	}
+	return batchResponse(results)
+}
@@ -7,4 +7,21 @@ const (
 	Push
 	Update
 	Delete
+	PushAt
+	ListDeadLetters
+	ReplayDeadLetters
+	PurgeDeadLetters
+	Stats
+	TaskStatus
+	ListTasks
+	Reschedule
+	RescheduleAt
+	PushSchedule
+	PauseSchedule
+	ResumeSchedule
+	CancelSchedule
+	PushChain
+	PushBatch
+	UpdateBatch
+	DeleteBatch
 )
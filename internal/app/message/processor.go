@@ -1,7 +1,10 @@
 package message
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -30,8 +33,17 @@ const (
 	INVALID_PUSH_MESSAGE ResponseErrCode = 1018
 	UPDATE_FAILED        ResponseErrCode = 1020
 	DELETE_FAILED        ResponseErrCode = 1022
+	DEAD_LETTER_FAILED   ResponseErrCode = 1024
+	TASK_NOT_FOUND       ResponseErrCode = 1026
+	LIST_FAILED          ResponseErrCode = 1028
+	RESCHEDULE_FAILED    ResponseErrCode = 1030
+	SCHEDULE_FAILED      ResponseErrCode = 1032
+	PUSH_FAILED          ResponseErrCode = 1034
 )
 
+// the maximum number of items of a batch command
+const MAX_BATCH_SIZE = 10000
+
 type Response struct {
 	Status    ResponseStatusCode
 	ErrorCode ResponseErrCode
@@ -62,7 +74,7 @@ func NewProcessor() Processor {
 // receive message from client
 func (p *processor) Receive(queue *core.DelayQueue, contents []string) *Response {
 	// defer conn.Close()
-	if queue == nil || !queue.IsReady {
+	if queue == nil || !queue.IsReady() {
 		return &Response{
 			Status:    Fail,
 			ErrorCode: NOT_READY,
@@ -72,11 +84,23 @@ func (p *processor) Receive(queue *core.DelayQueue, contents []string) *Response
 	// message format is:
 	// first line is auth code; 0 ----------|
 	// second line is cmd name; 1 ----------|
-	// third line is delay seconds or task id(for update, delete); 2 ----------|
-	// fourth line is notify way 3 ----------|
+	// third line is delay seconds(or a duration such as 250ms), due time(for push at),
+	// task id(for update, delete, status, reschedule), task id of the dead letter(for replay, * replays all of them),
+	// schedule id(for pause, resume and cancel schedule),
+	// the url encoded filter of list tasks, such as due_within=10m&tag.tenant=a&limit=20,
+	// the url encoded schedule of push schedule, such as cron=0 9 * * *&tz=Asia/Shanghai&max=10,
+	// the json array of the tasks of push chain, such as
+	// [{"id":"a","delay":"1h","mode":1,"target":"http://...","data":"..."},{"delay":"10m","mode":2,"target":"queue","data":"...","depends_on":["a"]}],
+	// or the json array of the items of a batch command, such as [{"delay":"60","mode":1,"target":"http://...","data":"..."}] for push batch,
+	// [{"id":"...","mode":1,"target":"http://...","data":"..."}] for update batch and ["id1","id2"] for delete batch; 2 ----------|
+	// fourth line is notify way, or the new delay or due time of reschedule and reschedule at 3 ----------|
 	// fifth line http url if task mode is HTTP, or is queueName if task mode is PubSub; 4 ----------|
 	// sixth line is message contents; 5 ----------|
-	if len(contents) < 2 || len(contents) > 6 {
+	// seventh line is optional tags of push, push at and push schedule, such as tenant=a&order_id=1001; 6 ----------|
+	// eighth line is optional url encoded options of push, push at and push schedule:
+	// id or idempotency_key to deduplicate the push, debounce or throttle to push on a logical key,
+	// such as id=order-1001 or debounce=reminder_user_1; 7 ----------|
+	if len(contents) < 2 || len(contents) > 8 {
 		return &Response{
 			Status:    Fail,
 			ErrorCode: INVALID_MESSAGE,
@@ -101,14 +125,22 @@ func (p *processor) Receive(queue *core.DelayQueue, contents []string) *Response
 
 	switch cmd {
 	case Push:
-		if len(contents) != 6 {
+		if len(contents) < 6 {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_PUSH_MESSAGE,
+			}
+		}
+		opts, err := parseTaskOptions(contents)
+		if err != nil {
 			return &Response{
 				Status:    Fail,
 				ErrorCode: INVALID_PUSH_MESSAGE,
+				Message:   err.Error(),
 			}
 		}
-		delaySeconds, _ := strconv.Atoi(contents[2])
-		if delaySeconds <= 0 {
+		delay := parseDelay(contents[2])
+		if delay <= 0 {
 			return &Response{
 				Status:    Fail,
 				ErrorCode: INVALID_DELAY_TIME,
@@ -119,9 +151,9 @@ func (p *processor) Receive(queue *core.DelayQueue, contents []string) *Response
 		taskData := contents[5]
 		switch notify.NotifyMode(wayCode) {
 		case notify.HTTP:
-			return p.executePush(queue, taskTarget, taskData, delaySeconds, notify.HTTP)
+			return p.executePush(queue, taskTarget, taskData, delay, notify.HTTP, opts...)
 		case notify.SubPub:
-			return p.executePush(queue, taskTarget, taskData, delaySeconds, notify.SubPub)
+			return p.executePush(queue, taskTarget, taskData, delay, notify.SubPub, opts...)
 		default:
 			return &Response{
 				Status:    Fail,
@@ -130,6 +162,141 @@ func (p *processor) Receive(queue *core.DelayQueue, contents []string) *Response
 			}
 		}
 
+	case PushAt:
+		if len(contents) < 6 {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_PUSH_MESSAGE,
+			}
+		}
+		opts, err := parseTaskOptions(contents)
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_PUSH_MESSAGE,
+				Message:   err.Error(),
+			}
+		}
+		dueAt, err := parseDueTime(contents[2])
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_DELAY_TIME,
+				Message:   err.Error(),
+			}
+		}
+		wayCode, _ := strconv.Atoi(contents[3])
+		mode := notify.NotifyMode(wayCode)
+		if mode != notify.HTTP && mode != notify.SubPub {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_PUSH_MESSAGE,
+				Message:   "Invalid notify way.",
+			}
+		}
+		task, err := queue.PushAt(dueAt, mode, fmt.Sprintf("%s|%s", contents[4], contents[5]), opts...)
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_DELAY_TIME,
+				Message:   err.Error(),
+			}
+		}
+		return &Response{
+			Status:  Ok,
+			Message: task.Id,
+		}
+	case PushChain:
+		if len(contents) != 3 {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_PUSH_MESSAGE,
+			}
+		}
+		chainTasks, err := parseChain(contents[2])
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_PUSH_MESSAGE,
+				Message:   err.Error(),
+			}
+		}
+		tasks, err := queue.PushChain(chainTasks)
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_PUSH_MESSAGE,
+				Message:   err.Error(),
+			}
+		}
+		ids := make([]string, len(tasks))
+		for i, task := range tasks {
+			ids[i] = task.Id
+		}
+		result, _ := json.Marshal(ids)
+		return &Response{
+			Status:  Ok,
+			Message: string(result),
+		}
+	case PushBatch, UpdateBatch, DeleteBatch:
+		if len(contents) != 3 {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_MESSAGE,
+			}
+		}
+		switch cmd {
+		case PushBatch:
+			return p.pushBatch(queue, contents[2])
+		case UpdateBatch:
+			return p.updateBatch(queue, contents[2])
+		default:
+			return p.deleteBatch(queue, contents[2])
+		}
+	case PushSchedule:
+		if len(contents) < 6 {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_PUSH_MESSAGE,
+			}
+		}
+		opts, err := parseTaskOptions(contents)
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_PUSH_MESSAGE,
+				Message:   err.Error(),
+			}
+		}
+		schedule, err := parseSchedule(contents[2])
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_PUSH_MESSAGE,
+				Message:   err.Error(),
+			}
+		}
+		wayCode, _ := strconv.Atoi(contents[3])
+		mode := notify.NotifyMode(wayCode)
+		if mode != notify.HTTP && mode != notify.SubPub {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_PUSH_MESSAGE,
+				Message:   "Invalid notify way.",
+			}
+		}
+		task, err := queue.PushSchedule(schedule, mode, fmt.Sprintf("%s|%s", contents[4], contents[5]), opts...)
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_PUSH_MESSAGE,
+				Message:   err.Error(),
+			}
+		}
+		return &Response{
+			Status:  Ok,
+			Message: task.Schedule.Id,
+		}
 	case Update:
 		if len(contents) != 6 {
 			return &Response{
@@ -175,6 +342,206 @@ func (p *processor) Receive(queue *core.DelayQueue, contents []string) *Response
 				Message: taskId,
 			}
 		}
+	case ListDeadLetters:
+		deadLetters, err := json.Marshal(queue.ListDeadLetters())
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: DEAD_LETTER_FAILED,
+				Message:   err.Error(),
+			}
+		}
+		return &Response{
+			Status:  Ok,
+			Message: string(deadLetters),
+		}
+	case ReplayDeadLetters:
+		if len(contents) != 3 {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_MESSAGE,
+			}
+		}
+		taskId := strings.TrimSpace(contents[2])
+		if taskId == "*" {
+			replayed, err := queue.ReplayAllDeadLetters()
+			if err != nil {
+				return &Response{
+					Status:    Fail,
+					ErrorCode: DEAD_LETTER_FAILED,
+					Message:   err.Error(),
+				}
+			}
+			return &Response{
+				Status:  Ok,
+				Message: strconv.Itoa(replayed),
+			}
+		}
+		if _, err := queue.ReplayDeadLetter(taskId); err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: DEAD_LETTER_FAILED,
+				Message:   err.Error(),
+			}
+		}
+		return &Response{
+			Status:  Ok,
+			Message: taskId,
+		}
+	case PurgeDeadLetters:
+		purged, err := queue.PurgeDeadLetters()
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: DEAD_LETTER_FAILED,
+				Message:   err.Error(),
+			}
+		}
+		return &Response{
+			Status:  Ok,
+			Message: strconv.Itoa(purged),
+		}
+	case TaskStatus:
+		if len(contents) != 3 {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_MESSAGE,
+			}
+		}
+		task, err := queue.GetTaskStatus(strings.TrimSpace(contents[2]))
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: TASK_NOT_FOUND,
+				Message:   err.Error(),
+			}
+		}
+		status, err := json.Marshal(task)
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_MESSAGE,
+				Message:   err.Error(),
+			}
+		}
+		return &Response{
+			Status:  Ok,
+			Message: string(status),
+		}
+	case Reschedule, RescheduleAt:
+		if len(contents) != 4 {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_MESSAGE,
+			}
+		}
+		taskId := strings.TrimSpace(contents[2])
+		var task *core.Task
+		var err error
+		if cmd == Reschedule {
+			delay := parseDelay(contents[3])
+			if delay <= 0 {
+				return &Response{
+					Status:    Fail,
+					ErrorCode: INVALID_DELAY_TIME,
+				}
+			}
+			task, err = queue.Reschedule(taskId, delay)
+		} else {
+			dueAt, parseErr := parseDueTime(contents[3])
+			if parseErr != nil {
+				return &Response{
+					Status:    Fail,
+					ErrorCode: INVALID_DELAY_TIME,
+					Message:   parseErr.Error(),
+				}
+			}
+			task, err = queue.RescheduleAt(taskId, dueAt)
+		}
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: RESCHEDULE_FAILED,
+				Message:   err.Error(),
+			}
+		}
+		return &Response{
+			Status:  Ok,
+			Message: task.Id,
+		}
+	case PauseSchedule, ResumeSchedule, CancelSchedule:
+		if len(contents) != 3 {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_MESSAGE,
+			}
+		}
+		scheduleId := strings.TrimSpace(contents[2])
+		var err error
+		switch cmd {
+		case PauseSchedule:
+			err = queue.PauseSchedule(scheduleId)
+		case ResumeSchedule:
+			_, err = queue.ResumeSchedule(scheduleId)
+		default:
+			err = queue.CancelSchedule(scheduleId)
+		}
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: SCHEDULE_FAILED,
+				Message:   err.Error(),
+			}
+		}
+		return &Response{
+			Status:  Ok,
+			Message: scheduleId,
+		}
+	case ListTasks:
+		filter := core.TaskFilter{}
+		if len(contents) > 2 {
+			var err error
+			if filter, err = parseTaskFilter(contents[2], queue.Now()); err != nil {
+				return &Response{
+					Status:    Fail,
+					ErrorCode: INVALID_MESSAGE,
+					Message:   err.Error(),
+				}
+			}
+		}
+		page, err := queue.ListTasks(filter)
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: LIST_FAILED,
+				Message:   err.Error(),
+			}
+		}
+		tasks, err := json.Marshal(page)
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: LIST_FAILED,
+				Message:   err.Error(),
+			}
+		}
+		return &Response{
+			Status:  Ok,
+			Message: string(tasks),
+		}
+	case Stats:
+		stats, err := json.Marshal(&statsMessage{PoolStats: queue.PoolStats(), Lag: queue.Lag()})
+		if err != nil {
+			return &Response{
+				Status:    Fail,
+				ErrorCode: INVALID_MESSAGE,
+				Message:   err.Error(),
+			}
+		}
+		return &Response{
+			Status:  Ok,
+			Message: string(stats),
+		}
 	default:
 		return &Response{
 			Status:    Fail,
@@ -184,8 +551,8 @@ func (p *processor) Receive(queue *core.DelayQueue, contents []string) *Response
 	}
 }
 
-func (p *processor) executePush(queue *core.DelayQueue, target, data string, delaySeconds int, mode notify.NotifyMode) *Response {
-	task, err := queue.Push(time.Duration(delaySeconds)*time.Second, mode, fmt.Sprintf("%s|%s", target, data))
+func (p *processor) executePush(queue *core.DelayQueue, target, data string, delay time.Duration, mode notify.NotifyMode, opts ...core.TaskOption) *Response {
+	task, err := queue.Push(delay, mode, fmt.Sprintf("%s|%s", target, data), opts...)
 	if err != nil {
 		return &Response{
 			Status:    Fail,
@@ -198,3 +565,224 @@ func (p *processor) executePush(queue *core.DelayQueue, target, data string, del
 		Message: task.Id,
 	}
 }
+
+// the delay is whole seconds, or a duration string for sub-second delays, such as 250ms or 1.5s
+func parseDelay(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil {
+		return 0
+	}
+	return delay
+}
+
+// the due time is a unix timestamp in seconds, or a RFC3339 time such as 2023-02-01T09:00:00Z
+func parseDueTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// the options of a pushed task from the optional lines after the message contents
+func parseTaskOptions(contents []string) ([]core.TaskOption, error) {
+	opts := []core.TaskOption{}
+	if len(contents) > 6 && strings.TrimSpace(contents[6]) != "" {
+		tags, err := parseTags(contents[6])
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, core.WithTags(tags))
+	}
+	if len(contents) > 7 && strings.TrimSpace(contents[7]) != "" {
+		values, err := url.ParseQuery(strings.TrimSpace(contents[7]))
+		if err != nil {
+			return nil, errors.New("Invalid push options.")
+		}
+		if values.Get("debounce") != "" && values.Get("throttle") != "" {
+			return nil, errors.New("Only one of debounce and throttle can be set.")
+		}
+		for key := range values {
+			switch key {
+			case "id":
+				opts = append(opts, core.WithTaskId(values.Get(key)))
+			case "idempotency_key":
+				opts = append(opts, core.WithIdempotencyKey(values.Get(key)))
+			case "debounce":
+				opts = append(opts, core.WithDebounce(values.Get(key)))
+			case "throttle":
+				opts = append(opts, core.WithThrottle(values.Get(key)))
+			default:
+				return nil, fmt.Errorf("Unknown push option %s.", key)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// the tags are url encoded key/value pairs, such as tenant=a&order_id=1001
+func parseTags(value string) (map[string]string, error) {
+	values, err := url.ParseQuery(strings.TrimSpace(value))
+	if err != nil {
+		return nil, errors.New("Invalid tags.")
+	}
+	tags := map[string]string{}
+	for key := range values {
+		tags[key] = values.Get(key)
+	}
+	return tags, nil
+}
+
+// the filter is url encoded, the due times are unix timestamps or RFC3339 times,
+// due_within selects the tasks which are due from now on within the duration, tags are prefixed by tag.
+func parseTaskFilter(value string, now time.Time) (core.TaskFilter, error) {
+	filter := core.TaskFilter{}
+	values, err := url.ParseQuery(strings.TrimSpace(value))
+	if err != nil {
+		return filter, errors.New("Invalid filter.")
+	}
+	for key := range values {
+		param := values.Get(key)
+		switch {
+		case key == "due_after" || key == "due_before":
+			dueTime, err := parseDueTime(param)
+			if err != nil {
+				return filter, fmt.Errorf("Invalid %s.", key)
+			}
+			if key == "due_after" {
+				filter.DueAfter = dueTime
+			} else {
+				filter.DueBefore = dueTime
+			}
+		case key == "due_within":
+			within, err := time.ParseDuration(param)
+			if err != nil {
+				return filter, errors.New("Invalid due_within.")
+			}
+			filter.DueAfter = now
+			filter.DueBefore = filter.DueAfter.Add(within)
+		case key == "mode":
+			mode, _ := strconv.Atoi(param)
+			filter.TaskMode = notify.NotifyMode(mode)
+		case key == "target":
+			filter.Target = param
+		case key == "offset":
+			filter.Offset, _ = strconv.Atoi(param)
+		case key == "limit":
+			filter.Limit, _ = strconv.Atoi(param)
+		case strings.HasPrefix(key, "tag."):
+			if filter.Tags == nil {
+				filter.Tags = map[string]string{}
+			}
+			filter.Tags[strings.TrimPrefix(key, "tag.")] = param
+		default:
+			return filter, fmt.Errorf("Unknown filter %s.", key)
+		}
+	}
+	return filter, nil
+}
+
+// the schedule is url encoded, such as cron=0 9 * * *&tz=Asia/Shanghai&start=2023-02-01T00:00:00Z&max=10,
+// or interval=30&fixed_delay=true for a task repeated every 30 seconds.
+// the interval is in seconds or a duration such as 1m30s, the start and end times are unix timestamps or RFC3339 times,
+// and the id is optional.
+func parseSchedule(value string) (core.Schedule, error) {
+	schedule := core.Schedule{}
+	values, err := url.ParseQuery(strings.TrimSpace(value))
+	if err != nil {
+		return schedule, errors.New("Invalid schedule.")
+	}
+	for key := range values {
+		param := values.Get(key)
+		switch key {
+		case "id":
+			schedule.Id = param
+		case "cron":
+			schedule.Cron = param
+		case "tz":
+			schedule.TimeZone = param
+		case "interval":
+			if schedule.Interval = parseDelay(param); schedule.Interval <= 0 {
+				return schedule, errors.New("Invalid interval.")
+			}
+		case "fixed_delay":
+			if schedule.FixedDelay, err = strconv.ParseBool(param); err != nil {
+				return schedule, errors.New("Invalid fixed_delay.")
+			}
+		case "start", "end":
+			t, err := parseDueTime(param)
+			if err != nil {
+				return schedule, fmt.Errorf("Invalid %s.", key)
+			}
+			if key == "start" {
+				schedule.StartAt = t
+			} else {
+				schedule.EndAt = t
+			}
+		case "max":
+			if schedule.MaxOccurrences, err = strconv.Atoi(param); err != nil {
+				return schedule, errors.New("Invalid max.")
+			}
+		default:
+			return schedule, fmt.Errorf("Unknown schedule field %s.", key)
+		}
+	}
+	if schedule.Cron == "" && schedule.Interval == 0 {
+		return schedule, errors.New("The cron expression or the interval is required.")
+	}
+	return schedule, nil
+}
+
+// the stats of the worker pool in the stats message, with how far the time wheel is behind the clock
+type statsMessage struct {
+	core.PoolStats
+	Lag time.Duration
+}
+
+// a task of a chain in the push chain message
+type chainTaskMessage struct {
+	Id string `json:"id"`
+	// seconds or a duration such as 10m
+	Delay     string            `json:"delay"`
+	Mode      int               `json:"mode"`
+	Target    string            `json:"target"`
+	Data      string            `json:"data"`
+	DependsOn []string          `json:"depends_on"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// the chain is a json array of tasks, the tasks refer to each other by their ids
+func parseChain(value string) ([]core.ChainTask, error) {
+	messages := []chainTaskMessage{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(value)), &messages); err != nil {
+		return nil, errors.New("Invalid chain.")
+	}
+	chainTasks := make([]core.ChainTask, len(messages))
+	for i, message := range messages {
+		mode := notify.NotifyMode(message.Mode)
+		if mode != notify.HTTP && mode != notify.SubPub {
+			return nil, errors.New("Invalid notify way.")
+		}
+		delay := time.Duration(0)
+		if message.Delay != "" {
+			if delay = parseDelay(message.Delay); delay <= 0 && strings.TrimSpace(message.Delay) != "0" {
+				return nil, errors.New("Invalid delay.")
+			}
+		}
+		chainTasks[i] = core.ChainTask{
+			Id:        message.Id,
+			Delay:     delay,
+			TaskMode:  mode,
+			TaskData:  fmt.Sprintf("%s|%s", message.Target, message.Data),
+			DependsOn: message.DependsOn,
+		}
+		if len(message.Tags) > 0 {
+			chainTasks[i].Options = []core.TaskOption{core.WithTags(message.Tags)}
+		}
+	}
+	return chainTasks, nil
+}
@@ -1,12 +1,17 @@
 package message
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/raymondmars/go-delayqueue/internal/app/core"
 	"github.com/raymondmars/go-delayqueue/internal/app/notify"
+	"github.com/raymondmars/go-delayqueue/internal/pkg/clock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,21 +44,195 @@ func (td *testDoNothingDb) RemoveAll() error {
 	return nil
 }
 
-func (td *testDoNothingDb) GetWheelTimePointer() int {
-	return 0
+func (td *testDoNothingDb) QueryTasks(filter core.TaskFilter) ([]*core.Task, int, error) {
+	return []*core.Task{}, 0, nil
 }
 
-func (td *testDoNothingDb) SaveWheelTimePointer(index int) error {
+func (td *testDoNothingDb) GetWheelTimePointer() (int, time.Time) {
+	return 0, time.Time{}
+}
+
+func (td *testDoNothingDb) SaveWheelTimePointer(index int, savedAt time.Time) error {
+	return nil
+}
+
+func (td *testDoNothingDb) SaveDeadLetter(task *core.Task) error {
+	return nil
+}
+
+func (td *testDoNothingDb) GetDeadLetters() []*core.Task {
+	return []*core.Task{}
+}
+
+func (td *testDoNothingDb) DeleteDeadLetter(taskId string) error {
+	return nil
+}
+
+func (td *testDoNothingDb) RemoveAllDeadLetters() error {
+	return nil
+}
+
+func (td *testDoNothingDb) SaveInFlight(task *core.Task) error {
+	return nil
+}
+
+func (td *testDoNothingDb) GetInFlight() []*core.Task {
+	return []*core.Task{}
+}
+
+func (td *testDoNothingDb) DeleteInFlight(taskId string) error {
+	return nil
+}
+
+func (td *testDoNothingDb) SaveStatus(task *core.Task, retention time.Duration) error {
+	return nil
+}
+
+func (td *testDoNothingDb) GetStatus(taskId string) *core.Task {
+	return nil
+}
+
+func (td *testDoNothingDb) SaveSchedule(task *core.Task) error {
+	return nil
+}
+
+func (td *testDoNothingDb) GetSchedule(scheduleId string) *core.Task {
+	return nil
+}
+
+func (td *testDoNothingDb) GetSchedules() []*core.Task {
+	return nil
+}
+
+func (td *testDoNothingDb) DeleteSchedule(scheduleId string) error {
+	return nil
+}
+
+func (td *testDoNothingDb) SaveBatch(tasks []*core.Task) error {
+	return nil
+}
+
+func (td *testDoNothingDb) DeleteBatch(taskIds []string) error {
+	return nil
+}
+
+func (td *testDoNothingDb) SaveWaiting(task *core.Task) error {
+	return nil
+}
+
+func (td *testDoNothingDb) GetWaiting(taskId string) *core.Task {
+	return nil
+}
+
+func (td *testDoNothingDb) GetWaitingList() []*core.Task {
 	return nil
 }
 
+func (td *testDoNothingDb) DeleteWaiting(taskId string) error {
+	return nil
+}
+
+func (td *testDoNothingDb) ClaimIdempotencyKey(key string, task *core.Task, retention time.Duration) (*core.Task, error) {
+	return nil, nil
+}
+
+func (td *testDoNothingDb) ReleaseIdempotencyKey(key string, taskId string) error {
+	return nil
+}
+
+// keeps the dead letters in memory
+type testDeadLetterDb struct {
+	testDoNothingDb
+	sync.Mutex
+	deadLetters map[string]*core.Task
+}
+
+func (td *testDeadLetterDb) SaveDeadLetter(task *core.Task) error {
+	td.Lock()
+	defer td.Unlock()
+	td.deadLetters[task.Id] = task
+	return nil
+}
+
+func (td *testDeadLetterDb) GetDeadLetters() []*core.Task {
+	td.Lock()
+	defer td.Unlock()
+	tasks := []*core.Task{}
+	for _, task := range td.deadLetters {
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+func (td *testDeadLetterDb) DeleteDeadLetter(taskId string) error {
+	td.Lock()
+	defer td.Unlock()
+	delete(td.deadLetters, taskId)
+	return nil
+}
+
+func (td *testDeadLetterDb) RemoveAllDeadLetters() error {
+	td.Lock()
+	defer td.Unlock()
+	td.deadLetters = map[string]*core.Task{}
+	return nil
+}
+
+// keeps the tasks in memory to query them
+type testTaskListDb struct {
+	testDoNothingDb
+	sync.Mutex
+	tasks map[string]*core.Task
+}
+
+func (td *testTaskListDb) Save(task *core.Task) error {
+	td.Lock()
+	defer td.Unlock()
+	saved := *task
+	saved.Next = nil
+	td.tasks[task.Id] = &saved
+	return nil
+}
+
+func (td *testTaskListDb) GetList() []*core.Task {
+	td.Lock()
+	defer td.Unlock()
+	tasks := []*core.Task{}
+	for _, task := range td.tasks {
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+func (td *testTaskListDb) Delete(taskId string) error {
+	td.Lock()
+	defer td.Unlock()
+	delete(td.tasks, taskId)
+	return nil
+}
+
+func (td *testTaskListDb) SaveBatch(tasks []*core.Task) error {
+	for _, task := range tasks {
+		td.Save(task)
+	}
+	return nil
+}
+
+func (td *testTaskListDb) DeleteBatch(taskIds []string) error {
+	for _, taskId := range taskIds {
+		td.Delete(taskId)
+	}
+	return nil
+}
+
+func (td *testTaskListDb) QueryTasks(filter core.TaskFilter) ([]*core.Task, int, error) {
+	tasks, total := core.QueryTasks(td.GetList(), filter)
+	return tasks, total, nil
+}
+
 func testQueue() *core.DelayQueue {
 	presisDb := &testDoNothingDb{}
-	return &core.DelayQueue{
-		Persistence:    presisDb,
-		TaskExecutor:   testFactory,
-		TaskQueryTable: make(core.SlotRecorder),
-	}
+	return core.New(core.WithTaskExecutor(testFactory), core.WithPersistence(presisDb))
 }
 
 func TestProcessor(t *testing.T) {
@@ -85,13 +264,21 @@ func TestProcessor(t *testing.T) {
 	assert.Equal(t, Fail, resp.Status)
 	assert.Equal(t, INVALID_DELAY_TIME, resp.ErrorCode)
 
+	resp = processor.Receive(dq, []string{messageAuthCode, "2", "abc", "1", "http://www.google.com", "test"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_DELAY_TIME, resp.ErrorCode)
+
 	resp = processor.Receive(dq, []string{messageAuthCode, "2", "100", "1", "http://www.google.com"})
 	assert.Equal(t, Fail, resp.Status)
 	assert.Equal(t, INVALID_PUSH_MESSAGE, resp.ErrorCode)
 
 	resp = processor.Receive(dq, []string{messageAuthCode, "2", "50", "1", "http://www.google.com", "test"})
 	assert.Equal(t, Ok, resp.Status)
-	assert.Equal(t, 1, dq.WheelTaskQuantity(50%core.WHEEL_SIZE))
+	assert.Equal(t, 1, dq.WheelTaskQuantity(0, 50))
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "2", "1500ms", "1", "http://www.google.com", "test"})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, 1, dq.WheelTaskQuantity(0, 2))
 
 	resp = processor.Receive(dq, []string{messageAuthCode, "2", "100", "2", "queue_name"})
 	assert.Equal(t, Fail, resp.Status)
@@ -99,13 +286,27 @@ func TestProcessor(t *testing.T) {
 
 	resp = processor.Receive(dq, []string{messageAuthCode, "2", "100", "2", "queue_name", "test"})
 	assert.Equal(t, Ok, resp.Status)
-	assert.Equal(t, 1, dq.WheelTaskQuantity(100%core.WHEEL_SIZE))
+	assert.Equal(t, 1, dq.WheelTaskQuantity(1, 1))
 
 	resp = processor.Receive(dq, []string{messageAuthCode, "2", "100", "3", "queue_name", "test"})
 	assert.Equal(t, Fail, resp.Status)
 	assert.Equal(t, INVALID_PUSH_MESSAGE, resp.ErrorCode)
 	assert.Equal(t, "Invalid notify way.", resp.Message)
 
+	// test push task at a specific time
+	resp = processor.Receive(dq, []string{messageAuthCode, "5", "tomorrow", "1", "http://www.google.com", "test"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_DELAY_TIME, resp.ErrorCode)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "5", fmt.Sprintf("%d", time.Now().Add(-time.Hour).Unix()), "1", "http://www.google.com", "test"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_DELAY_TIME, resp.ErrorCode)
+
+	dueAt := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	resp = processor.Receive(dq, []string{messageAuthCode, "5", dueAt.Format(time.RFC3339), "2", "queue_name", "test"})
+	assert.Equal(t, Ok, resp.Status)
+	assert.True(t, dueAt.Equal(dq.GetTask(resp.Message).DueAt))
+
 	// test update task from client
 	resp = processor.Receive(dq, []string{messageAuthCode, "2", "50", "1", "http://www.google.com", "test1"})
 	assert.Equal(t, Ok, resp.Status)
@@ -125,12 +326,356 @@ func TestProcessor(t *testing.T) {
 	// push a task to queue
 	resp = processor.Receive(dq, []string{messageAuthCode, "2", fmt.Sprintf("%d", delaySeconds), "1", "http://www.google.com", "test1"})
 	assert.Equal(t, Ok, resp.Status)
-	assert.Equal(t, 1, dq.WheelTaskQuantity(delaySeconds%core.WHEEL_SIZE))
+	assert.Equal(t, 1, dq.WheelTaskQuantity(0, delaySeconds))
 
 	taskId = resp.Message
 
 	// send delete message
 	resp = processor.Receive(dq, []string{messageAuthCode, "4", taskId})
 	assert.Equal(t, Ok, resp.Status)
-	assert.Equal(t, 0, dq.WheelTaskQuantity(delaySeconds%core.WHEEL_SIZE))
+	assert.Equal(t, 0, dq.WheelTaskQuantity(0, delaySeconds))
+}
+
+func TestProcessDeadLetters(t *testing.T) {
+	db := &testDeadLetterDb{deadLetters: map[string]*core.Task{}}
+	dq := core.New(core.WithTaskExecutor(testFactory), core.WithPersistence(db))
+	dq.Start()
+	defer dq.Stop(context.Background())
+	for _, id := range []string{"1", "2", "3"} {
+		db.SaveDeadLetter(&core.Task{Id: id, TaskMode: notify.HTTP, TaskData: "http://www.google.com|test", DueAt: time.Now().Add(time.Hour), LastError: "failed"})
+	}
+	processor := NewProcessor()
+
+	resp := processor.Receive(dq, []string{messageAuthCode, "6"})
+	assert.Equal(t, Ok, resp.Status)
+	deadLetters := []*core.Task{}
+	assert.Nil(t, json.Unmarshal([]byte(resp.Message), &deadLetters))
+	assert.Equal(t, 3, len(deadLetters))
+	assert.Equal(t, "failed", deadLetters[0].LastError)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "7"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_MESSAGE, resp.ErrorCode)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "7", "not-exist"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, DEAD_LETTER_FAILED, resp.ErrorCode)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "7", "1"})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, "1", resp.Message)
+	assert.Equal(t, 2, len(dq.ListDeadLetters()))
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "8"})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, "2", resp.Message)
+	assert.Equal(t, 0, len(dq.ListDeadLetters()))
+
+	db.SaveDeadLetter(&core.Task{Id: "4", TaskMode: notify.HTTP, TaskData: "http://www.google.com|test"})
+	resp = processor.Receive(dq, []string{messageAuthCode, "7", "*"})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, "1", resp.Message)
+}
+
+func TestProcessStats(t *testing.T) {
+	dq := testQueue()
+	dq.Start()
+	defer dq.Stop(context.Background())
+	processor := NewProcessor()
+
+	resp := processor.Receive(dq, []string{messageAuthCode, "9"})
+	assert.Equal(t, Ok, resp.Status)
+	stats := statsMessage{}
+	assert.Nil(t, json.Unmarshal([]byte(resp.Message), &stats))
+	assert.Equal(t, core.DEFAULT_POOL_WORKERS, stats.Workers)
+	assert.Contains(t, resp.Message, `"Lag":`)
+}
+
+func TestProcessTaskStatus(t *testing.T) {
+	dq := testQueue()
+	processor := NewProcessor()
+	dq.Start()
+	defer dq.Stop(context.Background())
+
+	resp := processor.Receive(dq, []string{messageAuthCode, "10", "not-exist"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, TASK_NOT_FOUND, resp.ErrorCode)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "2", "100", "1", "http://www.google.com", "test"})
+	assert.Equal(t, Ok, resp.Status)
+	resp = processor.Receive(dq, []string{messageAuthCode, "10", resp.Message})
+	assert.Equal(t, Ok, resp.Status)
+	task := core.Task{}
+	assert.Nil(t, json.Unmarshal([]byte(resp.Message), &task))
+	assert.Equal(t, core.TaskPending, task.State)
+	assert.Equal(t, "http://www.google.com|test", task.TaskData)
+}
+
+func TestProcessPushWithTags(t *testing.T) {
+	dq := testQueue()
+	processor := NewProcessor()
+	dq.Start()
+	defer dq.Stop(context.Background())
+
+	resp := processor.Receive(dq, []string{messageAuthCode, "2", "100", "1", "http://www.google.com", "test", "tenant=a&order_id=1001"})
+	assert.Equal(t, Ok, resp.Status)
+	task := dq.GetTask(resp.Message)
+	assert.Equal(t, map[string]string{"tenant": "a", "order_id": "1001"}, task.Tags)
+	assert.False(t, task.CreatedAt.IsZero())
+
+	dueAt := time.Now().Add(time.Hour).Unix()
+	resp = processor.Receive(dq, []string{messageAuthCode, "5", fmt.Sprintf("%d", dueAt), "2", "queue_name", "test", "source=billing"})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, "billing", dq.GetTask(resp.Message).Tags["source"])
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "2", "100", "1", "http://www.google.com", "test", "tenant=%zz"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_PUSH_MESSAGE, resp.ErrorCode)
+}
+
+func TestProcessListTasks(t *testing.T) {
+	db := &testTaskListDb{tasks: map[string]*core.Task{}}
+	// due_within is counted from the clock of the queue
+	fake := clock.NewFake(time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC))
+	dq := core.New(core.WithTaskExecutor(testFactory), core.WithPersistence(db), core.WithClock(fake))
+	processor := NewProcessor()
+	dq.Start()
+	defer dq.Stop(context.Background())
+
+	for i := 1; i <= 5; i++ {
+		resp := processor.Receive(dq, []string{messageAuthCode, "2", fmt.Sprintf("%dm", i*5), "1", "http://www.google.com", "test", "tenant=a"})
+		assert.Equal(t, Ok, resp.Status)
+	}
+	resp := processor.Receive(dq, []string{messageAuthCode, "2", "5m", "2", "queue_name", "test", "tenant=b"})
+	assert.Equal(t, Ok, resp.Status)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "11"})
+	assert.Equal(t, Ok, resp.Status)
+	page := core.TaskPage{}
+	assert.Nil(t, json.Unmarshal([]byte(resp.Message), &page))
+	assert.Equal(t, 6, page.Total)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "11", "due_within=12m&tag.tenant=a&mode=1&target=http://www.google.com&limit=1"})
+	assert.Equal(t, Ok, resp.Status)
+	page = core.TaskPage{}
+	assert.Nil(t, json.Unmarshal([]byte(resp.Message), &page))
+	assert.Equal(t, 2, page.Total)
+	assert.Equal(t, 1, len(page.Tasks))
+	assert.Equal(t, 1, page.NextOffset)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "11", "due_within=soon"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_MESSAGE, resp.ErrorCode)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "11", "color=red"})
+	assert.Equal(t, Fail, resp.Status)
+}
+
+func TestProcessReschedule(t *testing.T) {
+	dq := testQueue()
+	processor := NewProcessor()
+	dq.Start()
+	defer dq.Stop(context.Background())
+
+	resp := processor.Receive(dq, []string{messageAuthCode, "2", "100", "1", "http://www.google.com", "test"})
+	assert.Equal(t, Ok, resp.Status)
+	taskId := resp.Message
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "12", taskId, "10m"})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, taskId, resp.Message)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), dq.GetTask(taskId).DueAt, time.Second)
+
+	dueAt := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Second)
+	resp = processor.Receive(dq, []string{messageAuthCode, "13", taskId, dueAt.Format(time.RFC3339)})
+	assert.Equal(t, Ok, resp.Status)
+	assert.True(t, dueAt.Equal(dq.GetTask(taskId).DueAt))
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "12", taskId, "later"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_DELAY_TIME, resp.ErrorCode)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "12", "not-exist", "10m"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, RESCHEDULE_FAILED, resp.ErrorCode)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "13", taskId})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_MESSAGE, resp.ErrorCode)
+}
+
+func TestProcessPushSchedule(t *testing.T) {
+	db := &testTaskListDb{tasks: map[string]*core.Task{}}
+	dq := core.New(core.WithTaskExecutor(testFactory), core.WithPersistence(db))
+	processor := NewProcessor()
+	dq.Start()
+	defer dq.Stop(context.Background())
+
+	resp := processor.Receive(dq, []string{messageAuthCode, "14", "id=report&cron=0 9 * * MON-FRI&tz=Asia/Shanghai&max=10", "1", "http://www.google.com", "test", "tenant=a"})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, "report", resp.Message)
+	page, _ := dq.ListTasks(core.TaskFilter{Tags: map[string]string{"tenant": "a"}})
+	assert.Equal(t, 1, page.Total)
+	task := page.Tasks[0]
+	assert.Equal(t, "report", task.Schedule.Id)
+	assert.Equal(t, "Asia/Shanghai", task.Schedule.TimeZone)
+	assert.Equal(t, 10, task.Schedule.MaxOccurrences)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "14", "tz=Asia/Shanghai", "1", "http://www.google.com", "test"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_PUSH_MESSAGE, resp.ErrorCode)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "14", "cron=0 9 * *", "1", "http://www.google.com", "test"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_PUSH_MESSAGE, resp.ErrorCode)
+}
+
+func TestProcessPauseResumeAndCancelSchedule(t *testing.T) {
+	db := &testTaskListDb{tasks: map[string]*core.Task{}}
+	dq := core.New(core.WithTaskExecutor(testFactory), core.WithPersistence(db))
+	processor := NewProcessor()
+	dq.Start()
+	defer dq.Stop(context.Background())
+
+	resp := processor.Receive(dq, []string{messageAuthCode, "14", "id=heartbeat&interval=1m&fixed_delay=true", "1", "http://www.google.com", "test"})
+	assert.Equal(t, Ok, resp.Status)
+	page, _ := dq.ListTasks(core.TaskFilter{})
+	assert.Equal(t, 1, page.Total)
+	assert.Equal(t, time.Minute, page.Tasks[0].Schedule.Interval)
+	assert.True(t, page.Tasks[0].Schedule.FixedDelay)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "14", "interval=1m&cron=* * * * *", "1", "http://www.google.com", "test"})
+	assert.Equal(t, Fail, resp.Status)
+	resp = processor.Receive(dq, []string{messageAuthCode, "14", "interval=soon", "1", "http://www.google.com", "test"})
+	assert.Equal(t, Fail, resp.Status)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "15", "heartbeat"})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, "heartbeat", resp.Message)
+	// the do nothing db keeps no paused schedule
+	resp = processor.Receive(dq, []string{messageAuthCode, "16", "heartbeat"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, SCHEDULE_FAILED, resp.ErrorCode)
+
+	processor.Receive(dq, []string{messageAuthCode, "14", "id=report&interval=1h", "1", "http://www.google.com", "test"})
+	resp = processor.Receive(dq, []string{messageAuthCode, "17", "report"})
+	assert.Equal(t, Ok, resp.Status)
+	resp = processor.Receive(dq, []string{messageAuthCode, "17", "report"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, SCHEDULE_FAILED, resp.ErrorCode)
+	resp = processor.Receive(dq, []string{messageAuthCode, "17"})
+	assert.Equal(t, INVALID_MESSAGE, resp.ErrorCode)
+}
+
+func TestProcessPushWithTaskId(t *testing.T) {
+	db := &testTaskListDb{tasks: map[string]*core.Task{}}
+	dq := core.New(core.WithTaskExecutor(testFactory), core.WithPersistence(db))
+	processor := NewProcessor()
+	dq.Start()
+	defer dq.Stop(context.Background())
+
+	for i := 0; i < 2; i++ {
+		resp := processor.Receive(dq, []string{messageAuthCode, "2", "60", "1", "http://www.google.com", "test", "", "id=order-1001"})
+		assert.Equal(t, Ok, resp.Status)
+		assert.Equal(t, "order-1001", resp.Message)
+	}
+	page, _ := dq.ListTasks(core.TaskFilter{})
+	assert.Equal(t, 1, page.Total)
+
+	resp := processor.Receive(dq, []string{messageAuthCode, "2", "60", "1", "http://www.google.com", "test", "tenant=a", "idempotency_key=request-1"})
+	assert.Equal(t, Ok, resp.Status)
+	task := dq.GetTask(resp.Message)
+	assert.Equal(t, "request-1", task.IdempotencyKey)
+	assert.Equal(t, "a", task.Tags["tenant"])
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "2", "60", "1", "http://www.google.com", "test", "", "key=request-1"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_PUSH_MESSAGE, resp.ErrorCode)
+}
+
+func TestProcessDebounceAndThrottle(t *testing.T) {
+	db := &testTaskListDb{tasks: map[string]*core.Task{}}
+	dq := core.New(core.WithTaskExecutor(testFactory), core.WithPersistence(db))
+	processor := NewProcessor()
+	dq.Start()
+	defer dq.Stop(context.Background())
+
+	first := processor.Receive(dq, []string{messageAuthCode, "2", "60", "1", "http://www.google.com", "first", "", "debounce=user-1"})
+	assert.Equal(t, Ok, first.Status)
+	resp := processor.Receive(dq, []string{messageAuthCode, "2", "120", "1", "http://www.google.com", "second", "", "debounce=user-1"})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, first.Message, resp.Message)
+	assert.Equal(t, "http://www.google.com|second", dq.GetTask(first.Message).TaskData)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "2", "120", "1", "http://www.google.com", "third", "", "throttle=user-1"})
+	assert.Equal(t, first.Message, resp.Message)
+	assert.Equal(t, "http://www.google.com|second", dq.GetTask(first.Message).TaskData)
+	page, _ := dq.ListTasks(core.TaskFilter{})
+	assert.Equal(t, 1, page.Total)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "2", "60", "1", "http://www.google.com", "test", "", "debounce=user-1&throttle=user-1"})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_PUSH_MESSAGE, resp.ErrorCode)
+}
+
+func TestProcessPushChain(t *testing.T) {
+	db := &testTaskListDb{tasks: map[string]*core.Task{}}
+	dq := core.New(core.WithTaskExecutor(testFactory), core.WithPersistence(db))
+	processor := NewProcessor()
+	dq.Start()
+	defer dq.Stop(context.Background())
+
+	chain := `[{"id":"billing","delay":"1h","mode":1,"target":"http://www.google.com","data":"charge","tags":{"tenant":"a"}},` +
+		`{"id":"publish","delay":"600","mode":2,"target":"billing_done","data":"done","depends_on":["billing"]}]`
+	resp := processor.Receive(dq, []string{messageAuthCode, "18", chain})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, `["billing","publish"]`, resp.Message)
+	task := dq.GetTask("billing")
+	assert.Equal(t, "http://www.google.com|charge", task.TaskData)
+	assert.Equal(t, "a", task.Tags["tenant"])
+	assert.Equal(t, []string{"publish"}, task.Children)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "18", `[{"id":"a","delay":"1h","mode":1,"target":"t","data":"d","depends_on":["b"]}]`})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_PUSH_MESSAGE, resp.ErrorCode)
+	resp = processor.Receive(dq, []string{messageAuthCode, "18", `[{"id":"a","delay":"soon","mode":1}]`})
+	assert.Equal(t, Fail, resp.Status)
+	resp = processor.Receive(dq, []string{messageAuthCode, "18", `not json`})
+	assert.Equal(t, Fail, resp.Status)
+}
+
+func TestProcessBatchCommands(t *testing.T) {
+	db := &testTaskListDb{tasks: map[string]*core.Task{}}
+	dq := core.New(core.WithTaskExecutor(testFactory), core.WithPersistence(db))
+	processor := NewProcessor()
+	dq.Start()
+	defer dq.Stop(context.Background())
+
+	batch := `[{"id":"a","delay":"1h","mode":1,"target":"http://www.google.com","data":"a","tags":{"tenant":"a"}},` +
+		`{"id":"b","delay":"600","mode":2,"target":"topic","data":"b"},` +
+		`{"delay":"soon","mode":1,"target":"t","data":"c"},` +
+		`{"delay":"600","mode":9,"target":"t","data":"d"}]`
+	resp := processor.Receive(dq, []string{messageAuthCode, "19", batch})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, fmt.Sprintf(`[{"id":"a"},{"id":"b"},{"code":%d,"message":"Invalid delay."},{"code":%d,"message":"Invalid notify way."}]`, INVALID_DELAY_TIME, INVALID_PUSH_MESSAGE),
+		resp.Message)
+	assert.Equal(t, "a", dq.GetTask("a").Tags["tenant"])
+	assert.Equal(t, 2, len(db.GetList()))
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "20", `[{"id":"a","mode":2,"target":"topic","data":"changed"},{"id":"x","mode":1,"target":"t","data":"d"}]`})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, fmt.Sprintf(`[{"id":"a"},{"code":%d,"message":"task not found"}]`, TASK_NOT_FOUND), resp.Message)
+	assert.Equal(t, "topic|changed", dq.GetTask("a").TaskData)
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "21", `["a","b","x"]`})
+	assert.Equal(t, Ok, resp.Status)
+	assert.Equal(t, fmt.Sprintf(`[{"id":"a"},{"id":"b"},{"code":%d,"message":"task not found"}]`, TASK_NOT_FOUND), resp.Message)
+	assert.Nil(t, dq.GetTask("a"))
+	assert.Equal(t, 0, len(db.GetList()))
+
+	resp = processor.Receive(dq, []string{messageAuthCode, "21", `not json`})
+	assert.Equal(t, Fail, resp.Status)
+	assert.Equal(t, INVALID_MESSAGE, resp.ErrorCode)
+	resp = processor.Receive(dq, []string{messageAuthCode, "19"})
+	assert.Equal(t, INVALID_MESSAGE, resp.ErrorCode)
 }
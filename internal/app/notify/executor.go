@@ -4,3 +4,26 @@ package notify
 type Executor interface {
 	DoDelayTask(contents string) error
 }
+
+// PermanentError is returned by an executor when the task will fail again on retry,
+// such as invalid task contents
+type PermanentError struct {
+	Err error
+}
+
+func NewPermanentError(err error) *PermanentError {
+	return &PermanentError{Err: err}
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// the task should not be retried
+func (e *PermanentError) Retryable() bool {
+	return false
+}
@@ -40,11 +40,17 @@ func (nt *httpNotify) DoDelayTask(contents string) error {
 		defer resp.Body.Close()
 		if resp.StatusCode != 200 {
 			log.Warnln(fmt.Sprintf("http request response is %d", resp.StatusCode))
-			return errors.New("http request response is not 200")
+			err := errors.New("http request response is not 200")
+			// the client errors will not change on retry, except timeout and too many requests
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+				resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+				return NewPermanentError(err)
+			}
+			return err
 		}
 		return nil
 	} else {
 		log.Warnln(fmt.Sprintf("invalid http notify contents: %s", contents))
-		return errors.New("invalid notify contents")
+		return NewPermanentError(errors.New("invalid notify contents"))
 	}
 }
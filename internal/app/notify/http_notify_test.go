@@ -37,6 +37,15 @@ func (c *mockHttpNoneOkClient) Do(req *http.Request) (*http.Response, error) {
 	}, nil
 }
 
+type mockHttpNotFoundClient struct{}
+
+func (c *mockHttpNotFoundClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusNotFound,
+		Body:       mockBody,
+	}, nil
+}
+
 func TestHttpNofityDoDelayTask(t *testing.T) {
 	notifyOk := &httpNotify{
 		Client: &mockHttpOkClient{},
@@ -53,3 +62,21 @@ func TestHttpNofityDoDelayTask(t *testing.T) {
 	assert.Error(t, errors.New(fmt.Sprintf("http notify error: %s", "invalid request data")), notifyErr.DoDelayTask("https://google.com|test"))
 	assert.Error(t, errors.New("http request response is not 200"), notifyNoneOk.DoDelayTask("https://google.com|test"))
 }
+
+func TestHttpNofityPermanentErrors(t *testing.T) {
+	var permanent *PermanentError
+	notifyOk := &httpNotify{
+		Client: &mockHttpOkClient{},
+	}
+	assert.True(t, errors.As(notifyOk.DoDelayTask("test"), &permanent))
+
+	notifyNotFound := &httpNotify{
+		Client: &mockHttpNotFoundClient{},
+	}
+	assert.True(t, errors.As(notifyNotFound.DoDelayTask("https://google.com|test"), &permanent))
+
+	notifyNoneOk := &httpNotify{
+		Client: &mockHttpNoneOkClient{},
+	}
+	assert.False(t, errors.As(notifyNoneOk.DoDelayTask("https://google.com|test"), &permanent))
+}
@@ -0,0 +1,51 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2023, 2, 1, 9, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+	assert.Equal(t, start, fake.Now())
+
+	first := fake.NewTimer(time.Minute)
+	second := fake.After(time.Hour)
+	stopped := fake.NewTimer(time.Second)
+	assert.Equal(t, 3, fake.Timers())
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	fake.Advance(30 * time.Second)
+	select {
+	case <-first.C():
+		t.Fatal("the timer expired early")
+	default:
+	}
+	fake.Advance(30 * time.Second)
+	assert.Equal(t, start.Add(time.Minute), <-first.C())
+	assert.False(t, first.Stop())
+	assert.Equal(t, 1, fake.Timers())
+
+	// the clock never goes back
+	fake.Set(start)
+	assert.Equal(t, start.Add(time.Minute), fake.Now())
+	fake.Set(start.Add(2 * time.Hour))
+	assert.Equal(t, start.Add(time.Hour), <-second)
+	assert.Equal(t, 0, fake.Timers())
+
+	// a timer which is already due expires at once
+	select {
+	case <-fake.After(0):
+	default:
+		t.Fatal("the timer did not expire")
+	}
+	select {
+	case <-stopped.C():
+		t.Fatal("the stopped timer expired")
+	default:
+	}
+}
@@ -0,0 +1,216 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the next occurrence is searched within this number of years
+const MAX_SEARCH_YEARS = 5
+
+// Expression is a parsed cron expression,
+// each field is a bit set of the values it matches.
+type Expression struct {
+	second, minute, hour, dom, month, dow uint64
+	// the day of month or the day of week is not restricted by a *
+	domStar, dowStar bool
+}
+
+type bounds struct {
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	secondBounds = bounds{0, 59, nil}
+	minuteBounds = bounds{0, 59, nil}
+	hourBounds   = bounds{0, 23, nil}
+	domBounds    = bounds{1, 31, nil}
+	monthBounds  = bounds{1, 12, map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// both 0 and 7 are sunday
+	dowBounds = bounds{0, 7, map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// Parse a cron expression of five fields: minute, hour, day of month, month and day of week,
+// or six fields with the seconds first. A field is *, a value, a range such as 1-5,
+// a step such as */15 or 1-30/5, or a list of them such as 1,15,30.
+// Months and days of week can be names such as JAN or MON, ? is the same as *.
+// The macros @yearly, @monthly, @weekly, @daily and @hourly are supported too.
+func Parse(spec string) (*Expression, error) {
+	spec = strings.TrimSpace(spec)
+	if macro, ok := macros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("expected 5 or 6 fields, found %d: %s", len(fields), spec)
+	}
+
+	expr := &Expression{}
+	var err error
+	if expr.second, err = parseField(fields[0], secondBounds); err != nil {
+		return nil, err
+	}
+	if expr.minute, err = parseField(fields[1], minuteBounds); err != nil {
+		return nil, err
+	}
+	if expr.hour, err = parseField(fields[2], hourBounds); err != nil {
+		return nil, err
+	}
+	if expr.dom, err = parseField(fields[3], domBounds); err != nil {
+		return nil, err
+	}
+	if expr.month, err = parseField(fields[4], monthBounds); err != nil {
+		return nil, err
+	}
+	if expr.dow, err = parseField(fields[5], dowBounds); err != nil {
+		return nil, err
+	}
+	// sunday can be written as 7
+	if expr.dow&(1<<7) != 0 {
+		expr.dow = expr.dow&^(1<<7) | 1
+	}
+	expr.domStar = isStar(fields[3])
+	expr.dowStar = isStar(fields[5])
+	return expr, nil
+}
+
+func isStar(field string) bool {
+	return field == "*" || field == "?"
+}
+
+// parse a field into the bit set of the values it matches
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeAndStep := strings.SplitN(part, "/", 2)
+		var start, end uint
+		if isStar(rangeAndStep[0]) {
+			start, end = b.min, b.max
+		} else {
+			lowAndHigh := strings.SplitN(rangeAndStep[0], "-", 2)
+			var err error
+			if start, err = parseValue(lowAndHigh[0], b); err != nil {
+				return 0, err
+			}
+			end = start
+			if len(lowAndHigh) == 2 {
+				if end, err = parseValue(lowAndHigh[1], b); err != nil {
+					return 0, err
+				}
+			}
+		}
+		step := uint(1)
+		if len(rangeAndStep) == 2 {
+			value, err := strconv.ParseUint(rangeAndStep[1], 10, 32)
+			if err != nil || value == 0 {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+			step = uint(value)
+			// a single value with a step runs to the end of the range, such as 5/15
+			if !isStar(rangeAndStep[0]) && !strings.Contains(rangeAndStep[0], "-") {
+				end = b.max
+			}
+		}
+		if start > end {
+			return 0, fmt.Errorf("invalid range: %s", part)
+		}
+		for value := start; value <= end; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(value string, b bounds) (uint, error) {
+	if number, ok := b.names[strings.ToLower(value)]; ok {
+		return number, nil
+	}
+	number, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value: %s", value)
+	}
+	if uint(number) < b.min || uint(number) > b.max {
+		return 0, fmt.Errorf("value %d is out of range [%d, %d]", number, b.min, b.max)
+	}
+	return uint(number), nil
+}
+
+// Next returns the first time after t which matches the expression in the location of t,
+// the zero time is returned if there is none within MAX_SEARCH_YEARS years.
+func (e *Expression) Next(t time.Time) time.Time {
+	loc := t.Location()
+	// start from the next whole second
+	t = t.Add(time.Second - time.Duration(t.Nanosecond()))
+	yearLimit := t.Year() + MAX_SEARCH_YEARS
+
+WRAP:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+
+	for e.month&(1<<uint(t.Month())) == 0 {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		if t.Month() == time.January {
+			goto WRAP
+		}
+	}
+	for !e.matchDay(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		if t.Day() == 1 {
+			goto WRAP
+		}
+	}
+	// add durations instead of building the times, so the hours skipped by daylight saving are passed over
+	for e.hour&(1<<uint(t.Hour())) == 0 {
+		t = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second)
+		if t.Hour() == 0 {
+			goto WRAP
+		}
+	}
+	for e.minute&(1<<uint(t.Minute())) == 0 {
+		t = t.Add(time.Minute - time.Duration(t.Second())*time.Second)
+		if t.Minute() == 0 {
+			goto WRAP
+		}
+	}
+	for e.second&(1<<uint(t.Second())) == 0 {
+		t = t.Add(time.Second)
+		if t.Second() == 0 {
+			goto WRAP
+		}
+	}
+	return t
+}
+
+// the day matches when both the day of month and the day of week match,
+// or either of them matches if neither is a *, as in the classic cron
+func (e *Expression) matchDay(t time.Time) bool {
+	domMatch := e.dom&(1<<uint(t.Day())) != 0
+	dowMatch := e.dow&(1<<uint(t.Weekday())) != 0
+	if e.domStar || e.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
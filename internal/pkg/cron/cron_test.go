@@ -0,0 +1,72 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInvalidExpressions(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "* * * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "5-1 * * * *", "*/0 * * * *", "* * * FOO *"} {
+		_, err := Parse(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestNext(t *testing.T) {
+	from := time.Date(2023, 2, 1, 9, 30, 15, 500, time.UTC)
+	cases := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2023, 2, 1, 9, 31, 0, 0, time.UTC)},
+		{"* * * * * *", time.Date(2023, 2, 1, 9, 30, 16, 0, time.UTC)},
+		{"*/20 * * * * *", time.Date(2023, 2, 1, 9, 30, 20, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2023, 2, 2, 9, 0, 0, 0, time.UTC)},
+		{"45 9-17/2 * * *", time.Date(2023, 2, 1, 9, 45, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2023, 2, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 8 * * MON-FRI", time.Date(2023, 2, 2, 8, 0, 0, 0, time.UTC)},
+		{"0 8 * * sun", time.Date(2023, 2, 5, 8, 0, 0, 0, time.UTC)},
+		{"0 8 * * 7", time.Date(2023, 2, 5, 8, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 JAN ?", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// either the day of month or the day of week
+		{"0 0 10 * SAT", time.Date(2023, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"30 5/10 * * * *", time.Date(2023, 2, 1, 9, 35, 30, 0, time.UTC)},
+		{"@daily", time.Date(2023, 2, 2, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2023, 2, 1, 10, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		expr, err := Parse(c.spec)
+		assert.Nil(t, err, c.spec)
+		assert.Equal(t, c.next, expr.Next(from), c.spec)
+	}
+
+	// never happens
+	expr, _ := Parse("0 0 30 2 *")
+	assert.True(t, expr.Next(from).IsZero())
+}
+
+func TestNextInTimeZone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone database is not available")
+	}
+	expr, _ := Parse("0 9 * * *")
+	next := expr.Next(time.Date(2023, 2, 1, 12, 0, 0, 0, time.UTC).In(loc))
+	assert.Equal(t, time.Date(2023, 2, 1, 14, 0, 0, 0, time.UTC), next.UTC())
+
+	// 2:30 does not exist on the day daylight saving starts
+	expr, _ = Parse("30 2 * * *")
+	next = expr.Next(time.Date(2023, 3, 11, 12, 0, 0, 0, loc))
+	assert.Equal(t, time.Date(2023, 3, 13, 2, 30, 0, 0, loc), next)
+
+	// a half hour offset
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err == nil {
+		next = expr.Next(time.Date(2023, 2, 1, 12, 0, 0, 0, kolkata))
+		assert.Equal(t, time.Date(2023, 2, 2, 2, 30, 0, 0, kolkata), next)
+	}
+}